@@ -1,29 +1,78 @@
 package api
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
 	admission "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// sendAdmissionReviewError create an admission review with an
+// admissionError is an error denying an admission request, as opposed to
+// internal errors which are reported to the API server as webhook failures
+type admissionError struct {
+	code    int32
+	reason  metav1.StatusReason
+	message string
+}
+
+func (e admissionError) Error() string {
+	return e.message
+}
+
+// denied returns an admissionError with a status code and reason
+func denied(code int32, reason metav1.StatusReason, format string, a ...interface{}) error {
+	return admissionError{code: code, reason: reason, message: fmt.Sprintf(format, a...)}
+}
+
+// IsDenied returns true if an error denies a value, such as an invalid or
+// forbidden placeholder, as opposed to a failure to read it
+func IsDenied(err error) bool {
+	var denial admissionError
+	return errors.As(err, &denial)
+}
+
+// sendAdmissionReviewDenied attach a response denying the request to an
+// admission review and write it to http.ResponseWriter. The API server
+// receives a well-formed response and rejects the object without applying
+// the webhook failurePolicy. Warnings are returned to the client along with
+// the denial.
+func (s *Server) sendAdmissionReviewDenied(w http.ResponseWriter, ar admission.AdmissionReview, denial admissionError, warnings ...string) {
+	ar.Response = &admission.AdmissionResponse{
+		UID:      ar.Request.UID,
+		Allowed:  false,
+		Warnings: warnings,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    denial.code,
+			Reason:  denial.reason,
+			Message: denial.message,
+		},
+	}
+
+	s.sendAdmissionReview(w, ar)
+}
+
+// sendAdmissionReviewError create an admission review with an internal
 // error set as response message and write it to http.ResponseWriter
-func (s *Server) sendAdmissionReviewError(w http.ResponseWriter, err error) {
-
-	// Create empty AdmissionReview with an error
-	// set as response message
-	ar := admission.AdmissionReview{
-		Response: &admission.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+// with a server error code, so that the API server applies the webhook
+// failurePolicy
+func (s *Server) sendAdmissionReviewError(w http.ResponseWriter, ar admission.AdmissionReview, err error) {
+
+	// Create AdmissionReview with an error set as response message
+	ar.Response = &admission.AdmissionResponse{
+		UID: ar.Request.UID,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusInternalServerError,
+			Reason:  metav1.StatusReasonInternalError,
+			Message: err.Error(),
 		},
 	}
 
 	// Marshal admission review with response
-	arResp, err := json.Marshal(ar)
+	arResp, err := encodeAdmissionReview(ar)
 	if err != nil {
 		s.Logger.Errorf("failed to marshal response: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -31,7 +80,8 @@ func (s *Server) sendAdmissionReviewError(w http.ResponseWriter, err error) {
 	}
 
 	// Set http code to server error
-	w.WriteHeader(500)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
 
 	// Send admission review back to kubernetes
 	_, err = w.Write(arResp)
@@ -44,8 +94,8 @@ func (s *Server) sendAdmissionReviewError(w http.ResponseWriter, err error) {
 // sendAdmissionReview masharl and write to http.ResponseWriter an admission review
 func (s *Server) sendAdmissionReview(w http.ResponseWriter, ar admission.AdmissionReview) {
 
-	// Marshal Admission Rreview
-	resp, err := json.Marshal(ar)
+	// Marshal Admission Rreview in requested version
+	resp, err := encodeAdmissionReview(ar)
 	if err != nil {
 		s.Logger.Errorf("failed to marshal response: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -53,6 +103,7 @@ func (s *Server) sendAdmissionReview(w http.ResponseWriter, ar admission.Admissi
 	}
 
 	// Send admission review back to kubernetes
+	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(resp)
 	if err != nil {
 		s.Logger.Errorf("failed to write admission review response: %s", err)
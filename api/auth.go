@@ -0,0 +1,235 @@
+package api
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ouest-France/k8s-vault-webhook/filewatch"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// AuthModeAll requires every enabled authentication method to succeed
+	AuthModeAll = "all"
+	// AuthModeAny requires at least one enabled authentication method to succeed
+	AuthModeAny = "any"
+
+	// fileWatchInterval is the polling interval of watched files
+	fileWatchInterval = 10 * time.Second
+)
+
+// setupAuth loads basicauth file, watching it for changes, and initialises
+// verification cache and failure throttling
+func (s *Server) setupAuth() error {
+	s.authCache = newAuthCache(s.BasicAuthCacheTTL)
+	s.authThrottle = newAuthThrottle(s.AuthFailureLimit, s.AuthFailureWindow)
+
+	if s.BasicAuthFile == "" {
+		return nil
+	}
+
+	var err error
+	s.htpasswd, err = newHtpasswd(s.BasicAuthFile)
+	if err != nil {
+		return err
+	}
+
+	go filewatch.Watch(fileWatchInterval, nil, func() {
+		err := s.htpasswd.reload()
+		if err != nil {
+			s.Logger.WithError(err).Error("failed to reload basicauth file, keeping previous credentials")
+			return
+		}
+		s.authCache.flush()
+		s.Logger.Info("basicauth file reloaded")
+	}, s.BasicAuthFile)
+
+	return nil
+}
+
+// checkBasicAuth checks request user/password against basicauth list
+// defined by flags or config
+func (s *Server) checkBasicAuth(r *http.Request) error {
+
+	// Extract user/password from request
+	reqUser, reqPass, ok := r.BasicAuth()
+	if !ok {
+		return errors.New("missing basicauth credentials")
+	}
+
+	// Skip bcrypt comparison if credentials were recently verified
+	if s.authCache.valid(reqUser, reqPass) {
+		return nil
+	}
+
+	// Collect brcypt hashed passwords of user from flags, config and basicauth file
+	hashes := []string{}
+	for _, cfgBasicauth := range s.BasicAuth {
+		cfgUserPass := strings.SplitN(cfgBasicauth, ":", 2)
+		if cfgUserPass[0] == reqUser {
+			hashes = append(hashes, cfgUserPass[1])
+		}
+	}
+	if hash, ok := s.htpasswd.hash(reqUser); ok {
+		hashes = append(hashes, hash)
+	}
+
+	// Check password
+	for _, hash := range hashes {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(reqPass))
+		if err == nil {
+			s.authCache.add(reqUser, reqPass)
+			return nil
+		}
+	}
+
+	return errors.New("invalid basicauth credentials")
+}
+
+// checkClientCert checks that the request carries a client certificate verified
+// against the configured CA bundle and, if a list of allowed names is defined,
+// that its subject common name or one of its SANs is allowed
+func (s *Server) checkClientCert(r *http.Request) error {
+
+	// Certificate chain is verified by the TLS handshake against ClientCA
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return errors.New("missing verified client certificate")
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	// Any verified certificate is accepted without allowed names
+	if len(s.ClientNames) == 0 {
+		return nil
+	}
+
+	for _, name := range certificateNames(cert) {
+		for _, allowed := range s.ClientNames {
+			if name == allowed {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("client certificate %q is not allowed", cert.Subject.CommonName)
+}
+
+// certificateNames returns the subject common name and all SANs of a certificate
+func certificateNames(cert *x509.Certificate) []string {
+	names := []string{}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	return names
+}
+
+// loadClientCAs reads a PEM CA bundle used to verify client certificates
+func loadClientCAs(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificate found in client CA file %q", file)
+	}
+
+	return pool, nil
+}
+
+// authThrottle rejects requests from source IPs with too many
+// authentication failures within a time window
+type authThrottle struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	failures map[string]*failureWindow
+}
+
+// failureWindow counts authentication failures since start
+type failureWindow struct {
+	start time.Time
+	count int
+}
+
+// newAuthThrottle returns a throttle allowing limit failures per window,
+// or nil (throttling disabled) if limit or window is not positive
+func newAuthThrottle(limit int, window time.Duration) *authThrottle {
+	if limit <= 0 || window <= 0 {
+		return nil
+	}
+
+	return &authThrottle{limit: limit, window: window, failures: map[string]*failureWindow{}}
+}
+
+// blocked returns true if the source IP reached the failure limit in current window
+func (t *authThrottle) blocked(ip string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	failures, ok := t.failures[ip]
+	if !ok {
+		return false
+	}
+	if time.Since(failures.start) > t.window {
+		delete(t.failures, ip)
+		return false
+	}
+
+	return failures.count >= t.limit
+}
+
+// fail records an authentication failure for the source IP
+func (t *authThrottle) fail(ip string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Drop expired windows so the map doesn't grow unbounded
+	now := time.Now()
+	for key, failures := range t.failures {
+		if now.Sub(failures.start) > t.window {
+			delete(t.failures, key)
+		}
+	}
+
+	failures, ok := t.failures[ip]
+	if !ok {
+		t.failures[ip] = &failureWindow{start: now, count: 1}
+		return
+	}
+	failures.count++
+}
+
+// sourceIP returns the IP address of the request client
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
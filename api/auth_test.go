@@ -0,0 +1,82 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestServer_RequestAuth(t *testing.T) {
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basicauth := []string{"user:" + string(hash)}
+
+	apiserver := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "kube-apiserver"},
+		DNSNames: []string{"apiserver.cluster.local"},
+	}
+
+	var authTests = []struct {
+		description string
+		basicAuth   []string
+		clientCA    string
+		clientNames []string
+		authMode    string
+		user        string
+		pass        string
+		cert        *x509.Certificate
+		status      int
+	}{
+		{"Test no auth configured", nil, "", nil, AuthModeAll, "", "", nil, http.StatusOK},
+		{"Test valid basicauth", basicauth, "", nil, AuthModeAll, "user", "pass", nil, http.StatusOK},
+		{"Test invalid basicauth", basicauth, "", nil, AuthModeAll, "user", "wrong", nil, http.StatusForbidden},
+		{"Test missing basicauth", basicauth, "", nil, AuthModeAll, "", "", nil, http.StatusForbidden},
+		{"Test valid client certificate", nil, "ca.pem", nil, AuthModeAll, "", "", apiserver, http.StatusOK},
+		{"Test missing client certificate", nil, "ca.pem", nil, AuthModeAll, "", "", nil, http.StatusForbidden},
+		{"Test client certificate allowed by CN", nil, "ca.pem", []string{"kube-apiserver"}, AuthModeAll, "", "", apiserver, http.StatusOK},
+		{"Test client certificate allowed by SAN", nil, "ca.pem", []string{"apiserver.cluster.local"}, AuthModeAll, "", "", apiserver, http.StatusOK},
+		{"Test client certificate not allowed", nil, "ca.pem", []string{"other"}, AuthModeAll, "", "", apiserver, http.StatusForbidden},
+		{"Test all mode with both methods valid", basicauth, "ca.pem", nil, AuthModeAll, "user", "pass", apiserver, http.StatusOK},
+		{"Test all mode with only certificate valid", basicauth, "ca.pem", nil, AuthModeAll, "", "", apiserver, http.StatusForbidden},
+		{"Test any mode with only certificate valid", basicauth, "ca.pem", nil, AuthModeAny, "", "", apiserver, http.StatusOK},
+		{"Test any mode with only basicauth valid", basicauth, "ca.pem", nil, AuthModeAny, "user", "pass", nil, http.StatusOK},
+		{"Test any mode with no method valid", basicauth, "ca.pem", nil, AuthModeAny, "user", "wrong", nil, http.StatusForbidden},
+	}
+
+	for _, test := range authTests {
+
+		s := Server{
+			Logger:      logrus.New(),
+			BasicAuth:   test.basicAuth,
+			ClientCA:    test.clientCA,
+			ClientNames: test.clientNames,
+			AuthMode:    test.authMode,
+		}
+
+		handler := s.RequestAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		req := httptest.NewRequest(http.MethodPost, "/secret", nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.pass)
+		}
+		req.TLS = &tls.ConnectionState{}
+		if test.cert != nil {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{test.cert}}
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		require.Equal(t, test.status, rec.Code, test.description)
+	}
+}
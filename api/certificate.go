@@ -0,0 +1,73 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+
+	"github.com/Ouest-France/k8s-vault-webhook/filewatch"
+	"github.com/sirupsen/logrus"
+)
+
+// certReloader serves the HTTPS certificate loaded from disk and reloads
+// it when certificate or key files change
+type certReloader struct {
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+	logger   *logrus.Logger
+}
+
+// newCertReloader loads certificate and key files and watch them for changes
+func newCertReloader(certFile, keyFile string, logger *logrus.Logger) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	err := c.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	go filewatch.Watch(fileWatchInterval, nil, func() {
+		err := c.reload()
+		if err != nil {
+			c.logger.WithError(err).Error("failed to reload certificate, keeping previous one")
+			return
+		}
+		c.logger.Info("certificate reloaded")
+	}, certFile, keyFile)
+
+	return c, nil
+}
+
+// reload reads certificate and key pair from disk, current pair is kept
+// if the new files are invalid or don't match
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %s", err)
+	}
+	cert.Leaf = leaf
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+
+	// Expose certificate expiry for Prometheus metrics
+	certificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+
+	return nil
+}
+
+// GetCertificate returns the current certificate for tls.Config
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
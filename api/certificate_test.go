@@ -0,0 +1,90 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key as PEM files
+func writeTestCertificate(t *testing.T, certFile, keyFile, cn string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		DNSNames:     []string{cn},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader_reload(t *testing.T) {
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	firstExpiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	writeTestCertificate(t, certFile, keyFile, "first.svc", firstExpiry)
+
+	c, err := newCertReloader(certFile, keyFile, logrus.New())
+	require.Nil(t, err, "Test initial certificate load")
+
+	cert, err := c.GetCertificate(nil)
+	require.Nil(t, err)
+	require.Equal(t, "first.svc", cert.Leaf.Subject.CommonName, "Test initial certificate served")
+	require.Equal(t, float64(firstExpiry.Unix()), testutil.ToFloat64(certificateExpiry), "Test initial certificate expiry metric")
+
+	// Rotated certificate is served after reload
+	secondExpiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	writeTestCertificate(t, certFile, keyFile, "second.svc", secondExpiry)
+	require.Nil(t, c.reload(), "Test rotated certificate reload")
+
+	cert, err = c.GetCertificate(nil)
+	require.Nil(t, err)
+	require.Equal(t, "second.svc", cert.Leaf.Subject.CommonName, "Test rotated certificate served")
+	require.Equal(t, float64(secondExpiry.Unix()), testutil.ToFloat64(certificateExpiry), "Test rotated certificate expiry metric")
+
+	// Invalid files keep the last good pair
+	err = ioutil.WriteFile(keyFile, []byte("invalid"), 0600)
+	require.Nil(t, err)
+	require.NotNil(t, c.reload(), "Test invalid key reload")
+
+	cert, err = c.GetCertificate(nil)
+	require.Nil(t, err)
+	require.Equal(t, "second.svc", cert.Leaf.Subject.CommonName, "Test last good certificate kept")
+	require.Equal(t, float64(secondExpiry.Unix()), testutil.ToFloat64(certificateExpiry), "Test last good certificate expiry metric")
+}
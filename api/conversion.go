@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+
+	admission "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Supported AdmissionReview API versions
+const (
+	admissionV1      = "admission.k8s.io/v1"
+	admissionV1beta1 = "admission.k8s.io/v1beta1"
+)
+
+// decodeAdmissionReview decodes a v1 or v1beta1 admission review as v1,
+// APIVersion is left unchanged so the response is sent in the requested
+// version
+func decodeAdmissionReview(body []byte) (admission.AdmissionReview, error) {
+	var typeMeta metav1.TypeMeta
+	err := json.Unmarshal(body, &typeMeta)
+	if err != nil {
+		return admission.AdmissionReview{}, err
+	}
+
+	if typeMeta.APIVersion != admissionV1beta1 {
+		var ar admission.AdmissionReview
+		err = json.Unmarshal(body, &ar)
+		return ar, err
+	}
+
+	var ar v1beta1.AdmissionReview
+	err = json.Unmarshal(body, &ar)
+	if err != nil {
+		return admission.AdmissionReview{}, err
+	}
+
+	return reviewFromV1beta1(ar), nil
+}
+
+// encodeAdmissionReview marshals an admission review in its APIVersion
+func encodeAdmissionReview(ar admission.AdmissionReview) ([]byte, error) {
+	if ar.APIVersion == admissionV1beta1 {
+		return json.Marshal(reviewToV1beta1(ar))
+	}
+
+	return json.Marshal(ar)
+}
+
+// reviewFromV1beta1 converts a v1beta1 admission review to v1
+func reviewFromV1beta1(in v1beta1.AdmissionReview) admission.AdmissionReview {
+	out := admission.AdmissionReview{TypeMeta: in.TypeMeta}
+
+	if in.Request != nil {
+		out.Request = &admission.AdmissionRequest{
+			UID:                in.Request.UID,
+			Kind:               in.Request.Kind,
+			Resource:           in.Request.Resource,
+			SubResource:        in.Request.SubResource,
+			RequestKind:        in.Request.RequestKind,
+			RequestResource:    in.Request.RequestResource,
+			RequestSubResource: in.Request.RequestSubResource,
+			Name:               in.Request.Name,
+			Namespace:          in.Request.Namespace,
+			Operation:          admission.Operation(in.Request.Operation),
+			UserInfo:           in.Request.UserInfo,
+			Object:             in.Request.Object,
+			OldObject:          in.Request.OldObject,
+			DryRun:             in.Request.DryRun,
+			Options:            in.Request.Options,
+		}
+	}
+
+	if in.Response != nil {
+		out.Response = &admission.AdmissionResponse{
+			UID:              in.Response.UID,
+			Allowed:          in.Response.Allowed,
+			Result:           in.Response.Result,
+			Patch:            in.Response.Patch,
+			AuditAnnotations: in.Response.AuditAnnotations,
+			Warnings:         in.Response.Warnings,
+		}
+		if in.Response.PatchType != nil {
+			pt := admission.PatchType(*in.Response.PatchType)
+			out.Response.PatchType = &pt
+		}
+	}
+
+	return out
+}
+
+// reviewToV1beta1 converts a v1 admission review to v1beta1
+func reviewToV1beta1(in admission.AdmissionReview) v1beta1.AdmissionReview {
+	out := v1beta1.AdmissionReview{TypeMeta: in.TypeMeta}
+
+	if in.Request != nil {
+		out.Request = &v1beta1.AdmissionRequest{
+			UID:                in.Request.UID,
+			Kind:               in.Request.Kind,
+			Resource:           in.Request.Resource,
+			SubResource:        in.Request.SubResource,
+			RequestKind:        in.Request.RequestKind,
+			RequestResource:    in.Request.RequestResource,
+			RequestSubResource: in.Request.RequestSubResource,
+			Name:               in.Request.Name,
+			Namespace:          in.Request.Namespace,
+			Operation:          v1beta1.Operation(in.Request.Operation),
+			UserInfo:           in.Request.UserInfo,
+			Object:             in.Request.Object,
+			OldObject:          in.Request.OldObject,
+			DryRun:             in.Request.DryRun,
+			Options:            in.Request.Options,
+		}
+	}
+
+	if in.Response != nil {
+		out.Response = &v1beta1.AdmissionResponse{
+			UID:              in.Response.UID,
+			Allowed:          in.Response.Allowed,
+			Result:           in.Response.Result,
+			Patch:            in.Response.Patch,
+			AuditAnnotations: in.Response.AuditAnnotations,
+			Warnings:         in.Response.Warnings,
+		}
+		if in.Response.PatchType != nil {
+			pt := v1beta1.PatchType(*in.Response.PatchType)
+			out.Response.PatchType = &pt
+		}
+	}
+
+	return out
+}
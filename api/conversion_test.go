@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	admission "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestDecodeAdmissionReview(t *testing.T) {
+
+	secret := `{"apiVersion":"v1","kind":"Secret","metadata":{"name":"test-secret","namespace":"test-namespace"},"data":{"foo":"dmF1bHQ6Zm9vI2Jhcg=="},"type":"Opaque"}`
+
+	for _, version := range []string{admissionV1, admissionV1beta1} {
+		body := strings.Replace(admissionReviewJSON("Secret", secret), admissionV1, version, 1)
+		body = strings.Replace(body, `"operation":"CREATE"`, `"operation":"UPDATE","dryRun":true,"oldObject":`+secret, 1)
+
+		ar, err := decodeAdmissionReview([]byte(body))
+		require.Nil(t, err, version)
+		require.Equal(t, version, ar.APIVersion, "Test requested version is kept")
+		require.Equal(t, "705ab4f5-6393-11e8-b7cc-42010a800002", string(ar.Request.UID), version)
+		require.Equal(t, admission.Update, ar.Request.Operation, version)
+		require.Equal(t, "test-namespace", ar.Request.Namespace, version)
+		require.Equal(t, "admin", ar.Request.UserInfo.Username, version)
+		require.True(t, *ar.Request.DryRun, version)
+		require.JSONEq(t, secret, string(ar.Request.Object.Raw), version)
+		require.JSONEq(t, secret, string(ar.Request.OldObject.Raw), version)
+	}
+}
+
+func TestEncodeAdmissionReview(t *testing.T) {
+
+	pt := admission.PatchTypeJSONPatch
+	ar := admission.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview"},
+		Request:  &admission.AdmissionRequest{UID: "705ab4f5-6393-11e8-b7cc-42010a800002", Operation: admission.Create, Object: runtime.RawExtension{Raw: []byte(`{}`)}},
+		Response: &admission.AdmissionResponse{
+			UID:              "705ab4f5-6393-11e8-b7cc-42010a800002",
+			Allowed:          true,
+			Patch:            []byte(`[]`),
+			PatchType:        &pt,
+			Warnings:         []string{"warning"},
+			AuditAnnotations: map[string]string{"vault-reads": "{}"},
+		},
+	}
+
+	// v1 reviews are encoded unchanged
+	ar.APIVersion = admissionV1
+	v1JSON, err := encodeAdmissionReview(ar)
+	require.Nil(t, err)
+	expected, err := json.Marshal(ar)
+	require.Nil(t, err)
+	require.JSONEq(t, string(expected), string(v1JSON), "Test v1 review encoding")
+
+	// v1beta1 reviews are converted and round-trip to the same review
+	ar.APIVersion = admissionV1beta1
+	v1beta1JSON, err := encodeAdmissionReview(ar)
+	require.Nil(t, err)
+
+	var decoded v1beta1.AdmissionReview
+	require.Nil(t, json.Unmarshal(v1beta1JSON, &decoded))
+	require.Equal(t, admissionV1beta1, decoded.APIVersion, "Test v1beta1 review version")
+	require.Equal(t, v1beta1.PatchTypeJSONPatch, *decoded.Response.PatchType, "Test v1beta1 patch type")
+	require.Equal(t, ar, reviewFromV1beta1(decoded), "Test v1beta1 review round-trip")
+}
+
+func TestServer_secretHandlerVersions(t *testing.T) {
+
+	s := Server{
+		Vault:        fakeVaultClient{Value: "bar"},
+		VaultPattern: "secret/data/{{.Secret}}",
+		Logger:       logrus.New(),
+	}
+	secret := `{"apiVersion":"v1","kind":"Secret","metadata":{"name":"test-secret","namespace":"test-namespace"},"data":{"foo":"dmF1bHQ6Zm9vI2Jhcg=="},"type":"Opaque"}`
+
+	for _, version := range []string{admissionV1, admissionV1beta1} {
+		body := strings.Replace(admissionReviewJSON("Secret", secret), admissionV1, version, 1)
+
+		req := httptest.NewRequest(http.MethodPost, "/secret", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		s.Router().ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, version)
+
+		var review admission.AdmissionReview
+		require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &review), version)
+		require.Equal(t, version, review.APIVersion, "Test response in requested version")
+		require.Equal(t, "705ab4f5-6393-11e8-b7cc-42010a800002", string(review.Response.UID), version)
+		require.True(t, review.Response.Allowed, version)
+		require.JSONEq(t, `[{"op":"replace","path":"/data/foo","value":"YmFy"}]`, string(review.Response.Patch), version)
+	}
+
+	// Unsupported versions are rejected instead of being echoed
+	body := strings.Replace(admissionReviewJSON("Secret", secret), admissionV1, "admission.k8s.io/v2", 1)
+	req := httptest.NewRequest(http.MethodPost, "/secret", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.Router().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code, "Test unsupported version")
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// dryRunWarning is returned to clients on dry-run requests
+const dryRunWarning = "dry-run: vault placeholders were validated but not resolved"
+
+// VaultPathChecker interface is implemented by Vault clients able to check
+// a secret exists without retrieving its values
+type VaultPathChecker interface {
+	Exists(path string) (bool, error)
+}
+
+// checkVaultPath checks the secret of a placeholder exists on dry-run
+// requests if enabled and supported by its resolver, without reading its values
+func (s *Server) checkVaultPath(ph placeholder, path string) error {
+	if !s.DryRunCheckPaths {
+		return nil
+	}
+
+	r, ok := s.placeholderResolver(ph)
+	if !ok {
+		return nil
+	}
+	checker, ok := r.(VaultPathChecker)
+	if !ok {
+		return nil
+	}
+
+	exists, err := checker.Exists(path)
+	if err != nil {
+		return denied(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, "failed to check secret '%s' in vault: %s", path, err)
+	}
+	if !exists {
+		return denied(http.StatusNotFound, metav1.StatusReasonNotFound, "secret '%s' does not exist in vault", path)
+	}
+
+	return nil
+}
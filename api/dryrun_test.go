@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Fake Vault client checking paths and failing on reads for testing
+type fakeCheckerVaultClient struct {
+	Paths map[string]bool
+	Error bool
+}
+
+func (f fakeCheckerVaultClient) Read(path, key string) (string, error) {
+	return "", errors.New("vault must not be read on dry-run")
+}
+
+func (f fakeCheckerVaultClient) Exists(path string) (bool, error) {
+	if f.Error {
+		return false, errors.New("permission denied")
+	}
+	return f.Paths[path], nil
+}
+
+func TestServer_mutateSecretDataDryRun(t *testing.T) {
+
+	secret := corev1.Secret{Data: map[string][]byte{
+		"password": []byte("vault:db#password"),
+		"plain":    []byte("plain-value"),
+	}}
+	secret.Name = "test-secret"
+	secret.Namespace = "test-namespace"
+
+	var dryRunTests = []struct {
+		description string
+		vaultClient VaultClient
+		checkPaths  bool
+		statusCode  int32
+	}{
+		{"Test placeholders returned unchanged", fakeCheckerVaultClient{}, false, 0},
+		{"Test existing path is checked", fakeCheckerVaultClient{Paths: map[string]bool{"secret/data/db": true}}, true, 0},
+		{"Test missing path is denied", fakeCheckerVaultClient{}, true, http.StatusNotFound},
+		{"Test path check error is denied", fakeCheckerVaultClient{Error: true}, true, http.StatusServiceUnavailable},
+		{"Test client without path check", fakeVaultClient{Value: "error"}, true, 0},
+	}
+
+	for _, test := range dryRunTests {
+		s := Server{
+			Vault:            test.vaultClient,
+			VaultPattern:     "secret/data/{{.Secret}}",
+			Provenance:       true,
+			DryRunCheckPaths: test.checkPaths,
+			Logger:           logrus.New(),
+		}
+
+		result, err := s.mutateSecretData(secret, mutateOptions{DryRun: true})
+		if test.statusCode != 0 {
+			var denial admissionError
+			require.True(t, errors.As(err, &denial), test.description)
+			require.Equal(t, test.statusCode, denial.code, test.description)
+			continue
+		}
+
+		require.Nil(t, err, test.description)
+		require.Equal(t, []patchOperation{{Op: "replace", Path: "/data/password", Value: "dmF1bHQ6ZGIjcGFzc3dvcmQ="}}, result.Patch, test.description)
+		require.Equal(t, []string{dryRunWarning}, result.Warnings, test.description)
+		require.Empty(t, result.AuditAnnotations, test.description)
+	}
+}
+
+func TestServer_secretHandlerDryRun(t *testing.T) {
+
+	s := Server{
+		Vault:        fakeCheckerVaultClient{},
+		VaultPattern: "secret/data/{{.Secret}}",
+		Logger:       logrus.New(),
+	}
+
+	secret := `{"apiVersion":"v1","kind":"Secret","metadata":{"name":"test-secret","namespace":"test-namespace"},"data":{"foo":"dmF1bHQ6Zm9vI2Jhcg=="},"type":"Opaque"}`
+	body := strings.Replace(admissionReviewJSON("Secret", secret), `"operation":"CREATE"`, `"operation":"CREATE","dryRun":true`, 1)
+
+	req := httptest.NewRequest(http.MethodPost, "/secret", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.Router().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var review admission.AdmissionReview
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &review))
+	require.True(t, review.Response.Allowed, "Test dry-run request allowed without vault read")
+	require.JSONEq(t, `[{"op":"replace","path":"/data/foo","value":"dmF1bHQ6Zm9vI2Jhcg=="}]`, string(review.Response.Patch))
+	require.Equal(t, []string{dryRunWarning}, review.Response.Warnings)
+	require.Nil(t, review.Response.Result)
+}
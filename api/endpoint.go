@@ -0,0 +1,229 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultVaultEndpoint is the name of the Vault endpoint resolving vault
+// placeholders without endpoint prefix nor matching route
+const DefaultVaultEndpoint = "default"
+
+// endpointPrefix is the prefix of vault placeholders naming their Vault
+// endpoint, "vault@<endpoint>:path#key"
+const endpointPrefix = "vault@"
+
+var (
+	vaultEndpointReads = promauto.NewCounterVec(prometheus.CounterOpts{Name: "webhook_vault_endpoint_reads", Help: "The total number of values read from Vault by endpoint and result"}, []string{"endpoint", "result"})
+	vaultEndpointUp    = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "webhook_vault_endpoint_up", Help: "Whether a Vault endpoint was healthy at the last health check"}, []string{"endpoint"})
+)
+
+// VaultRoute routes vault placeholders of secrets in matching namespaces and
+// with matching labels to a named Vault endpoint. Namespaces are path
+// globs, any of them must match if set, and all labels must match.
+type VaultRoute struct {
+	Endpoint   string            `json:"endpoint"`
+	Namespaces []string          `json:"namespaces,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// Validate returns an error if the route has no matcher or an invalid
+// namespace glob
+func (r VaultRoute) Validate() error {
+	if r.Endpoint == "" {
+		return fmt.Errorf("route endpoint is required")
+	}
+	if len(r.Namespaces) == 0 && len(r.Labels) == 0 {
+		return fmt.Errorf("route to endpoint %q has no namespaces nor labels", r.Endpoint)
+	}
+	for _, pattern := range r.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("route to endpoint %q has invalid namespace pattern %q: %s", r.Endpoint, pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// matches returns true if a secret matches the route
+func (r VaultRoute) matches(secret corev1.Secret) bool {
+	if len(r.Namespaces) > 0 && !matchNamespace(r.Namespaces, secret.Namespace) {
+		return false
+	}
+
+	for name, value := range r.Labels {
+		if v, ok := secret.Labels[name]; !ok || v != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchNamespace returns true if a namespace matches any path glob
+func matchNamespace(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VaultHealthChecker interface is implemented by Vault clients able to check
+// their Vault is reachable and unsealed
+type VaultHealthChecker interface {
+	Health() error
+}
+
+// parseEndpointPlaceholder extracts the endpoint, path and key of a vault
+// placeholder with an endpoint prefix
+func (s *Server) parseEndpointPlaceholder(value string) (placeholder, bool, error) {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return placeholder{}, true, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "vault placeholder '%s' doesn't match 'vault@endpoint:path#key'", value)
+	}
+
+	endpoint := value[len(endpointPrefix):i]
+	if _, ok := s.VaultEndpoints[endpoint]; !ok && endpoint != DefaultVaultEndpoint {
+		return placeholder{}, true, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "vault placeholder '%s' uses unknown vault endpoint %q", value, endpoint)
+	}
+
+	ph, _, err := parsePlaceholder(placeholderPrefix + value[i+1:])
+	if err != nil {
+		return placeholder{}, true, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "vault placeholder '%s' doesn't match 'vault@endpoint:path#key'", value)
+	}
+	ph.Endpoint = endpoint
+
+	return ph, true, nil
+}
+
+// route returns a vault placeholder with the endpoint of the first route
+// matching the secret, placeholders with an endpoint prefix and of other
+// schemes are returned unchanged
+func (s *Server) route(secret corev1.Secret, ph placeholder) placeholder {
+	if (ph.Scheme != "" && ph.Scheme != SchemeVault) || ph.Endpoint != "" {
+		return ph
+	}
+
+	for _, r := range s.VaultRoutes {
+		if r.matches(secret) {
+			ph.Endpoint = r.Endpoint
+			return ph
+		}
+	}
+
+	return ph
+}
+
+// checkEndpointNamespace returns a denial if a vault placeholder resolves
+// from a named endpoint not allowed in the secret namespace. Endpoint
+// prefixes and labels are set by secret authors, so both explicit and routed
+// endpoints are checked.
+func (s *Server) checkEndpointNamespace(secret corev1.Secret, ph placeholder) error {
+	if ph.Endpoint == "" || ph.Endpoint == DefaultVaultEndpoint {
+		return nil
+	}
+	if !matchNamespace(s.EndpointNamespaces[ph.Endpoint], secret.Namespace) {
+		return denied(http.StatusForbidden, metav1.StatusReasonForbidden, "vault endpoint %q is not allowed in namespace %q", ph.Endpoint, secret.Namespace)
+	}
+
+	return nil
+}
+
+// vaultEndpoint returns the Vault client of a named endpoint
+func (s *Server) vaultEndpoint(name string) (Resolver, bool) {
+	if name == "" || name == DefaultVaultEndpoint {
+		return s.resolver(SchemeVault)
+	}
+
+	r, ok := s.VaultEndpoints[name]
+	return r, ok
+}
+
+// vaultHealth holds the last health check result of Vault endpoints
+type vaultHealth struct {
+	mu     sync.RWMutex
+	status map[string]string
+}
+
+// checkVaultHealth checks the health of Vault endpoints able to, and records
+// results in metrics and for the Vault status handler
+func (s *Server) checkVaultHealth() {
+	endpoints := map[string]Resolver{}
+	if r, ok := s.resolver(SchemeVault); ok {
+		endpoints[DefaultVaultEndpoint] = r
+	}
+	for name, r := range s.VaultEndpoints {
+		endpoints[name] = r
+	}
+
+	status := map[string]string{}
+	for name, r := range endpoints {
+		checker, ok := r.(VaultHealthChecker)
+		if !ok {
+			continue
+		}
+
+		err := checker.Health()
+		if err != nil {
+			s.Logger.WithError(err).WithField("vault_endpoint", name).Warn("vault endpoint is unhealthy")
+			status[name] = err.Error()
+			vaultEndpointUp.WithLabelValues(name).Set(0)
+			continue
+		}
+		status[name] = "up"
+		vaultEndpointUp.WithLabelValues(name).Set(1)
+	}
+
+	s.vaultHealth.mu.Lock()
+	s.vaultHealth.status = status
+	s.vaultHealth.mu.Unlock()
+}
+
+// watchVaultHealth checks the health of Vault endpoints at interval until
+// stop is closed
+func (s *Server) watchVaultHealth(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.checkVaultHealth()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// vaultStatusHandler returns the last health check result of each Vault
+// endpoint, with a 503 status if any endpoint is unhealthy. It isn't used
+// as readiness probe as placeholders of healthy endpoints still resolve.
+func (s *Server) vaultStatusHandler(w http.ResponseWriter, r *http.Request) {
+	s.vaultHealth.mu.RLock()
+	defer s.vaultHealth.mu.RUnlock()
+
+	status := http.StatusOK
+	endpoints := map[string]string{}
+	for name, result := range s.vaultHealth.status {
+		if result != "up" {
+			status = http.StatusServiceUnavailable
+		}
+		endpoints[name] = result
+	}
+
+	render.Status(r, status)
+	render.JSON(w, r, endpoints)
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Fake resolver with a health check for testing
+type fakeHealthResolver struct {
+	fakeResolver
+	Err error
+}
+
+func (f fakeHealthResolver) Health() error { return f.Err }
+
+func TestServer_parseEndpointPlaceholder(t *testing.T) {
+
+	s := Server{VaultEndpoints: map[string]Resolver{"prod": fakeResolver{}}}
+
+	var parseTests = []struct {
+		description string
+		value       string
+		placeholder placeholder
+		errorString string
+	}{
+		{"Test endpoint placeholder", "vault@prod:db#password", placeholder{Path: "db", Key: "password", Endpoint: "prod"}, ""},
+		{"Test default endpoint", "vault@default:db#password", placeholder{Path: "db", Key: "password", Endpoint: "default"}, ""},
+		{"Test unknown endpoint", "vault@other:db#password", placeholder{}, `vault placeholder 'vault@other:db#password' uses unknown vault endpoint "other"`},
+		{"Test missing key", "vault@prod:db", placeholder{}, "vault placeholder 'vault@prod:db' doesn't match 'vault@endpoint:path#key'"},
+		{"Test missing endpoint separator", "vault@prod", placeholder{}, "vault placeholder 'vault@prod' doesn't match 'vault@endpoint:path#key'"},
+	}
+
+	for _, test := range parseTests {
+		ph, ok, err := s.parseSchemePlaceholder(test.value)
+		require.True(t, ok, test.description)
+		if test.errorString != "" {
+			require.EqualError(t, err, test.errorString, test.description)
+			continue
+		}
+		require.Nil(t, err, test.description)
+		require.Equal(t, test.placeholder, ph, test.description)
+	}
+}
+
+func TestVaultRoute_matches(t *testing.T) {
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "prod-app", Labels: map[string]string{"env": "prod", "team": "web"}}}
+
+	var routeTests = []struct {
+		description string
+		route       VaultRoute
+		matches     bool
+	}{
+		{"Test namespace glob", VaultRoute{Namespaces: []string{"prod-*"}}, true},
+		{"Test any namespace", VaultRoute{Namespaces: []string{"dev-*", "prod-app"}}, true},
+		{"Test other namespace", VaultRoute{Namespaces: []string{"dev-*"}}, false},
+		{"Test labels", VaultRoute{Labels: map[string]string{"env": "prod", "team": "web"}}, true},
+		{"Test label value", VaultRoute{Labels: map[string]string{"env": "dev"}}, false},
+		{"Test missing label", VaultRoute{Labels: map[string]string{"tier": "db"}}, false},
+		{"Test namespace and labels", VaultRoute{Namespaces: []string{"prod-*"}, Labels: map[string]string{"env": "dev"}}, false},
+	}
+
+	for _, test := range routeTests {
+		require.Equal(t, test.matches, test.route.matches(secret), test.description)
+	}
+
+	require.EqualError(t, VaultRoute{Endpoint: "prod"}.Validate(), `route to endpoint "prod" has no namespaces nor labels`, "Test route without matcher")
+	require.Error(t, VaultRoute{Endpoint: "prod", Namespaces: []string{"["}}.Validate(), "Test invalid namespace pattern")
+}
+
+func TestServer_mutateSecretDataEndpoints(t *testing.T) {
+
+	secret := corev1.Secret{Data: map[string][]byte{
+		"password": []byte("vault:db#password"),
+		"token":    []byte("vault@nonprod:app#token"),
+		"user":     []byte("vault@default:db#user"),
+	}}
+	secret.Name = "test-secret"
+	secret.Namespace = "prod-app"
+
+	s := Server{
+		Resolvers: map[string]Resolver{
+			"vault": fakeResolver{Values: map[string]string{"secret/data/prod-app/db#user": "admin"}},
+		},
+		VaultEndpoints: map[string]Resolver{
+			"prod":    fakeResolver{Values: map[string]string{"secret/data/prod-app/db#password": "pr0d"}},
+			"nonprod": fakeResolver{Values: map[string]string{"secret/data/prod-app/app#token": "t0k3n"}},
+		},
+		EndpointNamespaces: map[string][]string{
+			"prod":    {"prod-*"},
+			"nonprod": {"*"},
+		},
+		VaultRoutes: []VaultRoute{
+			{Endpoint: "nonprod", Labels: map[string]string{"env": "dev"}},
+			{Endpoint: "prod", Namespaces: []string{"prod-*"}},
+		},
+		VaultPattern: "secret/data/{{.Namespace}}/{{.Secret}}",
+		Provenance:   true,
+		Logger:       logrus.New(),
+	}
+
+	// Placeholders are read from the endpoint of their prefix, or of the
+	// first matching route, or from the default endpoint
+	result, err := s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/password", Value: base64.StdEncoding.EncodeToString([]byte("pr0d"))}, result.Patch[0], "Test routed endpoint")
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/token", Value: base64.StdEncoding.EncodeToString([]byte("t0k3n"))}, result.Patch[1], "Test endpoint prefix")
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/user", Value: base64.StdEncoding.EncodeToString([]byte("admin"))}, result.Patch[2], "Test default endpoint prefix")
+	require.JSONEq(t, `{"password":"vault@prod:secret/data/prod-app/db#password","token":"vault@nonprod:secret/data/prod-app/app#token","user":"vault@default:secret/data/prod-app/db#user"}`, result.AuditAnnotations[auditAnnotationReads], "Test reads audit annotation")
+
+	var provenance map[string]Provenance
+	annotations := result.Patch[3].Value.(map[string]string)
+	require.Nil(t, json.Unmarshal([]byte(annotations[AnnotationProvenance]), &provenance))
+	require.Equal(t, "prod", provenance["password"].Endpoint, "Test provenance endpoint")
+
+	// Secrets matching the first route use its endpoint
+	secret.Labels = map[string]string{"env": "dev"}
+	_, err = s.mutateSecretData(secret, mutateOptions{})
+	var denial admissionError
+	require.True(t, errors.As(err, &denial), "Test first route matching")
+	require.Contains(t, denial.message, "failed to read secret 'secret/data/prod-app/db' in vault")
+
+	// Endpoints are denied in namespaces they aren't allowed in, whether
+	// named by prefix or routed by labels
+	s.VaultRoutes = append(s.VaultRoutes, VaultRoute{Endpoint: "prod", Labels: map[string]string{"env": "prod"}})
+	var namespaceTests = []struct {
+		description string
+		labels      map[string]string
+		value       string
+	}{
+		{"Test endpoint prefix not allowed", nil, "vault@prod:db#password"},
+		{"Test label route not allowed", map[string]string{"env": "prod"}, "vault:db#password"},
+	}
+	for _, test := range namespaceTests {
+		other := corev1.Secret{Data: map[string][]byte{"password": []byte(test.value)}}
+		other.Name = "test-secret"
+		other.Namespace = "dev-app"
+		other.Labels = test.labels
+		_, err = s.mutateSecretData(other, mutateOptions{})
+		require.True(t, errors.As(err, &denial), test.description)
+		require.Equal(t, int32(http.StatusForbidden), denial.code, test.description)
+		require.Equal(t, `vault endpoint "prod" is not allowed in namespace "dev-app"`, denial.message, test.description)
+	}
+
+	// Typed fields are checked too
+	typed := typedSecret(corev1.SecretTypeBasicAuth, map[string]string{"password": "vault@prod:db#password"})
+	_, err = s.mutateSecretData(typed, mutateOptions{})
+	require.True(t, errors.As(err, &denial), "Test typed endpoint prefix not allowed")
+	require.Equal(t, int32(http.StatusForbidden), denial.code, "Test typed endpoint prefix not allowed")
+}
+
+func TestServer_vaultStatusHandler(t *testing.T) {
+
+	s := Server{
+		Resolvers: map[string]Resolver{"vault": fakeHealthResolver{}},
+		VaultEndpoints: map[string]Resolver{
+			"prod":    fakeHealthResolver{},
+			"nonprod": fakeHealthResolver{Err: errors.New("vault is sealed")},
+			"file":    fakeResolver{},
+		},
+		Logger: logrus.New(),
+	}
+
+	// Endpoints without health check are not reported
+	s.checkVaultHealth()
+	w := httptest.NewRecorder()
+	s.Router().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status/vault", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code, "Test unhealthy endpoint")
+	require.JSONEq(t, `{"default":"up","prod":"up","nonprod":"vault is sealed"}`, w.Body.String())
+
+	s.VaultEndpoints["nonprod"] = fakeHealthResolver{}
+	s.checkVaultHealth()
+	w = httptest.NewRecorder()
+	s.Router().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status/vault", nil))
+	require.Equal(t, http.StatusOK, w.Code, "Test healthy endpoints")
+}
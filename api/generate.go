@@ -0,0 +1,143 @@
+package api
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// generatePrefix is the prefix of secret values to replace by Vault
+	// values generated at random if they don't exist yet
+	generatePrefix = "vault-generate:"
+
+	// Generated values length bounds and defaults
+	defaultGenerateLength  = 32
+	maxGenerateLength      = 1024
+	defaultGenerateCharset = "alnum"
+)
+
+// generateRegex extracts Vault secret path, key and generation options
+// from a generate placeholder
+var generateRegex = regexp.MustCompile(`^vault-generate:(.*)#([^?#]*)(?:\?(.*))?$`)
+
+// generateCharsets are the characters generated values are made of
+var generateCharsets = map[string]string{
+	"alnum":   "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789",
+	"alpha":   "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+	"numeric": "0123456789",
+	"hex":     "0123456789abcdef",
+	"ascii":   "!\"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefghijklmnopqrstuvwxyz{|}~",
+}
+
+// generateOptions describe the random value generated for a placeholder
+type generateOptions struct {
+	Length  int
+	Charset string
+}
+
+// VaultGenerator interface is implemented by Vault clients able to store a
+// value in a KV2 secret key if it doesn't exist yet
+type VaultGenerator interface {
+	// ReadOrCreate returns the value of a secret key, or writes value if
+	// the key doesn't exist with check-and-set so that concurrent writers
+	// all return the value stored first. created is true if value was written.
+	ReadOrCreate(path, key, value string) (stored string, version int, created bool, err error)
+}
+
+// parseGeneratePlaceholder extracts Vault secret path, key and generation
+// options from a value with the "vault-generate:" prefix
+func parseGeneratePlaceholder(value string) (placeholder, error) {
+	sub := generateRegex.FindStringSubmatch(value)
+	if len(sub) != 4 {
+		return placeholder{}, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "vault-generate placeholder '%s' doesn't match regex '%s'", value, generateRegex)
+	}
+
+	query, err := url.ParseQuery(sub[3])
+	if err != nil {
+		return placeholder{}, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "vault-generate placeholder '%s' has invalid options: %s", value, err)
+	}
+
+	// Options are checked in order for stable errors
+	options := make([]string, 0, len(query))
+	for option := range query {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+
+	opts := &generateOptions{Length: defaultGenerateLength, Charset: defaultGenerateCharset}
+	for _, option := range options {
+		v := query.Get(option)
+		switch option {
+		case "length":
+			opts.Length, err = strconv.Atoi(v)
+			if err != nil || opts.Length < 1 || opts.Length > maxGenerateLength {
+				return placeholder{}, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "vault-generate placeholder '%s' length must be between 1 and %d", value, maxGenerateLength)
+			}
+		case "charset":
+			if _, ok := generateCharsets[v]; !ok {
+				return placeholder{}, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "vault-generate placeholder '%s' charset must be one of alnum, alpha, numeric, hex or ascii", value)
+			}
+			opts.Charset = v
+		default:
+			return placeholder{}, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "vault-generate placeholder '%s' has unknown option '%s'", value, option)
+		}
+	}
+
+	return placeholder{Path: sub[1], Key: sub[2], Generate: opts}, nil
+}
+
+// randomValue returns a cryptographically random value of length characters
+// uniformly chosen in a charset
+func randomValue(opts generateOptions) (string, error) {
+	charset := generateCharsets[opts.Charset]
+	max := big.NewInt(int64(len(charset)))
+
+	value := make([]byte, opts.Length)
+	for i := range value {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random value: %s", err)
+		}
+		value[i] = charset[n.Int64()]
+	}
+
+	return string(value), nil
+}
+
+// checkGeneratePolicy checks random values may be generated at a Vault path,
+// which must match one of the generate path patterns
+func (s *Server) checkGeneratePolicy(vaultPath string) error {
+	for _, pattern := range s.GeneratePaths {
+		if ok, _ := path.Match(pattern, vaultPath); ok {
+			return nil
+		}
+	}
+
+	return denied(http.StatusForbidden, metav1.StatusReasonForbidden, "generating secret values at '%s' is not allowed", vaultPath)
+}
+
+// generateVault returns the value of a Vault secret key, generated at random
+// and stored in Vault if it doesn't exist yet
+func (s *Server) generateVault(vaultPath string, ph placeholder) (string, int, bool, error) {
+	r, _ := s.placeholderResolver(ph)
+	generator, ok := r.(VaultGenerator)
+	if !ok {
+		return "", 0, false, fmt.Errorf("vault client can't write generated values")
+	}
+
+	value, err := randomValue(*ph.Generate)
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	return generator.ReadOrCreate(vaultPath, ph.Key, value)
+}
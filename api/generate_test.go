@@ -0,0 +1,160 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Fake Vault client storing generated values for testing, values are keyed
+// by path#key
+type fakeGeneratorVaultClient struct {
+	Values map[string]string
+}
+
+func (f fakeGeneratorVaultClient) Read(path, key string) (string, error) {
+	value, ok := f.Values[path+"#"+key]
+	if !ok {
+		return "", errors.New("secret does not exist in Vault")
+	}
+	return value, nil
+}
+
+func (f fakeGeneratorVaultClient) ReadOrCreate(path, key, value string) (string, int, bool, error) {
+	if stored, ok := f.Values[path+"#"+key]; ok {
+		return stored, 1, false, nil
+	}
+	f.Values[path+"#"+key] = value
+	return value, 2, true, nil
+}
+
+func TestParseGeneratePlaceholder(t *testing.T) {
+
+	var parseTests = []struct {
+		description string
+		value       string
+		placeholder placeholder
+		errorString string
+	}{
+		{"Test default options", "vault-generate:app/db#password", placeholder{Path: "app/db", Key: "password", Generate: &generateOptions{Length: 32, Charset: "alnum"}}, ""},
+		{"Test options", "vault-generate:app/db#password?length=16&charset=hex", placeholder{Path: "app/db", Key: "password", Generate: &generateOptions{Length: 16, Charset: "hex"}}, ""},
+		{"Test missing key", "vault-generate:app/db", placeholder{}, "doesn't match regex"},
+		{"Test invalid length", "vault-generate:app/db#password?length=0", placeholder{}, "length must be between 1 and 1024"},
+		{"Test too long length", "vault-generate:app/db#password?length=1025", placeholder{}, "length must be between 1 and 1024"},
+		{"Test unknown charset", "vault-generate:app/db#password?charset=emoji", placeholder{}, "charset must be one of"},
+		{"Test unknown option", "vault-generate:app/db#password?size=12", placeholder{}, "unknown option 'size'"},
+	}
+
+	for _, test := range parseTests {
+		ph, ok, err := parsePlaceholder(test.value)
+		require.True(t, ok, test.description)
+		if test.errorString != "" {
+			require.Error(t, err, test.description)
+			require.Contains(t, err.Error(), test.errorString, test.description)
+			continue
+		}
+		require.Nil(t, err, test.description)
+		require.Equal(t, test.placeholder, ph, test.description)
+	}
+
+	// Generate placeholders are not Vault references
+	_, _, ok, _ := ParsePlaceholder("vault-generate:app/db#password")
+	require.False(t, ok, "Test exported parsing ignores generate placeholders")
+}
+
+func TestRandomValue(t *testing.T) {
+
+	for charset, chars := range generateCharsets {
+		value, err := randomValue(generateOptions{Length: 64, Charset: charset})
+		require.Nil(t, err)
+		require.Len(t, value, 64, "Test %s value length", charset)
+		for _, c := range value {
+			require.True(t, strings.ContainsRune(chars, c), "Test %s value characters", charset)
+		}
+	}
+
+	first, _ := randomValue(generateOptions{Length: 32, Charset: "alnum"})
+	second, _ := randomValue(generateOptions{Length: 32, Charset: "alnum"})
+	require.NotEqual(t, first, second, "Test values are random")
+}
+
+func TestServer_mutateSecretDataGenerate(t *testing.T) {
+
+	secret := corev1.Secret{Data: map[string][]byte{
+		"password": []byte("vault-generate:db#password?length=24"),
+		"user":     []byte("vault-generate:db#user"),
+	}}
+	secret.Name = "test-secret"
+	secret.Namespace = "test-namespace"
+
+	vault := fakeGeneratorVaultClient{Values: map[string]string{"secret/data/test-namespace/db#user": "admin"}}
+	s := Server{
+		Vault:         vault,
+		VaultPattern:  "secret/data/{{.Namespace}}/{{.Secret}}",
+		GeneratePaths: []string{"secret/data/test-namespace/*"},
+		Logger:        logrus.New(),
+	}
+
+	// Missing key is generated and stored, existing key is used
+	result, err := s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Len(t, result.Patch, 2)
+	password, err := base64.StdEncoding.DecodeString(result.Patch[0].Value.(string))
+	require.Nil(t, err)
+	require.Len(t, password, 24, "Test generated value length")
+	require.Equal(t, vault.Values["secret/data/test-namespace/db#password"], string(password), "Test generated value stored in vault")
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/user", Value: "YWRtaW4="}, result.Patch[1], "Test existing value used")
+	require.Equal(t, `{"password":"secret/data/test-namespace/db#password"}`, result.AuditAnnotations[auditAnnotationGenerated], "Test generated audit annotation")
+
+	// Stored value is used on next admission
+	result, err = s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Equal(t, base64.StdEncoding.EncodeToString(password), result.Patch[0].Value, "Test stored value reused")
+	require.Empty(t, result.AuditAnnotations[auditAnnotationGenerated])
+
+	// Nothing is generated on dry-run requests
+	dryRunVault := fakeGeneratorVaultClient{Values: map[string]string{}}
+	s.Vault = dryRunVault
+	_, err = s.mutateSecretData(secret, mutateOptions{DryRun: true})
+	require.Nil(t, err)
+	require.Empty(t, dryRunVault.Values, "Test dry-run doesn't write to vault")
+
+	// Generation is denied outside of allowed paths
+	s.GeneratePaths = []string{"secret/data/other-namespace/*"}
+	for _, dryRun := range []bool{false, true} {
+		_, err = s.mutateSecretData(secret, mutateOptions{DryRun: dryRun})
+		var denial admissionError
+		require.True(t, errors.As(err, &denial), "Test path not allowed")
+		require.Equal(t, int32(http.StatusForbidden), denial.code)
+	}
+
+	// Generation is disabled by default
+	s.GeneratePaths = nil
+	_, err = s.mutateSecretData(secret, mutateOptions{})
+	require.Error(t, err, "Test generation disabled")
+
+	// Vault clients without write support can't generate values
+	s.GeneratePaths = []string{"secret/data/test-namespace/*"}
+	s.Vault = fakeVaultClient{Value: "value"}
+	_, err = s.mutateSecretData(secret, mutateOptions{})
+	var denial admissionError
+	require.True(t, errors.As(err, &denial), "Test client without write support")
+	require.Equal(t, int32(http.StatusServiceUnavailable), denial.code)
+}
+
+func TestServer_podGenerateDenied(t *testing.T) {
+
+	s := injectServer()
+	pod := injectPod(map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault-generate:db#password"})
+
+	_, err := s.podPatch(pod)
+	var denial admissionError
+	require.True(t, errors.As(err, &denial), "Test generate placeholder denied in pods")
+	require.Equal(t, int32(http.StatusUnprocessableEntity), denial.code)
+}
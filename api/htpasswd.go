@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// htpasswd holds basicauth credentials loaded from an htpasswd-style file
+type htpasswd struct {
+	mu    sync.RWMutex
+	file  string
+	users map[string]string
+}
+
+// newHtpasswd loads credentials from an htpasswd-style file
+func newHtpasswd(file string) (*htpasswd, error) {
+	h := &htpasswd{file: file}
+	err := h.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// reload re-reads credentials from disk, current credentials are kept
+// if the file can't be read or is invalid
+func (h *htpasswd) reload() error {
+	users, err := parseHtpasswd(h.file)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+
+	return nil
+}
+
+// hash returns the bcrypt hashed password of a user
+func (h *htpasswd) hash(user string) (string, bool) {
+	if h == nil {
+		return "", false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	hash, ok := h.users[user]
+	return hash, ok
+}
+
+// parseHtpasswd reads an htpasswd-style file of user:bcrypt_hash lines,
+// empty lines and lines starting with # are ignored
+func parseHtpasswd(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open basicauth file: %s", err)
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		userHash := strings.SplitN(entry, ":", 2)
+		if len(userHash) != 2 || userHash[0] == "" || userHash[1] == "" {
+			return nil, fmt.Errorf("basicauth file line %d must match 'user:hashed_pass'", line)
+		}
+
+		// Only bcrypt hashes are supported, as generated by the hash
+		// command or by "htpasswd -B"
+		if !strings.HasPrefix(userHash[1], "$2") {
+			return nil, fmt.Errorf("basicauth file line %d: only bcrypt hashes are supported", line)
+		}
+
+		users[userHash[0]] = userHash[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read basicauth file: %s", err)
+	}
+
+	return users, nil
+}
+
+// authCache remembers successful basicauth verifications for a short time
+// to avoid a bcrypt comparison on every admission request. Entries are keyed
+// by a hash of the credentials so that plain passwords are never kept.
+type authCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[[sha256.Size]byte]time.Time
+}
+
+// newAuthCache returns a cache keeping verifications for ttl, or nil
+// (caching disabled) if ttl is not positive
+func newAuthCache(ttl time.Duration) *authCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &authCache{ttl: ttl, entries: map[[sha256.Size]byte]time.Time{}}
+}
+
+// valid returns true if credentials were successfully verified less than ttl ago
+func (c *authCache) valid(user, pass string) bool {
+	if c == nil {
+		return false
+	}
+
+	key := credentialsKey(user, pass)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiry, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(c.entries, key)
+		return false
+	}
+
+	return true
+}
+
+// add remembers a successful verification
+func (c *authCache) add(user, pass string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Drop expired entries so the cache doesn't grow unbounded
+	now := time.Now()
+	for key, expiry := range c.entries {
+		if now.After(expiry) {
+			delete(c.entries, key)
+		}
+	}
+
+	c.entries[credentialsKey(user, pass)] = now.Add(c.ttl)
+}
+
+// flush forgets all verifications, used when credentials are reloaded
+func (c *authCache) flush() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.entries = map[[sha256.Size]byte]time.Time{}
+	c.mu.Unlock()
+}
+
+// credentialsKey returns the cache key of a user/password pair
+func credentialsKey(user, pass string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(user + "\x00" + pass))
+}
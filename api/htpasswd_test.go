@@ -0,0 +1,110 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseHtpasswd(t *testing.T) {
+
+	var htpasswdTests = []struct {
+		description string
+		content     string
+		users       map[string]string
+		errorString string
+	}{
+		{
+			"Test valid file with comments and empty lines",
+			"# webhook users\n\nuser1:$2y$10$hash1\nuser2:$2a$10$hash2\n",
+			map[string]string{"user1": "$2y$10$hash1", "user2": "$2a$10$hash2"},
+			"",
+		},
+		{
+			"Test line without separator",
+			"user1\n",
+			nil,
+			"basicauth file line 1 must match 'user:hashed_pass'",
+		},
+		{
+			"Test non bcrypt hash",
+			"user1:$2y$10$hash1\nuser2:{SHA}hash2\n",
+			nil,
+			"basicauth file line 2: only bcrypt hashes are supported",
+		},
+	}
+
+	for _, test := range htpasswdTests {
+		file := filepath.Join(t.TempDir(), "htpasswd")
+		err := ioutil.WriteFile(file, []byte(test.content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		users, err := parseHtpasswd(file)
+		if test.errorString == "" {
+			require.Nil(t, err, test.description)
+		} else {
+			require.EqualError(t, err, test.errorString, test.description)
+		}
+		require.Equal(t, test.users, users, test.description)
+	}
+}
+
+func TestServer_RequestAuthFile(t *testing.T) {
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	err = ioutil.WriteFile(file, []byte("user:"+string(hash)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{
+		Logger:            logrus.New(),
+		BasicAuthFile:     file,
+		BasicAuthCacheTTL: time.Minute,
+		AuthFailureLimit:  2,
+		AuthFailureWindow: time.Minute,
+	}
+	err = s.setupAuth()
+	require.Nil(t, err)
+
+	handler := s.RequestAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(ip, user, pass string) int {
+		req := httptest.NewRequest(http.MethodPost, "/secret", nil)
+		req.RemoteAddr = ip + ":12345"
+		req.SetBasicAuth(user, pass)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Valid credentials are accepted and cached
+	require.Equal(t, http.StatusOK, request("10.0.0.1", "user", "pass"), "Test valid file credentials")
+	require.True(t, s.authCache.valid("user", "pass"), "Test successful verification is cached")
+
+	// Rotated credentials flush the cache
+	err = ioutil.WriteFile(file, []byte("other:"+string(hash)+"\n"), 0600)
+	require.Nil(t, err)
+	require.Nil(t, s.htpasswd.reload())
+	s.authCache.flush()
+	require.Equal(t, http.StatusForbidden, request("10.0.0.1", "user", "pass"), "Test removed user after reload")
+	require.Equal(t, http.StatusOK, request("10.0.0.1", "other", "pass"), "Test added user after reload")
+
+	// Source IP is throttled after too many failures
+	require.Equal(t, http.StatusForbidden, request("10.0.0.2", "other", "wrong"), "Test first failure")
+	require.Equal(t, http.StatusForbidden, request("10.0.0.2", "other", "wrong"), "Test second failure")
+	require.Equal(t, http.StatusTooManyRequests, request("10.0.0.2", "other", "pass"), "Test throttled source IP")
+	require.Equal(t, http.StatusOK, request("10.0.0.3", "other", "pass"), "Test other source IP not throttled")
+}
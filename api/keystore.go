@@ -0,0 +1,294 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	keystore "github.com/pavlo-v-chernykh/keystore-go/v4"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// AnnotationKeystorePrefix is the prefix of secret annotations holding a
+// keystore specification as JSON, built into the data key named after the
+// prefix, for example "keystore-keystore.p12: {"format": "pkcs12",
+// "cert": "vault:tls#crt", "key": "vault:tls#key", "password": "vault:tls#pass"}"
+const AnnotationKeystorePrefix = annotationPrefix + "keystore-"
+
+// Keystore formats
+const (
+	keystorePKCS12 = "pkcs12"
+	keystoreJKS    = "jks"
+)
+
+// defaultKeystoreAlias is the alias of the private key entry
+const defaultKeystoreAlias = "1"
+
+// keystoreSpec describes a keystore, fields are Vault placeholders or
+// plaintext values. Keystores without cert and key are trust stores of the
+// CA certificates.
+type keystoreSpec struct {
+	Format   string `json:"format"`
+	Cert     string `json:"cert,omitempty"`
+	Key      string `json:"key,omitempty"`
+	CA       string `json:"ca,omitempty"`
+	Password string `json:"password"`
+	Alias    string `json:"alias,omitempty"`
+}
+
+// keystoreSecretData builds the data keys of keystore annotations from PEM
+// certificates and keys read from Vault. Keystores are built with salts
+// derived from their content so that admissions of unchanged Vault values
+// build identical keystores. On dry-run requests references are only
+// validated and no data is built.
+func (s *Server) keystoreSecretData(secret corev1.Secret, dryRun bool) (builtData, error) {
+	result := builtData{Data: map[string][]byte{}, Provenance: map[string]Provenance{}, Reads: map[string]string{}}
+
+	keys := []string{}
+	for annotation := range secret.Annotations {
+		if strings.HasPrefix(annotation, AnnotationKeystorePrefix) {
+			keys = append(keys, strings.TrimPrefix(annotation, AnnotationKeystorePrefix))
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		location := fmt.Sprintf("annotation '%s%s'", AnnotationKeystorePrefix, key)
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			return result, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "%s: invalid data key: %s", location, strings.Join(errs, ", "))
+		}
+
+		var spec keystoreSpec
+		decoder := json.NewDecoder(strings.NewReader(secret.Annotations[AnnotationKeystorePrefix+key]))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&spec)
+		if err != nil {
+			return result, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "%s: invalid keystore specification: %s", location, err)
+		}
+		err = spec.validate()
+		if err != nil {
+			return result, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "%s: invalid keystore specification: %s", location, err)
+		}
+
+		// Resolve each field, recording Vault references read
+		values := map[string]string{}
+		sources := map[string]string{}
+		for name, value := range map[string]string{"cert": spec.Cert, "key": spec.Key, "ca": spec.CA, "password": spec.Password} {
+			if value == "" {
+				continue
+			}
+			values[name], sources[name], err = s.annotationValue(secret, fmt.Sprintf("%s field '%s'", location, name), value, dryRun)
+			if err != nil {
+				return result, err
+			}
+			if sources[name] == "" {
+				delete(sources, name)
+			}
+		}
+		if dryRun {
+			continue
+		}
+
+		data, err := buildKeystore(spec, values)
+		if err != nil {
+			return result, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "%s: failed to build keystore: %s", location, err)
+		}
+
+		// Provenance has no version as built values can't be resynced,
+		// keystores without Vault reference are plaintext
+		result.Data[key] = data
+		for name, ref := range sources {
+			result.Reads[key+"."+name] = ref
+		}
+		if len(sources) == 0 {
+			continue
+		}
+		result.Provenance[key] = Provenance{
+			Placeholder: "keystore:" + spec.Format,
+			Sources:     sources,
+			ResolvedAt:  timeNow().UTC().Truncate(time.Second),
+		}
+	}
+
+	return result, nil
+}
+
+// validate checks a keystore specification fields
+func (spec keystoreSpec) validate() error {
+	if spec.Format != keystorePKCS12 && spec.Format != keystoreJKS {
+		return fmt.Errorf("format must be %s or %s", keystorePKCS12, keystoreJKS)
+	}
+	if (spec.Cert == "") != (spec.Key == "") {
+		return errors.New("cert and key must be set together")
+	}
+	if spec.Cert == "" && spec.CA == "" {
+		return errors.New("cert and key or ca is required")
+	}
+	if spec.Password == "" {
+		return errors.New("password is required")
+	}
+	if spec.Alias != "" && spec.Cert == "" {
+		return errors.New("alias requires cert and key")
+	}
+
+	return nil
+}
+
+// buildKeystore returns a PKCS#12 or JKS keystore of a certificate and key
+// with its chain, or a trust store of CA certificates
+func buildKeystore(spec keystoreSpec, values map[string]string) ([]byte, error) {
+	password := values["password"]
+	if password == "" {
+		return nil, errors.New("password is empty")
+	}
+
+	var chain []*x509.Certificate
+	var privateKey interface{}
+	if spec.Cert != "" {
+		pair, err := tls.X509KeyPair([]byte(values["cert"]), []byte(values["key"]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cert or key: %s", err)
+		}
+		for _, der := range pair.Certificate {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cert: %s", err)
+			}
+			chain = append(chain, cert)
+		}
+		privateKey = pair.PrivateKey
+	}
+
+	var cas []*x509.Certificate
+	if values["ca"] != "" {
+		var err error
+		cas, err = parseCertificates([]byte(values["ca"]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ca: %s", err)
+		}
+	}
+
+	// Salts and IVs are derived from a hash of the keystore content keyed
+	// on the private key, so that keystores are rebuilt identically. The
+	// password is left out as salts are stored in clear and must not give
+	// a faster way to check it than the key derivation itself.
+	seed := hmac.New(sha256.New, []byte(values["key"]))
+	for _, part := range []string{spec.Format, spec.Alias, values["cert"], values["ca"]} {
+		fmt.Fprintf(seed, "%d:%s", len(part), part)
+	}
+	random := &seededReader{seed: seed.Sum(nil)}
+
+	alias := spec.Alias
+	if alias == "" {
+		alias = defaultKeystoreAlias
+	}
+
+	switch spec.Format {
+	case keystorePKCS12:
+		if privateKey == nil {
+			return pkcs12.Modern.WithRand(random).EncodeTrustStore(cas, password)
+		}
+		return pkcs12.Modern.WithRand(random).Encode(privateKey, chain[0], append(chain[1:], cas...), password)
+
+	case keystoreJKS:
+		ks := keystore.New(keystore.WithOrderedAliases(), keystore.WithCustomRandomNumberGenerator(random))
+		if privateKey != nil {
+			der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key: %s", err)
+			}
+			entry := keystore.PrivateKeyEntry{CreationTime: chain[0].NotBefore, PrivateKey: der}
+			for _, cert := range append(chain, cas...) {
+				entry.CertificateChain = append(entry.CertificateChain, keystore.Certificate{Type: "X509", Content: cert.Raw})
+			}
+			err = ks.SetPrivateKeyEntry(alias, entry, []byte(password))
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			for i, cert := range cas {
+				entry := keystore.TrustedCertificateEntry{CreationTime: cert.NotBefore, Certificate: keystore.Certificate{Type: "X509", Content: cert.Raw}}
+				err := ks.SetTrustedCertificateEntry(fmt.Sprintf("ca-%d", i), entry)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		var store bytes.Buffer
+		err := ks.Store(&store, []byte(password))
+		if err != nil {
+			return nil, err
+		}
+		return store.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("format %q is not supported", spec.Format)
+}
+
+// parseCertificates returns the certificates of PEM blocks
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificate found")
+	}
+
+	return certs, nil
+}
+
+// seededReader is a reader of bytes derived from a seed, used in place of
+// a random reader so that keystores are built identically
+type seededReader struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+var _ io.Reader = &seededReader{}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			block := sha256.New()
+			block.Write(r.seed)
+			binary.Write(block, binary.BigEndian, r.counter)
+			r.counter++
+			r.buf = block.Sum(nil)
+		}
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+
+	return n, nil
+}
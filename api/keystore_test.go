@@ -0,0 +1,186 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	keystore "github.com/pavlo-v-chernykh/keystore-go/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// testPEMCertificate returns a PEM certificate and key signed by a parent,
+// self-signed if parent is nil
+func testPEMCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour).Truncate(time.Second),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	return cert, key,
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+// keystoreSecret returns a secret with keystore annotations by data key
+func keystoreSecret(specs map[string]string) corev1.Secret {
+	secret := corev1.Secret{Data: map[string][]byte{}}
+	secret.Name = "test-secret"
+	secret.Namespace = "test-namespace"
+	secret.Annotations = map[string]string{}
+	for key, spec := range specs {
+		secret.Annotations[AnnotationKeystorePrefix+key] = spec
+	}
+
+	return secret
+}
+
+func TestServer_mutateSecretDataKeystore(t *testing.T) {
+
+	ca, caKey, caPEM, _ := testPEMCertificate(t, "ca", nil, nil)
+	cert, _, certPEM, keyPEM := testPEMCertificate(t, "app", ca, caKey)
+
+	s := Server{
+		Vault: fakeVersionVaultClient{Values: map[string]string{
+			"secret/data/test-namespace/tls#crt":  certPEM,
+			"secret/data/test-namespace/tls#key":  keyPEM,
+			"secret/data/test-namespace/tls#ca":   caPEM,
+			"secret/data/test-namespace/tls#pass": "changeit",
+		}},
+		VaultPattern: "secret/data/{{.Namespace}}/{{.Secret}}",
+		Logger:       logrus.New(),
+	}
+
+	secret := keystoreSecret(map[string]string{
+		"keystore.p12":   `{"format": "pkcs12", "cert": "vault:tls#crt", "key": "vault:tls#key", "ca": "vault:tls#ca", "password": "vault:tls#pass"}`,
+		"keystore.jks":   `{"format": "jks", "cert": "vault:tls#crt", "key": "vault:tls#key", "ca": "vault:tls#ca", "password": "vault:tls#pass", "alias": "app"}`,
+		"truststore.jks": `{"format": "jks", "ca": "vault:tls#ca", "password": "changeit"}`,
+		"truststore.p12": `{"format": "pkcs12", "ca": "vault:tls#ca", "password": "changeit"}`,
+	})
+	result, err := s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Len(t, result.Patch, 4)
+	data := map[string][]byte{}
+	for _, patch := range result.Patch {
+		value, err := base64.StdEncoding.DecodeString(patch.Value.(string))
+		require.Nil(t, err)
+		data[patch.Path] = value
+	}
+
+	// PKCS#12 keystore holds the key, cert and CA chain
+	key, p12Cert, p12CAs, err := pkcs12.DecodeChain(data["/data/keystore.p12"], "changeit")
+	require.Nil(t, err)
+	require.NotNil(t, key, "Test pkcs12 private key")
+	require.Equal(t, cert.Raw, p12Cert.Raw, "Test pkcs12 certificate")
+	require.Len(t, p12CAs, 1, "Test pkcs12 ca chain")
+
+	// JKS keystore holds the key entry with its chain
+	ks := keystore.New()
+	require.Nil(t, ks.Load(bytes.NewReader(data["/data/keystore.jks"]), []byte("changeit")))
+	entry, err := ks.GetPrivateKeyEntry("app", []byte("changeit"))
+	require.Nil(t, err)
+	require.Len(t, entry.CertificateChain, 2, "Test jks certificate chain")
+	require.Equal(t, cert.Raw, entry.CertificateChain[0].Content, "Test jks certificate")
+
+	// Trust stores hold the CA certificates
+	ts := keystore.New()
+	require.Nil(t, ts.Load(bytes.NewReader(data["/data/truststore.jks"]), []byte("changeit")))
+	require.True(t, ts.IsTrustedCertificateEntry("ca-0"), "Test jks trust store")
+	trusted, err := pkcs12.DecodeTrustStore(data["/data/truststore.p12"], "changeit")
+	require.Nil(t, err)
+	require.Equal(t, ca.Raw, trusted[0].Raw, "Test pkcs12 trust store")
+
+	// Keystores are identical across admissions
+	again, err := s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Equal(t, result.Patch, again.Patch, "Test deterministic keystores")
+
+	// Keystores without Vault reference are plaintext
+	s.Provenance = true
+	plaintext := keystoreSecret(map[string]string{
+		"truststore.jks": `{"format": "jks", "ca": "vault:tls#ca", "password": "changeit"}`,
+		"truststore.p12": `{"format": "pkcs12", "ca": ` + strconv.Quote(caPEM) + `, "password": "changeit"}`,
+	})
+	result, err = s.mutateSecretData(plaintext, mutateOptions{})
+	require.Nil(t, err)
+	var provenance map[string]Provenance
+	require.Nil(t, json.Unmarshal([]byte(result.Patch[2].Value.(string)), &provenance))
+	require.Contains(t, provenance, "truststore.jks", "Test resolved keystore provenance")
+	require.NotContains(t, provenance, "truststore.p12", "Test plaintext keystore provenance")
+	s.Provenance = false
+
+	// Nothing is built on dry-run requests
+	result, err = s.mutateSecretData(secret, mutateOptions{DryRun: true})
+	require.Nil(t, err)
+	require.Empty(t, result.Patch, "Test dry-run")
+}
+
+func TestServer_mutateSecretDataKeystoreErrors(t *testing.T) {
+
+	_, _, certPEM, _ := testPEMCertificate(t, "app", nil, nil)
+	_, _, _, otherKeyPEM := testPEMCertificate(t, "other", nil, nil)
+
+	s := Server{
+		Vault: fakeVersionVaultClient{Values: map[string]string{
+			"secret/data/test-namespace/tls#crt":   certPEM,
+			"secret/data/test-namespace/tls#key":   otherKeyPEM,
+			"secret/data/test-namespace/tls#empty": "",
+		}},
+		VaultPattern: "secret/data/{{.Namespace}}/{{.Secret}}",
+		Logger:       logrus.New(),
+	}
+
+	var keystoreTests = []struct {
+		description string
+		spec        string
+		errorString string
+	}{
+		{"Test invalid json", `{"format": "jks"`, "invalid keystore specification"},
+		{"Test unknown field", `{"format": "jks", "ca": "x", "password": "x", "chain": "x"}`, `unknown field "chain"`},
+		{"Test unknown format", `{"format": "pem", "ca": "x", "password": "x"}`, "format must be pkcs12 or jks"},
+		{"Test cert without key", `{"format": "jks", "cert": "vault:tls#crt", "password": "x"}`, "cert and key must be set together"},
+		{"Test missing password", `{"format": "jks", "ca": "vault:tls#crt"}`, "password is required"},
+		{"Test empty password", `{"format": "jks", "ca": "vault:tls#crt", "password": "vault:tls#empty"}`, "password is empty"},
+		{"Test mismatched key", `{"format": "pkcs12", "cert": "vault:tls#crt", "key": "vault:tls#key", "password": "x"}`, "invalid cert or key"},
+		{"Test invalid ca", `{"format": "pkcs12", "ca": "vault:tls#key", "password": "x"}`, "invalid ca: no PEM certificate found"},
+	}
+
+	for _, test := range keystoreTests {
+		_, err := s.mutateSecretData(keystoreSecret(map[string]string{"keystore": test.spec}), mutateOptions{})
+		var denial admissionError
+		require.True(t, errors.As(err, &denial), test.description)
+		require.Equal(t, int32(http.StatusUnprocessableEntity), denial.code, test.description)
+		require.Contains(t, denial.message, test.errorString, test.description)
+	}
+}
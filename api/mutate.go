@@ -3,26 +3,93 @@ package api
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"regexp"
-	"strings"
+	"net/http"
+	"sort"
 	"text/template"
 
 	"github.com/Masterminds/sprig/v3"
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// auditAnnotationReads is the audit annotation listing Vault references read
+// for each data key, prefixed by the webhook name in the audit log
+const auditAnnotationReads = "vault-reads"
+
+// auditAnnotationReused is the audit annotation listing Vault references
+// whose value was reused from the previous admission of the secret
+const auditAnnotationReused = "vault-reused"
+
+// auditAnnotationGenerated is the audit annotation listing Vault references
+// whose value was generated and stored in Vault by this admission
+const auditAnnotationGenerated = "vault-generated"
+
+// mutateOptions holds admission request details used to mutate a secret
+type mutateOptions struct {
+	// OldSecret is the secret being replaced on UPDATE requests
+	OldSecret *corev1.Secret
+
+	// DryRun is true for dry-run requests, which must not have side effects
+	DryRun bool
+
+	// Resync is true for writes by the resync reconciler or the VaultSecret
+	// controller, whose provenance of values with a matching content hash is
+	// trusted
+	Resync bool
+}
+
+// mutation holds the result of a secret mutation
+type mutation struct {
+	Patch            []patchOperation
+	Warnings         []string
+	AuditAnnotations map[string]string
+}
+
+// fallbackError is implemented by Vault client errors returned along with a
+// fallback value, for example when a secret doesn't exist in Vault. The
+// fallback value is injected and a warning is returned to the client.
+type fallbackError interface {
+	error
+	Fallback() bool
+}
+
 // mutateSecretData iterates over all secret keys and replace values if necessary
-// by secret values stored in Vault
-func (s *Server) mutateSecretData(secret corev1.Secret) ([]patchOperation, error) {
+// by secret values stored in Vault. Placeholders that can't be resolved return
+// an admissionError denying the request, other errors are internal errors.
+func (s *Server) mutateSecretData(secret corev1.Secret, opts mutateOptions) (mutation, error) {
 
-	// Patchs list
-	patch := []patchOperation{}
+	// Patchs, warnings and Vault references read
+	result := mutation{Patch: []patchOperation{}, AuditAnnotations: map[string]string{}}
+	reads := map[string]string{}
+	provenance := map[string]Provenance{}
+	resolved := map[string][]byte{}
+	reused := map[string]string{}
+	generated := map[string]string{}
 
-	// Check each data key for secret to mutate
-	for k8sSecretKey, k8sSecretValue := range secret.Data {
+	// Values resolved on previous admission can be reused on UPDATE
+	// for unchanged placeholders
+	reusable := map[string]reusedValue{}
+	if s.ReuseOnUpdate && opts.OldSecret != nil {
+		var err error
+		reusable, err = reusableValues(secret, *opts.OldSecret)
+		if err != nil {
+			s.Logger.WithError(err).Warn("failed to get reusable values from old secret, reading all values from vault")
+		}
+	}
+
+	// Check each data key for secret to mutate, in order for stable warnings
+	k8sSecretKeys := make([]string, 0, len(secret.Data))
+	for k8sSecretKey := range secret.Data {
+		k8sSecretKeys = append(k8sSecretKeys, k8sSecretKey)
+	}
+	sort.Strings(k8sSecretKeys)
+
+	for _, k8sSecretKey := range k8sSecretKeys {
+		k8sSecretValue := secret.Data[k8sSecretKey]
 
 		logger := s.Logger.WithFields(logrus.Fields{
 			"kubernetes_secret_name":      secret.Name,
@@ -30,79 +97,150 @@ func (s *Server) mutateSecretData(secret corev1.Secret) ([]patchOperation, error
 			"kubernetes_secret_key":       k8sSecretKey,
 		})
 
-		// Ignore if no "vault:" prefix on secret value
-		if !strings.HasPrefix(string(k8sSecretValue), "vault:") {
-			logger.Debug("value doesn't have 'vault:' prefix, ignoring")
+		// Warn about values looking like malformed placeholders
+		if warning := placeholderWarning(string(k8sSecretValue)); warning != "" {
+			logger.Warn(warning)
+			result.Warnings = append(result.Warnings, fmt.Sprintf("data key %q: %s", k8sSecretKey, warning))
+		}
+
+		// Extract placeholder scheme, path and key, ignore if no registered
+		// scheme prefix on secret value
+		ph, ok, err := s.parseSchemePlaceholder(string(k8sSecretValue))
+		if !ok {
+			logger.Debug("value doesn't have a placeholder prefix, ignoring")
 			secretIgnored.Inc()
 			continue
 		}
-
-		// Extract Vault secret path and key
-		re := regexp.MustCompile(`^vault:(.*)#(.*)$`)
-		sub := re.FindStringSubmatch(string(k8sSecretValue))
-		if len(sub) != 3 {
-			logger.Errorf("vault placeholder '%s' doesn't match regex '^vault:(.*)#(.*)$'", string(k8sSecretValue))
+		if err != nil {
+			logger.WithError(err).Error("invalid vault placeholder")
 			secretFailed.Inc()
-			return []patchOperation{}, fmt.Errorf("vault placeholder '%s' doesn't match regex '^vault:(.*)#(.*)$'", string(k8sSecretValue))
+			return mutation{Patch: []patchOperation{}, Warnings: result.Warnings}, err
+		}
+		ph = s.route(secret, ph)
+		err = s.checkEndpointNamespace(secret, ph)
+		if err != nil {
+			logger.WithError(err).Error("vault endpoint not allowed")
+			secretFailed.Inc()
+			return mutation{Patch: []patchOperation{}}, err
 		}
-		vaultRawSecretPath := sub[1]
-		vaultSecretKey := sub[2]
 
 		// Check that required fields are not empty
 		for key, val := range map[string]string{"name": secret.Name, "namespace": secret.Namespace} {
 			if val == "" {
 				logger.Errorf("secret field %s cannot be empty", key)
 				secretFailed.Inc()
-				return []patchOperation{}, fmt.Errorf("secret field %s cannot be empty", key)
+				return mutation{Patch: []patchOperation{}}, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "secret field %s cannot be empty", key)
 			}
 		}
 
 		// Template vault secret path
-		pathTemplate, err := template.New("path").Funcs(sprig.TxtFuncMap()).Parse(s.VaultPattern)
-		if err != nil {
-			logger.WithError(err).Errorf("failed to parse template vault path pattern")
-			secretFailed.Inc()
-			return []patchOperation{}, errors.New("failed to parse template vault path pattern")
-		}
-
-		var vaultSecretPath bytes.Buffer
-		err = pathTemplate.Execute(&vaultSecretPath, struct {
-			Name      string
-			Namespace string
-			Secret    string
-		}{
-			Name:      secret.Name,        // Kubernetes secret name
-			Namespace: secret.Namespace,   // Kubernetes secret namespace
-			Secret:    vaultRawSecretPath, // Kubernetes secret parsed value
-		})
+		vaultSecretPath, err := s.vaultPath(secret.Name, secret.Namespace, ph)
 		if err != nil {
-			logger.WithError(err).Error("failed to execute template function on vault path pattern")
+			logger.WithError(err).Error("failed to template vault path pattern")
 			secretFailed.Inc()
-			return []patchOperation{}, errors.New("failed to execute template function on vault path pattern")
+			return mutation{Patch: []patchOperation{}}, err
 		}
 
 		logger = logger.WithFields(logrus.Fields{
-			"vault_secret_path": vaultSecretPath.String(),
-			"vault_secret_key":  vaultSecretKey,
+			"vault_secret_path": vaultSecretPath,
+			"vault_secret_key":  ph.Key,
 		})
+		if ph.Scheme != "" {
+			logger = logger.WithField("placeholder_scheme", ph.Scheme)
+		}
+		if ph.Endpoint != "" {
+			logger = logger.WithField("vault_endpoint", ph.Endpoint)
+		}
+
+		// Random values are only generated at paths allowed by policy
+		if ph.Generate != nil {
+			err = s.checkGeneratePolicy(vaultSecretPath)
+			if err != nil {
+				logger.WithError(err).Error("vault secret generation not allowed")
+				secretFailed.Inc()
+				return mutation{Patch: []patchOperation{}}, err
+			}
+		}
+
+		// Dry-run requests only validate placeholders and optionally check
+		// the Vault secret exists, values are never read nor generated and
+		// placeholders are returned unchanged
+		if opts.DryRun {
+			if ph.Generate == nil {
+				err = s.checkVaultPath(ph, vaultSecretPath)
+			}
+			if err != nil {
+				logger.WithError(err).Error("dry-run vault secret check failed")
+				secretFailed.Inc()
+				return mutation{Patch: []patchOperation{}}, err
+			}
+
+			result.Patch = append(result.Patch, patchOperation{
+				Op:    "replace",
+				Path:  fmt.Sprintf("/data/%s", k8sSecretKey),
+				Value: base64.StdEncoding.EncodeToString(k8sSecretValue),
+			})
+			secretDryRun.Inc()
+
+			logger.Info("kubernetes secret validated on dry-run")
+			continue
+		}
+
+		// Reuse value resolved on previous admission if the placeholder
+		// still resolves to the same Vault path and key
+		if r, ok := reusable[k8sSecretKey]; ok && r.Provenance.Scheme == ph.Scheme && r.Provenance.Endpoint == ph.Endpoint && r.Provenance.Path == vaultSecretPath && r.Provenance.Key == ph.Key {
+			result.Patch = append(result.Patch, patchOperation{
+				Op:    "replace",
+				Path:  fmt.Sprintf("/data/%s", k8sSecretKey),
+				Value: base64.StdEncoding.EncodeToString(r.Value),
+			})
+			reused[k8sSecretKey] = ph.ref(vaultSecretPath)
+			resolved[k8sSecretKey] = r.Value
+			provenance[k8sSecretKey] = r.Provenance
+			secretReused.Inc()
+
+			logger.Info("kubernetes secret mutated with value reused from previous admission")
+			continue
+		}
 
-		// Read secret from Vault
-		vaultSecretValue, err := s.Vault.Read(vaultSecretPath.String(), vaultSecretKey)
+		// Read secret from Vault, generated and stored first if missing for
+		// generate placeholders, fallback values are injected with a warning
+		var vaultSecretValue string
+		var vaultSecretVersion int
+		created := false
+		if ph.Generate != nil {
+			vaultSecretValue, vaultSecretVersion, created, err = s.generateVault(vaultSecretPath, ph)
+		} else {
+			vaultSecretValue, vaultSecretVersion, err = s.resolve(ph, vaultSecretPath)
+		}
+		var fallback fallbackError
+		if errors.As(err, &fallback) && fallback.Fallback() {
+			logger.WithError(err).Warn("vault secret not found, fallback value used")
+			result.Warnings = append(result.Warnings, fmt.Sprintf("data key %q: %s, fallback value used", k8sSecretKey, err))
+			err = nil
+		}
 		if err != nil {
 			logger.WithError(err).Error("failed to read secret in vault")
 			secretFailed.Inc()
-			return []patchOperation{}, fmt.Errorf("failed to read secret '%s' in vault: %s", vaultSecretPath.String(), err)
+			return mutation{Patch: []patchOperation{}}, denied(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, "failed to read secret '%s' in vault: %s", vaultSecretPath, err)
 		}
 
 		// Create patch to mutate secret value with vault value
-		patch = append(
-			patch,
+		result.Patch = append(
+			result.Patch,
 			patchOperation{
 				Op:    "replace",
 				Path:  fmt.Sprintf("/data/%s", k8sSecretKey),
 				Value: base64.StdEncoding.EncodeToString([]byte(vaultSecretValue)),
 			},
 		)
+		reads[k8sSecretKey] = ph.ref(vaultSecretPath)
+		if created {
+			generated[k8sSecretKey] = reads[k8sSecretKey]
+			secretGenerated.Inc()
+		}
+		resolved[k8sSecretKey] = []byte(vaultSecretValue)
+		provenance[k8sSecretKey] = ph.provenance(string(k8sSecretValue), vaultSecretPath, vaultSecretVersion)
 
 		// Increment secret mutated counter for prometheus metric
 		secretMutated.Inc()
@@ -110,5 +248,125 @@ func (s *Server) mutateSecretData(secret corev1.Secret) ([]patchOperation, error
 		logger.Info("kubernetes secret mutated with vault value")
 	}
 
-	return patch, nil
+	// Build data keys of typed secrets from typed field annotations, render
+	// data key templates and build keystores, replacing values of the same keys
+	dataCreated := false
+	for _, build := range []func(corev1.Secret, bool) (builtData, error){s.typedSecretData, s.templateSecretData, s.keystoreSecretData} {
+		built, err := build(secret, opts.DryRun)
+		if err != nil {
+			logger := s.Logger.WithFields(logrus.Fields{"kubernetes_secret_name": secret.Name, "kubernetes_secret_namespace": secret.Namespace})
+			logger.WithError(err).Error("failed to build secret data from annotations")
+			secretFailed.Inc()
+			return mutation{Patch: []patchOperation{}}, err
+		}
+		if len(built.Data) > 0 && secret.Data == nil && !dataCreated {
+			result.Patch = append(result.Patch, patchOperation{Op: "add", Path: "/data", Value: map[string]string{}})
+			dataCreated = true
+		}
+		builtKeys := make([]string, 0, len(built.Data))
+		for key := range built.Data {
+			builtKeys = append(builtKeys, key)
+		}
+		sort.Strings(builtKeys)
+		for _, key := range builtKeys {
+			result.Patch = append(result.Patch, patchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/data/%s", key),
+				Value: base64.StdEncoding.EncodeToString(built.Data[key]),
+			})
+			resolved[key] = built.Data[key]
+			if p, ok := built.Provenance[key]; ok {
+				provenance[key] = p
+			} else {
+				delete(provenance, key)
+			}
+			secretMutated.Inc()
+		}
+		for ref, path := range built.Reads {
+			reads[ref] = path
+		}
+	}
+
+	// Nothing is resolved on dry-run requests
+	dryRunMutated := opts.DryRun && len(result.Patch) > 0
+
+	// Record provenance of mutated data keys on the secret, merged with
+	// provenance of values unchanged since a previous admission. Provenance
+	// sent by clients is replaced on dry-run requests too, as it is checked
+	// by the validating webhook.
+	if s.Provenance {
+		merged, err := mergeProvenance(secret, opts.OldSecret, provenance, opts.Resync)
+		if err != nil {
+			logger := s.Logger.WithFields(logrus.Fields{"kubernetes_secret_name": secret.Name, "kubernetes_secret_namespace": secret.Namespace})
+			logger.WithError(err).Warn("failed to merge recorded provenance, replacing it")
+			merged = provenance
+		}
+		patch, err := provenancePatch(secret, merged, resolved)
+		if err != nil {
+			return mutation{Patch: []patchOperation{}}, err
+		}
+		result.Patch = append(result.Patch, patch...)
+	}
+
+	if opts.DryRun {
+		if dryRunMutated {
+			result.Warnings = append(result.Warnings, dryRunWarning)
+		}
+		return result, nil
+	}
+
+	// Record Vault references read or reused, never the values
+	for annotation, refs := range map[string]map[string]string{auditAnnotationReads: reads, auditAnnotationReused: reused, auditAnnotationGenerated: generated} {
+		if len(refs) == 0 {
+			continue
+		}
+		refsJSON, err := json.Marshal(refs)
+		if err != nil {
+			return mutation{Patch: []patchOperation{}}, fmt.Errorf("failed to marshal %s audit annotation: %s", annotation, err)
+		}
+		result.AuditAnnotations[annotation] = string(refsJSON)
+	}
+
+	return result, nil
+}
+
+// vaultPath templates the Vault secret path of a placeholder with the
+// configured vault pattern, unless its resolver uses raw paths or has its
+// own pattern
+func (s *Server) vaultPath(name, namespace string, ph placeholder) (string, error) {
+	if r, ok := s.placeholderResolver(ph); ok {
+		if pr, ok := r.(PathPatternResolver); ok {
+			if pr.PathPattern() == "" {
+				return ph.Path, nil
+			}
+			return VaultPath(pr.PathPattern(), name, namespace, ph.Path)
+		}
+	}
+
+	return VaultPath(s.VaultPattern, name, namespace, ph.Path)
+}
+
+// VaultPath templates a Vault secret path with a vault pattern, for a
+// Kubernetes object name and namespace and a placeholder path
+func VaultPath(pattern, name, namespace, path string) (string, error) {
+	pathTemplate, err := template.New("path").Funcs(sprig.TxtFuncMap()).Parse(pattern)
+	if err != nil {
+		return "", errors.New("failed to parse template vault path pattern")
+	}
+
+	var vaultSecretPath bytes.Buffer
+	err = pathTemplate.Execute(&vaultSecretPath, struct {
+		Name      string
+		Namespace string
+		Secret    string
+	}{
+		Name:      name,      // Kubernetes object name
+		Namespace: namespace, // Kubernetes object namespace
+		Secret:    path,      // Kubernetes secret parsed value
+	})
+	if err != nil {
+		return "", errors.New("failed to execute template function on vault path pattern")
+	}
+
+	return vaultSecretPath.String(), nil
 }
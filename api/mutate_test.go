@@ -133,7 +133,8 @@ func TestServer_mutateSecretData(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		patch, err := s.mutateSecretData(secret)
+		result, err := s.mutateSecretData(secret, mutateOptions{})
+		patch := result.Patch
 		if test.errorString == "" {
 			require.Nil(t, err, test.description)
 		} else {
@@ -151,3 +152,98 @@ func TestServer_mutateSecretData(t *testing.T) {
 		require.Equal(t, patch, test.patch, test.description)
 	}
 }
+
+// Fake Vault fallback error for testing
+type fakeFallbackError struct{}
+
+func (f fakeFallbackError) Error() string  { return "key \"bar\" not found in Vault" }
+func (f fakeFallbackError) Fallback() bool { return true }
+
+// Fake Vault client returning fallback values for testing
+type fakeFallbackVaultClient struct{}
+
+func (f fakeFallbackVaultClient) Read(path, key string) (string, error) {
+	return fakeFallbackError{}.Error(), fakeFallbackError{}
+}
+
+func TestServer_mutateSecretDataWarnings(t *testing.T) {
+
+	var warningTests = []struct {
+		description      string
+		vaultClient      VaultClient
+		data             map[string][]byte
+		warnings         []string
+		auditAnnotations map[string]string
+	}{
+		{
+			"Test valid placeholders are audited without warnings",
+			fakeVaultClient{Value: "bar"},
+			map[string][]byte{"foo": []byte("vault:foo#bar"), "foo2": []byte("vault:foo2#bar2"), "simple": []byte("test")},
+			nil,
+			map[string]string{"vault-reads": `{"foo":"secret/data/foo#bar","foo2":"secret/data/foo2#bar2"}`},
+		},
+		{
+			"Test wrong case prefix",
+			fakeVaultClient{Value: "bar"},
+			map[string][]byte{"foo": []byte("Vault:foo#bar")},
+			[]string{`data key "foo": value looks like a vault placeholder with a wrong case prefix, left unchanged`},
+			map[string]string{},
+		},
+		{
+			"Test surrounding whitespace",
+			fakeVaultClient{Value: "bar"},
+			map[string][]byte{"foo": []byte(" vault:foo#bar"), "foo2": []byte("vault:foo#bar ")},
+			[]string{
+				`data key "foo": value looks like a vault placeholder surrounded by whitespace, left unchanged`,
+				`data key "foo2": vault placeholder has trailing whitespace`,
+			},
+			map[string]string{"vault-reads": `{"foo2":"secret/data/foo#bar "}`},
+		},
+		{
+			"Test empty key",
+			fakeVaultClient{Value: "bar"},
+			map[string][]byte{"foo": []byte("vault:foo#")},
+			[]string{`data key "foo": vault placeholder has an empty path or key`},
+			map[string]string{"vault-reads": `{"foo":"secret/data/foo#"}`},
+		},
+		{
+			"Test fallback value used",
+			fakeFallbackVaultClient{},
+			map[string][]byte{"foo": []byte("vault:foo#bar")},
+			[]string{`data key "foo": key "bar" not found in Vault, fallback value used`},
+			map[string]string{"vault-reads": `{"foo":"secret/data/foo#bar"}`},
+		},
+	}
+
+	for _, test := range warningTests {
+
+		s := Server{
+			Vault:        test.vaultClient,
+			VaultPattern: "secret/data/{{.Secret}}",
+			Logger:       logrus.New(),
+		}
+
+		secret := corev1.Secret{Data: test.data}
+		secret.Name = "test-secret"
+		secret.Namespace = "test-namespace"
+
+		result, err := s.mutateSecretData(secret, mutateOptions{})
+		require.Nil(t, err, test.description)
+		require.Equal(t, test.warnings, result.Warnings, test.description)
+		require.Equal(t, test.auditAnnotations, result.AuditAnnotations, test.description)
+
+		// Audit annotations never contain vault values
+		for _, annotation := range result.AuditAnnotations {
+			require.NotContains(t, annotation, `"bar"`, test.description)
+		}
+	}
+
+	// Placeholders without key are denied with a warning
+	s := Server{Vault: fakeVaultClient{Value: "bar"}, VaultPattern: "secret/data/{{.Secret}}", Logger: logrus.New()}
+	secret := corev1.Secret{Data: map[string][]byte{"foo": []byte("vault:foo")}}
+	secret.Name = "test-secret"
+	secret.Namespace = "test-namespace"
+	result, err := s.mutateSecretData(secret, mutateOptions{})
+	require.Error(t, err, "Test missing key is denied")
+	require.Equal(t, []string{`data key "foo": vault placeholder has no '#key', expected 'vault:path#key'`}, result.Warnings, "Test missing key warning")
+}
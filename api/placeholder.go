@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// placeholderPrefix is the prefix of secret values to replace by Vault values
+const placeholderPrefix = "vault:"
+
+// placeholderRegex extracts Vault secret path and key from a placeholder
+var placeholderRegex = regexp.MustCompile(`^vault:(.*)#(.*)$`)
+
+// placeholder represent a Vault reference parsed from a secret value
+type placeholder struct {
+	Path string
+	Key  string
+
+	// Scheme is the resolver scheme, empty for Vault placeholders
+	Scheme string
+
+	// Keyless is set for placeholders of resolvers without keys
+	Keyless bool
+
+	// Endpoint is the Vault endpoint of vault placeholders, from their
+	// prefix or routes, empty for the default endpoint
+	Endpoint string
+
+	// Generate is set for "vault-generate:" placeholders
+	Generate *generateOptions
+}
+
+// parsePlaceholder extracts Vault secret path and key from a secret value,
+// ok is false if the value doesn't have the "vault:" or "vault-generate:"
+// prefix and must be left unchanged. A value with the prefix that doesn't
+// match the placeholder regex returns an admissionError.
+func parsePlaceholder(value string) (p placeholder, ok bool, err error) {
+
+	// Random values are generated in Vault if missing
+	if strings.HasPrefix(value, generatePrefix) {
+		p, err = parseGeneratePlaceholder(value)
+		return p, true, err
+	}
+
+	// Ignore if no "vault:" prefix on secret value
+	if !strings.HasPrefix(value, placeholderPrefix) {
+		return placeholder{}, false, nil
+	}
+
+	sub := placeholderRegex.FindStringSubmatch(value)
+	if len(sub) != 3 {
+		return placeholder{}, true, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "vault placeholder '%s' doesn't match regex '^vault:(.*)#(.*)$'", value)
+	}
+
+	return placeholder{Path: sub[1], Key: sub[2]}, true, nil
+}
+
+// ParsePlaceholder extracts Vault secret path and key from a placeholder of
+// the form "vault:path#key", ok is false if the value doesn't have the
+// "vault:" prefix
+func ParsePlaceholder(value string) (path, key string, ok bool, err error) {
+	if strings.HasPrefix(value, generatePrefix) {
+		return "", "", false, nil
+	}
+
+	p, ok, err := parsePlaceholder(value)
+	return p.Path, p.Key, ok, err
+}
+
+// checkNoGenerate returns an admissionError for "vault-generate:"
+// placeholders used where values can't be generated
+func checkNoGenerate(ph placeholder, location string) error {
+	if ph.Generate == nil {
+		return nil
+	}
+
+	return denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "%s: vault-generate placeholders are only supported in secret data", location)
+}
+
+// placeholderWarning returns a warning message if a secret value looks like
+// a malformed placeholder, or an empty string otherwise
+func placeholderWarning(value string) string {
+
+	// Placeholders without key are denied, the warning tells how to fix them
+	if strings.HasPrefix(value, placeholderPrefix) && !strings.Contains(value, "#") {
+		return "vault placeholder has no '#key', expected 'vault:path#key'"
+	}
+
+	// Valid placeholders with an empty path or key are resolved but
+	// most likely a mistake
+	if p, ok, err := parsePlaceholder(value); ok {
+		if err == nil && (p.Path == "" || p.Key == "") {
+			return "vault placeholder has an empty path or key"
+		}
+		if err == nil && strings.TrimSpace(value) != value {
+			return "vault placeholder has trailing whitespace"
+		}
+		return ""
+	}
+
+	// Only the beginning of the value is checked as values can be large
+	head := value
+	if len(head) > 64 {
+		head = head[:64]
+	}
+	trimmed := strings.TrimSpace(head)
+
+	if !strings.HasPrefix(strings.ToLower(trimmed), placeholderPrefix) {
+		return ""
+	}
+	if trimmed != head && strings.HasPrefix(trimmed, placeholderPrefix) {
+		return "value looks like a vault placeholder surrounded by whitespace, left unchanged"
+	}
+
+	return "value looks like a vault placeholder with a wrong case prefix, left unchanged"
+}
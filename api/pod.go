@@ -0,0 +1,340 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AnnotationInject enables secrets injection in a pod when set to "true"
+	AnnotationInject = annotationPrefix + "inject"
+
+	// AnnotationSecretPrefix is the prefix of pod annotations referencing a
+	// Vault secret, the annotation suffix is the name of the injected file
+	AnnotationSecretPrefix = annotationPrefix + "secret-"
+
+	// AnnotationRole overrides the Vault role the init container logs in with,
+	// among the roles allowed by the webhook configuration
+	AnnotationRole = annotationPrefix + "role"
+
+	// AnnotationMountPath overrides the directory secrets are mounted in
+	AnnotationMountPath = annotationPrefix + "mount-path"
+
+	// DefaultMountPath is the default directory secrets are mounted in
+	DefaultMountPath = "/vault/secrets"
+
+	// injectVolume and injectContainer are the names of the volume and init
+	// container added to pods
+	injectVolume    = "vault-secrets"
+	injectContainer = "vault-fetch"
+)
+
+// systemMountPaths are the directories secrets can't be mounted in, over or
+// under, so that the in-memory volume never shadows system files or the
+// service account token in /var/run/secrets
+var systemMountPaths = []string{"/bin", "/boot", "/dev", "/etc", "/lib", "/lib64", "/proc", "/root", "/run", "/sbin", "/sys", "/usr", "/var/run"}
+
+func (s *Server) podHandler(w http.ResponseWriter, r *http.Request) {
+
+	logger := s.Logger.WithField("handler", "pod")
+	logger.Debug("request received, handling")
+
+	admissionReview, logger, ok := s.readAdmissionReview(w, r, logger, "Pod", podFailed, podIgnored)
+	if !ok {
+		return
+	}
+
+	// Parse pod object
+	var pod corev1.Pod
+	err := json.Unmarshal(admissionReview.Request.Object.Raw, &pod)
+	if err != nil {
+		logger.WithError(err).Error("failed to unmarshal pod")
+		s.sendAdmissionReviewDenied(w, admissionReview, admissionError{
+			code:    http.StatusBadRequest,
+			reason:  metav1.StatusReasonBadRequest,
+			message: fmt.Sprintf("failed to unmarshal pod: %s", err),
+		})
+		podFailed.Inc()
+		return
+	}
+
+	// Pods created by controllers may not have their namespace set yet
+	if pod.Namespace == "" {
+		pod.Namespace = admissionReview.Request.Namespace
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"kubernetes_pod_name":      podName(pod),
+		"kubernetes_pod_namespace": pod.Namespace,
+	})
+
+	patch, err := s.podPatch(pod)
+	var denial admissionError
+	if errors.As(err, &denial) {
+		logger.WithError(err).Warn("pod denied")
+		s.sendAdmissionReviewDenied(w, admissionReview, denial)
+		podFailed.Inc()
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("failed to mutate pod")
+		s.sendAdmissionReviewError(w, admissionReview, err)
+		podFailed.Inc()
+		return
+	}
+
+	// Marshal patches
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		logger.WithError(err).Error("failed to marshal patches")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		podFailed.Inc()
+		return
+	}
+
+	admissionReview.Response = &admission.AdmissionResponse{
+		UID:     admissionReview.Request.UID,
+		Allowed: true,
+		Patch:   patchBytes,
+		PatchType: func() *admission.PatchType {
+			pt := admission.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}
+	s.sendAdmissionReview(w, admissionReview)
+
+	if len(patch) > 0 {
+		logger.Info("kubernetes pod mutated")
+		podMutated.Inc()
+	} else {
+		podIgnored.Inc()
+	}
+}
+
+// podPatcher builds patch operations on a pod, keeping track of arrays
+// created by previous operations
+type podPatcher struct {
+	pod   corev1.Pod
+	patch []patchOperation
+}
+
+// addVolume adds a volume to the pod
+func (p *podPatcher) addVolume(volume corev1.Volume) {
+	if p.pod.Spec.Volumes == nil {
+		p.patch = append(p.patch, patchOperation{Op: "add", Path: "/spec/volumes", Value: []corev1.Volume{volume}})
+	} else {
+		p.patch = append(p.patch, patchOperation{Op: "add", Path: "/spec/volumes/-", Value: volume})
+	}
+	p.pod.Spec.Volumes = append(p.pod.Spec.Volumes, volume)
+}
+
+// addInitContainer adds an init container running before all others
+func (p *podPatcher) addInitContainer(container corev1.Container) {
+	if p.pod.Spec.InitContainers == nil {
+		p.patch = append(p.patch, patchOperation{Op: "add", Path: "/spec/initContainers", Value: []corev1.Container{container}})
+	} else {
+		p.patch = append(p.patch, patchOperation{Op: "add", Path: "/spec/initContainers/0", Value: container})
+	}
+	p.pod.Spec.InitContainers = append([]corev1.Container{container}, p.pod.Spec.InitContainers...)
+}
+
+// addVolumeMount adds a volume mount to a container
+func (p *podPatcher) addVolumeMount(i int, mount corev1.VolumeMount) {
+	if p.pod.Spec.Containers[i].VolumeMounts == nil {
+		p.patch = append(p.patch, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/volumeMounts", i), Value: []corev1.VolumeMount{mount}})
+	} else {
+		p.patch = append(p.patch, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", i), Value: mount})
+	}
+	p.pod.Spec.Containers[i].VolumeMounts = append(p.pod.Spec.Containers[i].VolumeMounts, mount)
+}
+
+// hasInitContainer returns true if the pod has an init container by name
+func hasInitContainer(pod corev1.Pod, name string) bool {
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// podRole returns the Vault role injected containers log in with, pods can
+// only choose allowed roles so that pod authors can't log in with the role
+// of other workloads
+func (s *Server) podRole(pod corev1.Pod) (string, error) {
+	role, ok := pod.Annotations[AnnotationRole]
+	if !ok {
+		return s.InjectRole, nil
+	}
+
+	for _, allowed := range s.InjectRoles {
+		if role == allowed {
+			return role, nil
+		}
+	}
+
+	return "", denied(http.StatusForbidden, metav1.StatusReasonForbidden, "vault role '%s' of annotation %s is not allowed", role, AnnotationRole)
+}
+
+// podMountPath returns the directory secrets are mounted in, annotated paths
+// must be absolute, clean and out of system directories
+func podMountPath(pod corev1.Pod) (string, error) {
+	mountPath, ok := pod.Annotations[AnnotationMountPath]
+	if !ok {
+		return DefaultMountPath, nil
+	}
+
+	if !path.IsAbs(mountPath) || path.Clean(mountPath) != mountPath {
+		return "", denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "mount path '%s' of annotation %s must be an absolute clean path", mountPath, AnnotationMountPath)
+	}
+	for _, system := range systemMountPaths {
+		if mountPath == system || strings.HasPrefix(mountPath, system+"/") || strings.HasPrefix(system, strings.TrimSuffix(mountPath, "/")+"/") {
+			return "", denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "mount path '%s' of annotation %s is in or over system directory %s", mountPath, AnnotationMountPath, system)
+		}
+	}
+
+	return mountPath, nil
+}
+
+// checkInjectConfig returns an error if pod injection isn't configured
+func (s *Server) checkInjectConfig() error {
+	if s.InjectImage == "" || s.InjectVaultAddr == "" {
+		return errors.New("pod injection requires inject image and vault address to be configured")
+	}
+	return nil
+}
+
+// podPatch returns patch operations injecting Vault secrets in a pod,
+// as files for annotated pods and through the exec wrapper for containers
+// with Vault references in env values
+func (s *Server) podPatch(pod corev1.Pod) ([]patchOperation, error) {
+	p := &podPatcher{pod: *pod.DeepCopy(), patch: []patchOperation{}}
+
+	err := s.patchPodFiles(p)
+	if err != nil {
+		return []patchOperation{}, err
+	}
+
+	err = s.patchPodEnv(p)
+	if err != nil {
+		return []patchOperation{}, err
+	}
+
+	return p.patch, nil
+}
+
+// patchPodFiles adds an init container writing annotated Vault secrets to
+// an in-memory volume mounted in all containers. Pods without injection
+// annotation or already injected are left unchanged.
+func (s *Server) patchPodFiles(p *podPatcher) error {
+	pod := p.pod
+
+	// Webhook reinvocation must not inject twice
+	if pod.Annotations[AnnotationInject] != "true" || hasInitContainer(pod, injectContainer) {
+		return nil
+	}
+
+	err := s.checkInjectConfig()
+	if err != nil {
+		return err
+	}
+
+	secrets, err := s.podSecrets(pod)
+	if err != nil {
+		return err
+	}
+	if len(secrets) == 0 {
+		return denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "pod has %s annotation but no %s* annotation", AnnotationInject, AnnotationSecretPrefix)
+	}
+
+	mountPath, err := podMountPath(pod)
+	if err != nil {
+		return err
+	}
+
+	role, err := s.podRole(pod)
+	if err != nil {
+		return err
+	}
+
+	// Init container arguments are resolved Vault references, never values
+	args := []string{"fetch", "--vault-addr", s.InjectVaultAddr, "--vault-auth-mount", s.InjectAuthMount, "--vault-role", role, "--dir", mountPath}
+	args = append(args, secrets...)
+
+	p.addVolume(corev1.Volume{
+		Name:         injectVolume,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+	})
+	p.addInitContainer(corev1.Container{
+		Name:         injectContainer,
+		Image:        s.InjectImage,
+		Args:         args,
+		VolumeMounts: []corev1.VolumeMount{{Name: injectVolume, MountPath: mountPath}},
+	})
+	for i := range pod.Spec.Containers {
+		p.addVolumeMount(i, corev1.VolumeMount{Name: injectVolume, MountPath: mountPath, ReadOnly: true})
+	}
+
+	return nil
+}
+
+// podSecrets returns the pod secret annotations as fetch arguments of the
+// form file=path#key, sorted by file name, with paths templated with the
+// vault pattern
+func (s *Server) podSecrets(pod corev1.Pod) ([]string, error) {
+	files := []string{}
+	for annotation := range pod.Annotations {
+		if strings.HasPrefix(annotation, AnnotationSecretPrefix) {
+			files = append(files, strings.TrimPrefix(annotation, AnnotationSecretPrefix))
+		}
+	}
+	sort.Strings(files)
+
+	secrets := []string{}
+	for _, file := range files {
+		if file == "" || file == "." || file == ".." || strings.ContainsAny(file, "/=") {
+			return nil, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "annotation '%s%s' is not a valid file name", AnnotationSecretPrefix, file)
+		}
+
+		value := pod.Annotations[AnnotationSecretPrefix+file]
+		ph, ok, err := parsePlaceholder(value)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "annotation '%s%s' value doesn't have '%s' prefix", AnnotationSecretPrefix, file, placeholderPrefix)
+		}
+		err = checkNoGenerate(ph, fmt.Sprintf("annotation '%s%s'", AnnotationSecretPrefix, file))
+		if err != nil {
+			return nil, err
+		}
+
+		path, err := s.vaultPath(podName(pod), pod.Namespace, ph)
+		if err != nil {
+			return nil, err
+		}
+
+		secrets = append(secrets, fmt.Sprintf("%s=%s#%s", file, path, ph.Key))
+	}
+
+	return secrets, nil
+}
+
+// podName returns the pod name, or its generate name prefix for pods
+// created by controllers
+func podName(pod corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// injectServer returns a server configured for pod injection
+func injectServer() Server {
+	return Server{
+		VaultPattern:    "secret/data/{{.Namespace}}/{{.Secret}}",
+		InjectImage:     "ouestfrance/k8s-vault-webhook:test",
+		InjectVaultAddr: "https://vault:8200",
+		InjectAuthMount: "kubernetes",
+		InjectRole:      "default",
+		InjectRoles:     []string{"app"},
+		Logger:          logrus.New(),
+	}
+}
+
+// injectPod returns a pod with annotations and a single container
+func injectPod(annotations map[string]string) corev1.Pod {
+	pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app"}}}}
+	pod.Name = "test-pod"
+	pod.Namespace = "test-namespace"
+	pod.Annotations = annotations
+	return pod
+}
+
+func TestServer_podPatch(t *testing.T) {
+
+	s := injectServer()
+
+	pod := injectPod(map[string]string{
+		AnnotationInject:                   "true",
+		AnnotationSecretPrefix + "db.pass": "vault:db#password",
+		AnnotationSecretPrefix + "api":     "vault:api#token",
+		AnnotationRole:                     "app",
+	})
+
+	patch, err := s.podPatch(pod)
+	require.Nil(t, err)
+	require.Len(t, patch, 3, "Test volume, init container and mount patches")
+
+	require.Equal(t, patchOperation{Op: "add", Path: "/spec/volumes", Value: []corev1.Volume{{
+		Name:         injectVolume,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+	}}}, patch[0], "Test in-memory volume added")
+
+	require.Equal(t, "/spec/initContainers", patch[1].Path, "Test init container added")
+	initContainers := patch[1].Value.([]corev1.Container)
+	require.Equal(t, "ouestfrance/k8s-vault-webhook:test", initContainers[0].Image)
+	require.Equal(t, []string{
+		"fetch", "--vault-addr", "https://vault:8200", "--vault-auth-mount", "kubernetes", "--vault-role", "app", "--dir", DefaultMountPath,
+		"api=secret/data/test-namespace/api#token",
+		"db.pass=secret/data/test-namespace/db#password",
+	}, initContainers[0].Args, "Test init container arguments")
+
+	require.Equal(t, patchOperation{Op: "add", Path: "/spec/containers/0/volumeMounts", Value: []corev1.VolumeMount{{
+		Name: injectVolume, MountPath: DefaultMountPath, ReadOnly: true,
+	}}}, patch[2], "Test volume mounted in containers")
+
+	// Existing arrays are appended to, init container runs first
+	pod.Annotations[AnnotationMountPath] = "/secrets"
+	pod.Spec.Volumes = []corev1.Volume{{Name: "data"}}
+	pod.Spec.InitContainers = []corev1.Container{{Name: "migrate"}}
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", VolumeMounts: []corev1.VolumeMount{{Name: "data"}}})
+	patch, err = s.podPatch(pod)
+	require.Nil(t, err)
+	require.Equal(t, []string{"/spec/volumes/-", "/spec/initContainers/0", "/spec/containers/0/volumeMounts", "/spec/containers/1/volumeMounts/-"}, []string{patch[0].Path, patch[1].Path, patch[2].Path, patch[3].Path})
+	require.Equal(t, corev1.VolumeMount{Name: injectVolume, MountPath: "/secrets", ReadOnly: true}, patch[3].Value, "Test mount path annotation")
+
+	// Already injected pods are unchanged
+	pod.Spec.InitContainers = []corev1.Container{{Name: injectContainer}}
+	patch, err = s.podPatch(pod)
+	require.Nil(t, err)
+	require.Empty(t, patch, "Test pod injected once")
+}
+
+func TestServer_podPatchErrors(t *testing.T) {
+
+	var podTests = []struct {
+		description string
+		annotations map[string]string
+		denied      bool
+		empty       bool
+	}{
+		{"Test pod without annotation is unchanged", map[string]string{AnnotationSecretPrefix + "db": "vault:db#password"}, false, true},
+		{"Test pod without secrets is denied", map[string]string{AnnotationInject: "true"}, true, false},
+		{"Test invalid placeholder is denied", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db"}, true, false},
+		{"Test value without prefix is denied", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "db#password"}, true, false},
+		{"Test role not allowed is denied", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db#password", AnnotationRole: "admin"}, true, false},
+		{"Test invalid file name is denied", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "..": "vault:db#password"}, true, false},
+		{"Test custom mount path is allowed", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db#password", AnnotationMountPath: "/app/secrets"}, false, false},
+		{"Test relative mount path is denied", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db#password", AnnotationMountPath: "secrets"}, true, false},
+		{"Test unclean mount path is denied", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db#password", AnnotationMountPath: "/app/../etc"}, true, false},
+		{"Test trailing slash mount path is denied", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db#password", AnnotationMountPath: "/app/secrets/"}, true, false},
+		{"Test system mount path is denied", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db#password", AnnotationMountPath: "/etc"}, true, false},
+		{"Test service account mount path is denied", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db#password", AnnotationMountPath: "/var/run/secrets/kubernetes.io"}, true, false},
+		{"Test mount path over system directory is denied", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db#password", AnnotationMountPath: "/var"}, true, false},
+		{"Test root mount path is denied", map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db#password", AnnotationMountPath: "/"}, true, false},
+	}
+
+	s := injectServer()
+	for _, test := range podTests {
+		patch, err := s.podPatch(injectPod(test.annotations))
+		if test.denied {
+			require.True(t, errors.As(err, &admissionError{}), test.description)
+			continue
+		}
+		require.Nil(t, err, test.description)
+		require.Equal(t, test.empty, len(patch) == 0, test.description)
+	}
+
+	// Missing configuration is an internal error
+	s.InjectImage = ""
+	_, err := s.podPatch(injectPod(map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db#password"}))
+	require.NotNil(t, err)
+	require.False(t, errors.As(err, &admissionError{}), "Test missing inject image")
+}
+
+func TestServer_podHandler(t *testing.T) {
+
+	s := injectServer()
+
+	// Namespace is taken from the request for pods created by controllers
+	pod := `{"apiVersion":"v1","kind":"Pod","metadata":{"generateName":"app-","annotations":{"` + AnnotationInject + `":"true","` + AnnotationSecretPrefix + `db":"vault:db#password"}},"spec":{"containers":[{"name":"app","image":"app"}]}}`
+	body := strings.Replace(admissionReviewJSON("Pod", pod), `"resource":"secrets"`, `"resource":"pods"`, 1)
+
+	req := httptest.NewRequest(http.MethodPost, "/pod", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.Router().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var review admission.AdmissionReview
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &review))
+	require.True(t, review.Response.Allowed)
+	require.Contains(t, string(review.Response.Patch), `db=secret/data/test-namespace/db#password`, "Test request namespace used in vault path")
+}
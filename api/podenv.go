@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AnnotationCommandPrefix is the prefix of pod annotations setting the
+	// original command of a container as a JSON array, the annotation suffix
+	// is the container name. It is required for containers with Vault
+	// references in env values that rely on the image entrypoint.
+	AnnotationCommandPrefix = annotationPrefix + "command-"
+
+	// execVolume and execContainer are the names of the volume and init
+	// container installing the exec wrapper in pods
+	execVolume    = "vault-bin"
+	execContainer = "vault-install"
+
+	// execDir is the directory the exec wrapper is installed in
+	execDir = "/vault/bin"
+
+	// execBinary is the exec wrapper path in containers
+	execBinary = execDir + "/k8s-vault-webhook"
+)
+
+// patchPodEnv rewrites the command of containers with Vault references in
+// env values to run through the exec wrapper, which resolves them at process
+// start so that values never appear in the pod spec. References are templated
+// with the vault pattern in place. Pods already injected are left unchanged.
+func (s *Server) patchPodEnv(p *podPatcher) error {
+	pod := p.pod
+
+	// Webhook reinvocation must not inject twice
+	if hasInitContainer(pod, execContainer) {
+		return nil
+	}
+
+	installed := false
+	for i, c := range pod.Spec.Containers {
+		found := false
+		for j, env := range c.Env {
+			if env.ValueFrom != nil {
+				continue
+			}
+
+			ph, ok, err := parsePlaceholder(env.Value)
+			if !ok {
+				continue
+			}
+			if err == nil {
+				err = checkNoGenerate(ph, fmt.Sprintf("container '%s' env '%s'", c.Name, env.Name))
+			}
+			if err != nil {
+				return err
+			}
+			found = true
+
+			path, err := s.vaultPath(podName(pod), pod.Namespace, ph)
+			if err != nil {
+				return err
+			}
+			p.patch = append(p.patch, patchOperation{
+				Op:    "replace",
+				Path:  fmt.Sprintf("/spec/containers/%d/env/%d/value", i, j),
+				Value: fmt.Sprintf("%s%s#%s", placeholderPrefix, path, ph.Key),
+			})
+		}
+		if !found {
+			continue
+		}
+
+		command, err := containerCommand(pod, c)
+		if err != nil {
+			return err
+		}
+
+		// Exec wrapper is installed once for all containers
+		if !installed {
+			err = s.checkInjectConfig()
+			if err != nil {
+				return err
+			}
+
+			p.addVolume(corev1.Volume{
+				Name:         execVolume,
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			})
+			p.addInitContainer(corev1.Container{
+				Name:         execContainer,
+				Image:        s.InjectImage,
+				Args:         []string{"install", execDir},
+				VolumeMounts: []corev1.VolumeMount{{Name: execVolume, MountPath: execDir}},
+			})
+			installed = true
+		}
+
+		role, err := s.podRole(pod)
+		if err != nil {
+			return err
+		}
+
+		// Container args are appended to the command by the kubelet and
+		// passed to the original command unchanged
+		wrapped := []string{execBinary, "exec", "--vault-addr", s.InjectVaultAddr, "--vault-auth-mount", s.InjectAuthMount, "--vault-role", role, "--"}
+		wrapped = append(wrapped, command...)
+		p.patch = append(p.patch, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/command", i), Value: wrapped})
+		p.addVolumeMount(i, corev1.VolumeMount{Name: execVolume, MountPath: execDir, ReadOnly: true})
+	}
+
+	return nil
+}
+
+// containerCommand returns the command of a container, from its spec or
+// from the command annotation as the image entrypoint can't be known
+func containerCommand(pod corev1.Pod, c corev1.Container) ([]string, error) {
+	if len(c.Command) > 0 {
+		return c.Command, nil
+	}
+
+	annotation := AnnotationCommandPrefix + c.Name
+	raw, ok := pod.Annotations[annotation]
+	if !ok {
+		return nil, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "container '%s' has vault references in env but no command, set its command or the '%s' annotation", c.Name, annotation)
+	}
+
+	var command []string
+	err := json.Unmarshal([]byte(raw), &command)
+	if err != nil || len(command) == 0 {
+		return nil, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "annotation '%s' must be a non empty JSON array of strings", annotation)
+	}
+
+	return command, nil
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestServer_podPatchEnv(t *testing.T) {
+
+	s := injectServer()
+
+	pod := injectPod(map[string]string{AnnotationCommandPrefix + "sidecar": `["/sidecar","--verbose"]`})
+	pod.Spec.Containers = []corev1.Container{
+		{
+			Name:    "app",
+			Command: []string{"/app"},
+			Env: []corev1.EnvVar{
+				{Name: "LOG_LEVEL", Value: "info"},
+				{Name: "DB_PASSWORD", Value: "vault:db#password"},
+			},
+		},
+		{
+			Name: "sidecar",
+			Env:  []corev1.EnvVar{{Name: "TOKEN", Value: "vault:api#token"}},
+		},
+		{
+			Name: "plain",
+			Env:  []corev1.EnvVar{{Name: "FROM_SECRET", ValueFrom: &corev1.EnvVarSource{}}},
+		},
+	}
+
+	patch, err := s.podPatch(pod)
+	require.Nil(t, err)
+
+	wrapper := []string{execBinary, "exec", "--vault-addr", "https://vault:8200", "--vault-auth-mount", "kubernetes", "--vault-role", "default", "--"}
+	mount := corev1.VolumeMount{Name: execVolume, MountPath: execDir, ReadOnly: true}
+	require.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/0/env/1/value", Value: "vault:secret/data/test-namespace/db#password"},
+		{Op: "add", Path: "/spec/volumes", Value: []corev1.Volume{{Name: execVolume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}},
+		{Op: "add", Path: "/spec/initContainers", Value: []corev1.Container{{
+			Name:         execContainer,
+			Image:        "ouestfrance/k8s-vault-webhook:test",
+			Args:         []string{"install", execDir},
+			VolumeMounts: []corev1.VolumeMount{{Name: execVolume, MountPath: execDir}},
+		}}},
+		{Op: "add", Path: "/spec/containers/0/command", Value: append(append([]string{}, wrapper...), "/app")},
+		{Op: "add", Path: "/spec/containers/0/volumeMounts", Value: []corev1.VolumeMount{mount}},
+		{Op: "replace", Path: "/spec/containers/1/env/0/value", Value: "vault:secret/data/test-namespace/api#token"},
+		{Op: "add", Path: "/spec/containers/1/command", Value: append(append([]string{}, wrapper...), "/sidecar", "--verbose")},
+		{Op: "add", Path: "/spec/containers/1/volumeMounts", Value: []corev1.VolumeMount{mount}},
+	}, patch, "Test env references injected through exec wrapper")
+
+	// Already injected pods are unchanged
+	pod.Spec.InitContainers = []corev1.Container{{Name: execContainer}}
+	patch, err = s.podPatch(pod)
+	require.Nil(t, err)
+	require.Empty(t, patch, "Test pod injected once")
+}
+
+func TestServer_podPatchEnvWithFiles(t *testing.T) {
+
+	s := injectServer()
+
+	// File and env injection share pod arrays created by the first patch
+	pod := injectPod(map[string]string{AnnotationInject: "true", AnnotationSecretPrefix + "db": "vault:db#password"})
+	pod.Spec.Containers[0].Command = []string{"/app"}
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "TOKEN", Value: "vault:api#token"}}
+
+	patch, err := s.podPatch(pod)
+	require.Nil(t, err)
+
+	paths := []string{}
+	for _, op := range patch {
+		paths = append(paths, op.Path)
+	}
+	require.Equal(t, []string{
+		"/spec/volumes",
+		"/spec/initContainers",
+		"/spec/containers/0/volumeMounts",
+		"/spec/containers/0/env/0/value",
+		"/spec/volumes/-",
+		"/spec/initContainers/0",
+		"/spec/containers/0/command",
+		"/spec/containers/0/volumeMounts/-",
+	}, paths, "Test arrays created once")
+}
+
+func TestServer_podPatchEnvErrors(t *testing.T) {
+
+	var envTests = []struct {
+		description string
+		annotations map[string]string
+		env         string
+	}{
+		{"Test container without command is denied", nil, "vault:db#password"},
+		{"Test invalid command annotation is denied", map[string]string{AnnotationCommandPrefix + "app": "/app"}, "vault:db#password"},
+		{"Test invalid reference is denied", map[string]string{AnnotationCommandPrefix + "app": `["/app"]`}, "vault:db"},
+	}
+
+	s := injectServer()
+	for _, test := range envTests {
+		pod := injectPod(test.annotations)
+		pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "DB_PASSWORD", Value: test.env}}
+
+		_, err := s.podPatch(pod)
+		require.True(t, errors.As(err, &admissionError{}), test.description)
+	}
+}
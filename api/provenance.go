@@ -0,0 +1,180 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// annotationPrefix is the prefix of annotations set by the webhook
+	annotationPrefix = "k8s-vault-webhook.ouest-france.fr/"
+
+	// AnnotationProvenance records where each mutated data key comes from
+	AnnotationProvenance = annotationPrefix + "provenance"
+
+	// AnnotationContentHash records a hash of the secret data after mutation
+	AnnotationContentHash = annotationPrefix + "content-hash"
+)
+
+// timeNow returns the current time, replaced in tests
+var timeNow = time.Now
+
+// Provenance describes where a mutated data key value comes from,
+// it must never contain secret values
+type Provenance struct {
+	Placeholder string    `json:"placeholder"`
+	Scheme      string    `json:"scheme,omitempty"`
+	Endpoint    string    `json:"endpoint,omitempty"`
+	Path        string    `json:"path"`
+	Key         string    `json:"key"`
+	Version     int       `json:"version,omitempty"`
+	ResolvedAt  time.Time `json:"resolvedAt"`
+
+	// Sources are the Vault references of values built from several
+	// references, such as typed secrets, by field
+	Sources map[string]string `json:"sources,omitempty"`
+}
+
+// VaultVersionReader interface is implemented by Vault clients able to
+// return the KV version a secret was read at
+type VaultVersionReader interface {
+	ReadVersion(path, key string) (string, int, error)
+}
+
+// provenance returns the provenance of a value resolved from a placeholder
+// at a path and version
+func (ph placeholder) provenance(value, path string, version int) Provenance {
+	return Provenance{
+		Placeholder: value,
+		Scheme:      ph.Scheme,
+		Endpoint:    ph.Endpoint,
+		Path:        path,
+		Key:         ph.Key,
+		Version:     version,
+		ResolvedAt:  timeNow().UTC().Truncate(time.Second),
+	}
+}
+
+// ParseProvenance returns the provenance recorded on a secret by
+// annotation, nil if the secret has no provenance annotation
+func ParseProvenance(secret corev1.Secret) (map[string]Provenance, error) {
+	raw, ok := secret.Annotations[AnnotationProvenance]
+	if !ok {
+		return nil, nil
+	}
+
+	provenance := map[string]Provenance{}
+	err := json.Unmarshal([]byte(raw), &provenance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse provenance annotation: %s", err)
+	}
+
+	return provenance, nil
+}
+
+// PlaceholderRef returns the Vault path and key a vault placeholder recorded
+// in provenance resolves to for a secret through a vault pattern, so that
+// recorded paths can be checked before being read again
+func PlaceholderRef(pattern string, secret corev1.Secret, value string) (string, string, error) {
+
+	// Endpoint prefix doesn't change the path
+	if strings.HasPrefix(value, endpointPrefix) {
+		i := strings.Index(value, ":")
+		if i < 0 {
+			return "", "", fmt.Errorf("vault placeholder '%s' doesn't match 'vault@endpoint:path#key'", value)
+		}
+		value = placeholderPrefix + value[i+1:]
+	}
+
+	ph, ok, err := parsePlaceholder(value)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		return "", "", fmt.Errorf("'%s' is not a vault placeholder", value)
+	}
+
+	path, err := VaultPath(pattern, secret.Name, secret.Namespace, ph.Path)
+	return path, ph.Key, err
+}
+
+// ContentHash returns a hash of secret data, stable across key ordering
+func ContentHash(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		// Length prefixes avoid collisions between key/value boundaries
+		fmt.Fprintf(h, "%d:%s%d:", len(key), key, len(data[key]))
+		h.Write(data[key])
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// provenancePatch returns patch operations setting provenance and content
+// hash annotations, or removing them if no data key has a provenance
+func provenancePatch(secret corev1.Secret, provenance map[string]Provenance, resolved map[string][]byte) ([]patchOperation, error) {
+
+	// Remove stale annotations of previously mutated secrets
+	if len(provenance) == 0 {
+		patch := []patchOperation{}
+		for _, annotation := range []string{AnnotationProvenance, AnnotationContentHash} {
+			if _, ok := secret.Annotations[annotation]; ok {
+				patch = append(patch, patchOperation{Op: "remove", Path: "/metadata/annotations/" + escapeJSONPointer(annotation)})
+			}
+		}
+		return patch, nil
+	}
+
+	provenanceJSON, err := json.Marshal(provenance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal provenance annotation: %s", err)
+	}
+
+	// Hash data as stored after mutation
+	data := map[string][]byte{}
+	for key, value := range secret.Data {
+		data[key] = value
+	}
+	for key, value := range resolved {
+		data[key] = value
+	}
+
+	annotations := map[string]string{
+		AnnotationProvenance:  string(provenanceJSON),
+		AnnotationContentHash: ContentHash(data),
+	}
+
+	// Annotations map must be created if secret has none
+	if secret.Annotations == nil {
+		return []patchOperation{{Op: "add", Path: "/metadata/annotations", Value: annotations}}, nil
+	}
+
+	patch := []patchOperation{}
+	for _, annotation := range []string{AnnotationProvenance, AnnotationContentHash} {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations/" + escapeJSONPointer(annotation),
+			Value: annotations[annotation],
+		})
+	}
+
+	return patch, nil
+}
+
+// escapeJSONPointer escapes a JSON pointer reference token
+func escapeJSONPointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
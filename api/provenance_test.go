@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Fake Vault client returning KV versions for testing
+type fakeVersionVaultClient struct {
+	Values map[string]string
+}
+
+func (f fakeVersionVaultClient) Read(path, key string) (string, error) {
+	value, _, err := f.ReadVersion(path, key)
+	return value, err
+}
+
+func (f fakeVersionVaultClient) ReadVersion(path, key string) (string, int, error) {
+	return f.Values[path+"#"+key], 3, nil
+}
+
+func TestServer_mutateSecretDataProvenance(t *testing.T) {
+
+	now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	s := Server{
+		Vault: fakeVersionVaultClient{Values: map[string]string{
+			"secret/data/test-namespace/db#password": "s3cr3t-password",
+			"secret/data/test-namespace/db#user":     "s3cr3t-user",
+		}},
+		VaultPattern: "secret/data/{{.Namespace}}/{{.Secret}}",
+		Provenance:   true,
+		Logger:       logrus.New(),
+	}
+
+	secret := corev1.Secret{Data: map[string][]byte{
+		"password": []byte("vault:db#password"),
+		"user":     []byte("vault:db#user"),
+		"plain":    []byte("plain-value"),
+	}}
+	secret.Name = "test-secret"
+	secret.Namespace = "test-namespace"
+
+	// Annotations map is created on secrets without annotations
+	result, err := s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Len(t, result.Patch, 3, "Test data and annotations patches")
+
+	annotationsPatch := result.Patch[2]
+	require.Equal(t, "add", annotationsPatch.Op, "Test annotations map added")
+	require.Equal(t, "/metadata/annotations", annotationsPatch.Path, "Test annotations map added")
+	annotations := annotationsPatch.Value.(map[string]string)
+
+	expectedProvenance := map[string]Provenance{
+		"password": {Placeholder: "vault:db#password", Path: "secret/data/test-namespace/db", Key: "password", Version: 3, ResolvedAt: now},
+		"user":     {Placeholder: "vault:db#user", Path: "secret/data/test-namespace/db", Key: "user", Version: 3, ResolvedAt: now},
+	}
+	var provenance map[string]Provenance
+	require.Nil(t, json.Unmarshal([]byte(annotations[AnnotationProvenance]), &provenance))
+	require.Equal(t, expectedProvenance, provenance, "Test provenance annotation")
+
+	expectedHash := ContentHash(map[string][]byte{
+		"password": []byte("s3cr3t-password"),
+		"user":     []byte("s3cr3t-user"),
+		"plain":    []byte("plain-value"),
+	})
+	require.Equal(t, expectedHash, annotations[AnnotationContentHash], "Test content hash annotation")
+
+	// Annotation values never contain secret material
+	for _, value := range annotations {
+		require.NotContains(t, value, "s3cr3t", "Test annotations without secret values")
+	}
+
+	// Annotations are added one by one on secrets with annotations
+	secret.Annotations = map[string]string{"team": "web"}
+	result, err = s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Len(t, result.Patch, 4, "Test data and annotations patches")
+	require.Equal(t, "/metadata/annotations/k8s-vault-webhook.ouest-france.fr~1provenance", result.Patch[2].Path, "Test escaped provenance annotation path")
+	require.Equal(t, "/metadata/annotations/k8s-vault-webhook.ouest-france.fr~1content-hash", result.Patch[3].Path, "Test escaped content hash annotation path")
+	require.Equal(t, expectedHash, result.Patch[3].Value, "Test content hash annotation")
+
+	// Stale annotations are removed when no value is mutated anymore
+	secret.Data = map[string][]byte{"plain": []byte("plain-value")}
+	secret.Annotations = annotations
+	result, err = s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []patchOperation{
+		{Op: "remove", Path: "/metadata/annotations/k8s-vault-webhook.ouest-france.fr~1provenance"},
+		{Op: "remove", Path: "/metadata/annotations/k8s-vault-webhook.ouest-france.fr~1content-hash"},
+	}, result.Patch, "Test stale annotations removed")
+
+	// Forged annotations with a matching content hash are removed too
+	forged, err := json.Marshal(map[string]Provenance{"plain": {Placeholder: "vault:db#password"}})
+	require.Nil(t, err)
+	forgedSecret := secret
+	forgedSecret.Annotations = map[string]string{
+		AnnotationProvenance:  string(forged),
+		AnnotationContentHash: ContentHash(secret.Data),
+	}
+	result, err = s.mutateSecretData(forgedSecret, mutateOptions{})
+	require.Nil(t, err)
+	require.Len(t, result.Patch, 2, "Test forged annotations removed")
+	result, err = s.mutateSecretData(forgedSecret, mutateOptions{DryRun: true})
+	require.Nil(t, err)
+	require.Len(t, result.Patch, 2, "Test forged annotations removed on dry-run")
+
+	// Provenance can be parsed back from annotations
+	parsed, err := ParseProvenance(corev1.Secret{ObjectMeta: secret.ObjectMeta})
+	require.Nil(t, err)
+	require.Equal(t, expectedProvenance, parsed, "Test provenance parsed from annotation")
+}
+
+func TestContentHash(t *testing.T) {
+
+	a := ContentHash(map[string][]byte{"a": []byte("1"), "b": []byte("2")})
+	b := ContentHash(map[string][]byte{"b": []byte("2"), "a": []byte("1")})
+	require.Equal(t, a, b, "Test hash doesn't depend on key order")
+
+	c := ContentHash(map[string][]byte{"a": []byte("12"), "b": []byte("")})
+	require.NotEqual(t, a, c, "Test hash depends on key/value boundaries")
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Placeholder schemes of built-in backends
+const (
+	SchemeVault        = "vault"
+	SchemeVaultTransit = "vault-transit"
+	SchemeFile         = "file"
+	SchemeAWSSM        = "awssm"
+	SchemeAWSSSM       = "ssm"
+)
+
+var resolverReads = promauto.NewCounterVec(prometheus.CounterOpts{Name: "webhook_resolver_reads", Help: "The total number of values read by resolvers by scheme and result"}, []string{"scheme", "result"})
+
+// Resolver interface is implemented by secret backends resolving the
+// placeholders of a scheme, "scheme:path#key", to secret values. Resolvers
+// may implement VaultVersionReader, VaultPathChecker and VaultGenerator to
+// record versions, check paths on dry-run requests and generate values.
+type Resolver interface {
+	Read(path, key string) (string, error)
+}
+
+// PathPatternResolver interface is implemented by resolvers whose
+// placeholder paths are templated with their own pattern instead of the
+// vault pattern, paths are used as is if the pattern is empty
+type PathPatternResolver interface {
+	PathPattern() string
+}
+
+// KeylessResolver interface is implemented by resolvers whose placeholders,
+// "scheme:path", reference a single value without key
+type KeylessResolver interface {
+	Keyless() bool
+}
+
+// resolver returns the resolver of a placeholder scheme, the Vault client
+// resolves the vault scheme unless another resolver is registered
+func (s *Server) resolver(scheme string) (Resolver, bool) {
+	if scheme == "" {
+		scheme = SchemeVault
+	}
+	if r, ok := s.Resolvers[scheme]; ok {
+		return r, true
+	}
+	if scheme == SchemeVault && s.Vault != nil {
+		return s.Vault, true
+	}
+
+	return nil, false
+}
+
+// schemes returns the registered placeholder schemes other than vault,
+// longest first so that a scheme prefixing another one never shadows it
+func (s *Server) schemes() []string {
+	schemes := []string{}
+	for scheme := range s.Resolvers {
+		if scheme != SchemeVault {
+			schemes = append(schemes, scheme)
+		}
+	}
+	sort.Slice(schemes, func(i, j int) bool {
+		if len(schemes[i]) != len(schemes[j]) {
+			return len(schemes[i]) > len(schemes[j])
+		}
+		return schemes[i] < schemes[j]
+	})
+
+	return schemes
+}
+
+// parseSchemePlaceholder extracts the scheme, path and key of a placeholder
+// of a registered scheme or of the vault scheme from a secret value, ok is
+// false if the value doesn't have such a prefix and must be left unchanged
+func (s *Server) parseSchemePlaceholder(value string) (placeholder, bool, error) {
+	for _, scheme := range s.schemes() {
+		prefix := scheme + ":"
+		if !strings.HasPrefix(value, prefix) {
+			continue
+		}
+		if kr, ok := s.Resolvers[scheme].(KeylessResolver); ok && kr.Keyless() {
+			if strings.Contains(value, "#") {
+				return placeholder{}, true, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "%s placeholder '%s' doesn't match '%spath'", scheme, value, prefix)
+			}
+			return placeholder{Scheme: scheme, Path: value[len(prefix):], Keyless: true}, true, nil
+		}
+		i := strings.LastIndex(value, "#")
+		if i < len(prefix) {
+			return placeholder{}, true, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "%s placeholder '%s' doesn't match '%spath#key'", scheme, value, prefix)
+		}
+		return placeholder{Scheme: scheme, Path: value[len(prefix):i], Key: value[i+1:]}, true, nil
+	}
+
+	// Vault placeholders may name their endpoint
+	if strings.HasPrefix(value, endpointPrefix) {
+		return s.parseEndpointPlaceholder(value)
+	}
+
+	return parsePlaceholder(value)
+}
+
+// ref returns the reference of a resolved placeholder recorded in audit
+// annotations and provenance, prefixed by its scheme except for Vault
+func (ph placeholder) ref(path string) string {
+	if ph.Endpoint != "" {
+		return fmt.Sprintf("%s%s:%s#%s", endpointPrefix, ph.Endpoint, path, ph.Key)
+	}
+	if ph.Scheme == "" || ph.Scheme == SchemeVault {
+		return fmt.Sprintf("%s#%s", path, ph.Key)
+	}
+	if ph.Keyless {
+		return fmt.Sprintf("%s:%s", ph.Scheme, path)
+	}
+
+	return fmt.Sprintf("%s:%s#%s", ph.Scheme, path, ph.Key)
+}
+
+// placeholderResolver returns the resolver of a placeholder, the client of
+// its endpoint for vault placeholders
+func (s *Server) placeholderResolver(ph placeholder) (Resolver, bool) {
+	if ph.Endpoint != "" {
+		return s.vaultEndpoint(ph.Endpoint)
+	}
+
+	return s.resolver(ph.Scheme)
+}
+
+// resolve reads a placeholder value with its resolver, with its version if
+// the resolver supports it, version is 0 otherwise
+func (s *Server) resolve(ph placeholder, path string) (string, int, error) {
+	scheme := ph.Scheme
+	if scheme == "" {
+		scheme = SchemeVault
+	}
+	r, ok := s.placeholderResolver(ph)
+	if !ok && ph.Endpoint != "" {
+		return "", 0, fmt.Errorf("no vault endpoint %q configured", ph.Endpoint)
+	}
+	if !ok {
+		return "", 0, fmt.Errorf("no resolver registered for scheme %q", scheme)
+	}
+
+	var value string
+	var version int
+	var err error
+	if vr, ok := r.(VaultVersionReader); ok {
+		value, version, err = vr.ReadVersion(path, ph.Key)
+	} else {
+		value, err = r.Read(path, ph.Key)
+	}
+
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	resolverReads.WithLabelValues(scheme, result).Inc()
+	if scheme == SchemeVault {
+		endpoint := ph.Endpoint
+		if endpoint == "" {
+			endpoint = DefaultVaultEndpoint
+		}
+		vaultEndpointReads.WithLabelValues(endpoint, result).Inc()
+	}
+
+	return value, version, err
+}
+
+// Resolve reads the value of a placeholder for a secret with the resolvers,
+// Vault endpoints and routes used to mutate secrets, and returns it with its
+// provenance. Invalid or forbidden placeholders return errors for which
+// IsDenied is true. Fallback values of missing secrets are never returned.
+func (s *Server) Resolve(secret corev1.Secret, value string) (string, Provenance, error) {
+	ph, ok, err := s.parseSchemePlaceholder(value)
+	if !ok {
+		return "", Provenance{}, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "reference doesn't have a placeholder prefix")
+	}
+	if err != nil {
+		return "", Provenance{}, err
+	}
+	err = checkNoGenerate(ph, "reference")
+	if err != nil {
+		return "", Provenance{}, err
+	}
+
+	ph = s.route(secret, ph)
+	err = s.checkEndpointNamespace(secret, ph)
+	if err != nil {
+		return "", Provenance{}, err
+	}
+	path, err := s.vaultPath(secret.Name, secret.Namespace, ph)
+	if err != nil {
+		return "", Provenance{}, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "%s", err)
+	}
+
+	// Fallback values of missing secrets are returned with an error
+	resolved, version, err := s.resolve(ph, path)
+	if err != nil {
+		return "", Provenance{}, fmt.Errorf("failed to read key %q of secret %q: %s", ph.Key, path, err)
+	}
+
+	return resolved, ph.provenance(value, path, version), nil
+}
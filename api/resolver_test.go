@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Fake resolver returning values keyed by path#key for testing
+type fakeResolver struct {
+	Values map[string]string
+}
+
+func (f fakeResolver) Read(path, key string) (string, error) {
+	value, ok := f.Values[path+"#"+key]
+	if !ok {
+		return "", errors.New("value not found")
+	}
+	return value, nil
+}
+
+// Fake resolver with a path pattern for testing
+type fakePatternResolver struct {
+	fakeResolver
+	Pattern string
+}
+
+func (f fakePatternResolver) PathPattern() string { return f.Pattern }
+
+// Fake keyless resolver with a path pattern for testing
+type fakeKeylessResolver struct {
+	fakePatternResolver
+}
+
+func (f fakeKeylessResolver) Keyless() bool { return true }
+
+func TestServer_parseSchemePlaceholder(t *testing.T) {
+
+	s := Server{Resolvers: map[string]Resolver{
+		"file":          fakeResolver{},
+		"vault-transit": fakePatternResolver{},
+		"ssm":           fakeKeylessResolver{},
+	}}
+
+	var parseTests = []struct {
+		description string
+		value       string
+		placeholder placeholder
+		ok          bool
+		errorString string
+	}{
+		{"Test vault placeholder", "vault:db#password", placeholder{Path: "db", Key: "password"}, true, ""},
+		{"Test registered scheme", "file:db#password", placeholder{Scheme: "file", Path: "db", Key: "password"}, true, ""},
+		{"Test key split on last hash", "vault-transit:app#vault:v1:abc", placeholder{Scheme: "vault-transit", Path: "app", Key: "vault:v1:abc"}, true, ""},
+		{"Test unregistered scheme", "awssm:db#password", placeholder{}, false, ""},
+		{"Test plaintext", "password", placeholder{}, false, ""},
+		{"Test missing key", "file:db", placeholder{}, true, "file placeholder 'file:db' doesn't match 'file:path#key'"},
+		{"Test keyless scheme", "ssm:/app/db", placeholder{Scheme: "ssm", Path: "/app/db", Keyless: true}, true, ""},
+		{"Test keyless scheme with key", "ssm:/app/db#password", placeholder{}, true, "ssm placeholder 'ssm:/app/db#password' doesn't match 'ssm:path'"},
+	}
+
+	for _, test := range parseTests {
+		ph, ok, err := s.parseSchemePlaceholder(test.value)
+		require.Equal(t, test.ok, ok, test.description)
+		if test.errorString != "" {
+			require.EqualError(t, err, test.errorString, test.description)
+			continue
+		}
+		require.Nil(t, err, test.description)
+		require.Equal(t, test.placeholder, ph, test.description)
+	}
+}
+
+func TestServer_mutateSecretDataResolvers(t *testing.T) {
+
+	secret := corev1.Secret{Data: map[string][]byte{
+		"password": []byte("vault:db#password"),
+		"token":    []byte("file:app#token"),
+		"key":      []byte("vault-transit:app#vault:v1:abc"),
+		"param":    []byte("ssm:/app/param"),
+		"other":    []byte("awssm:app#token"),
+	}}
+	secret.Name = "test-secret"
+	secret.Namespace = "test-namespace"
+
+	s := Server{
+		Resolvers: map[string]Resolver{
+			"vault":         fakeResolver{Values: map[string]string{"secret/data/test-namespace/db#password": "s3cr3t"}},
+			"file":          fakeResolver{Values: map[string]string{"secret/data/test-namespace/app#token": "t0k3n"}},
+			"vault-transit": fakePatternResolver{fakeResolver{Values: map[string]string{"test-namespace-app#vault:v1:abc": "k3y"}}, "{{.Namespace}}-{{.Secret}}"},
+			"ssm":           fakeKeylessResolver{fakePatternResolver{fakeResolver{Values: map[string]string{"/test-namespace/app/param#": "p4r4m"}}, "/{{.Namespace}}{{.Secret}}"}},
+		},
+		VaultPattern: "secret/data/{{.Namespace}}/{{.Secret}}",
+		Provenance:   true,
+		Logger:       logrus.New(),
+	}
+
+	// Values are dispatched to the resolver of their scheme, resolver
+	// patterns replace the vault pattern and unregistered schemes are left
+	// unchanged
+	result, err := s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/key", Value: base64.StdEncoding.EncodeToString([]byte("k3y"))}, result.Patch[0], "Test transit resolver")
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/param", Value: base64.StdEncoding.EncodeToString([]byte("p4r4m"))}, result.Patch[1], "Test keyless resolver")
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/password", Value: base64.StdEncoding.EncodeToString([]byte("s3cr3t"))}, result.Patch[2], "Test vault resolver")
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/token", Value: base64.StdEncoding.EncodeToString([]byte("t0k3n"))}, result.Patch[3], "Test file resolver")
+	require.JSONEq(t, `{"key":"vault-transit:test-namespace-app#vault:v1:abc","param":"ssm:/test-namespace/app/param","password":"secret/data/test-namespace/db#password","token":"file:secret/data/test-namespace/app#token"}`, result.AuditAnnotations[auditAnnotationReads], "Test reads audit annotation")
+
+	var provenance map[string]Provenance
+	annotations := result.Patch[4].Value.(map[string]string)
+	require.Nil(t, json.Unmarshal([]byte(annotations[AnnotationProvenance]), &provenance))
+	require.Equal(t, "file", provenance["token"].Scheme, "Test provenance scheme")
+	require.Equal(t, "", provenance["password"].Scheme, "Test vault provenance has no scheme")
+
+	// Vault placeholders fail without vault resolver
+	delete(s.Resolvers, "vault")
+	_, err = s.mutateSecretData(secret, mutateOptions{})
+	var denial admissionError
+	require.True(t, errors.As(err, &denial), "Test vault scheme disabled")
+	require.Equal(t, int32(http.StatusServiceUnavailable), denial.code)
+	require.Contains(t, denial.message, `no resolver registered for scheme "vault"`)
+}
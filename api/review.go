@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// secretReview is an admission review of a secret decoded from a request
+type secretReview struct {
+	Review    admission.AdmissionReview
+	Secret    corev1.Secret
+	OldSecret *corev1.Secret
+	DryRun    bool
+}
+
+// readAdmissionReview decodes an admission review of a v1 object kind from
+// a request body. If ok is false, the request was invalid or not about this
+// kind and a response has already been written, counted as failed or ignored.
+func (s *Server) readAdmissionReview(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, kind string, failed, ignored prometheus.Counter) (ar admission.AdmissionReview, entry *logrus.Entry, ok bool) {
+
+	// Read request body
+	body, err := ioutil.ReadAll(r.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		logger.WithError(err).Error("request body too large")
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		failed.Inc()
+		return ar, logger, false
+	}
+	if err != nil {
+		logger.WithError(err).Error("failed to read request body")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		failed.Inc()
+		return ar, logger, false
+	}
+	defer r.Body.Close()
+
+	// Parse review request, v1beta1 reviews are converted to v1
+	ar, err = decodeAdmissionReview(body)
+	if err != nil {
+		logger.WithError(err).Error("failed to unmarshal request")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		failed.Inc()
+		return ar, logger, false
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"kubernetes_admissionreview_kind":       ar.Kind,
+		"kubernetes_admissionreview_apiversion": ar.APIVersion,
+	})
+
+	// Validate admission request type
+	if ar.Kind != "AdmissionReview" {
+
+		logger.Debug("not an admissionreview request, ignoring")
+		s.sendAdmissionReview(w, ar)
+		ignored.Inc()
+
+		return ar, logger, false
+	}
+
+	// Validate admission review version
+	if ar.APIVersion != admissionV1 && ar.APIVersion != admissionV1beta1 {
+		logger.Error("unsupported admissionreview version")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		failed.Inc()
+		return ar, logger, false
+	}
+
+	// Validate request is present
+	if ar.Request == nil {
+		logger.Error("admissionreview without request")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		failed.Inc()
+		return ar, logger, false
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"kubernetes_admissionreview_uid":                ar.Request.UID,
+		"kubernetes_admissionreview_request_kind":       ar.Request.Kind,
+		"kubernetes_admissionreview_request_apiversion": ar.Request.Kind.Version,
+	})
+
+	// Validate object type, other objects are allowed unchanged
+	if ar.Request.Kind.Kind != kind || ar.Request.Kind.Version != "v1" {
+
+		logger.Debugf("not a %s object, ignoring", strings.ToLower(kind))
+		ar.Response = &admission.AdmissionResponse{
+			UID:     ar.Request.UID,
+			Allowed: true,
+		}
+		s.sendAdmissionReview(w, ar)
+		ignored.Inc()
+
+		return ar, logger, false
+	}
+
+	return ar, logger, true
+}
+
+// readSecretReview decodes a secret admission review from a request body.
+// If ok is false, the request was invalid or not about a secret and a
+// response has already been written, counted as failed or ignored.
+func (s *Server) readSecretReview(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, failed, ignored prometheus.Counter) (review secretReview, entry *logrus.Entry, ok bool) {
+
+	review.Review, logger, ok = s.readAdmissionReview(w, r, logger, "Secret", failed, ignored)
+	if !ok {
+		return review, logger, false
+	}
+	request := review.Review.Request
+
+	// Parse secret object
+	err := json.Unmarshal(request.Object.Raw, &review.Secret)
+	if err != nil {
+		logger.WithError(err).Error("failed to unmarshal secret")
+		s.sendAdmissionReviewDenied(w, review.Review, admissionError{
+			code:    http.StatusBadRequest,
+			reason:  metav1.StatusReasonBadRequest,
+			message: fmt.Sprintf("failed to unmarshal secret: %s", err),
+		})
+		failed.Inc()
+		return review, logger, false
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"kubernetes_secret_name":      review.Secret.Name,
+		"kubernetes_secret_namespace": review.Secret.Namespace,
+	})
+
+	// Parse old secret object on update
+	if request.Operation == admission.Update && len(request.OldObject.Raw) > 0 {
+		var oldSecret corev1.Secret
+		err = json.Unmarshal(request.OldObject.Raw, &oldSecret)
+		if err != nil {
+			logger.WithError(err).Warn("failed to unmarshal old secret, ignoring it")
+		} else {
+			review.OldSecret = &oldSecret
+		}
+	}
+
+	review.DryRun = request.DryRun != nil && *request.DryRun
+
+	return review, logger, true
+}
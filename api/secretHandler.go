@@ -2,12 +2,10 @@ package api
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"errors"
 	"net/http"
 
-	"github.com/sirupsen/logrus"
 	admission "k8s.io/api/admission/v1"
-	corev1 "k8s.io/api/core/v1"
 )
 
 type patchOperation struct {
@@ -21,81 +19,37 @@ func (s *Server) secretHandler(w http.ResponseWriter, r *http.Request) {
 	logger := s.Logger.WithField("handler", "secret")
 	logger.Debug("request received, handling")
 
-	// Read request body
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		logger.WithError(err).Error("failed to read request body")
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		secretFailed.Inc()
+	review, logger, ok := s.readSecretReview(w, r, logger, secretFailed, secretIgnored)
+	if !ok {
 		return
 	}
-	defer r.Body.Close()
+	admissionReview := review.Review
 
-	// Parse review request
-	var admissionReview admission.AdmissionReview
-	err = json.Unmarshal(body, &admissionReview)
-	if err != nil {
-		logger.WithError(err).Error("failed to unmarshal request")
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		secretFailed.Inc()
-		return
+	opts := mutateOptions{
+		OldSecret: review.OldSecret,
+		DryRun:    review.DryRun,
+		Resync:    s.ResyncUsername != "" && admissionReview.Request.UserInfo.Username == s.ResyncUsername,
 	}
 
-	logger = logger.WithFields(logrus.Fields{
-		"kubernetes_admissionreview_kind":       admissionReview.Kind,
-		"kubernetes_admissionreview_apiversion": admissionReview.APIVersion,
-	})
-
-	// Validate admission request type
-	if admissionReview.Kind != "AdmissionReview" || admissionReview.APIVersion != "admission.k8s.io/v1" {
-
-		logger.Debug("not an admissionreview request, ignoring")
-		s.sendAdmissionReview(w, admissionReview)
-		secretIgnored.Inc()
-
-		return
-	}
-
-	logger = logger.WithFields(logrus.Fields{
-		"kubernetes_admissionreview_request_kind":       admissionReview.Request.Kind,
-		"kubernetes_admissionreview_request_apiversion": admissionReview.Request.Kind.Version,
-	})
-
-	// Validate object type
-	if admissionReview.Request.Kind.Kind != "Secret" || admissionReview.Request.Kind.Version != "v1" {
-
-		logger.Debug("not a secret object, ignoring")
-		s.sendAdmissionReview(w, admissionReview)
-		secretIgnored.Inc()
-
-		return
-	}
-
-	// Parse secret object
-	var secret corev1.Secret
-	err = json.Unmarshal(admissionReview.Request.Object.Raw, &secret)
-	if err != nil {
-		logger.WithError(err).Error("failed to unmarshal secret")
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	// Unresolvable placeholders deny the request, internal errors
+	// are reported as webhook failures
+	result, err := s.mutateSecretData(review.Secret, opts)
+	var denial admissionError
+	if errors.As(err, &denial) {
+		logger.WithError(err).Warn("secret denied")
+		s.sendAdmissionReviewDenied(w, admissionReview, denial, result.Warnings...)
 		secretFailed.Inc()
 		return
 	}
-
-	logger = logger.WithFields(logrus.Fields{
-		"kubernetes_secret_name":      secret.Name,
-		"kubernetes_secret_namespace": secret.Namespace,
-	})
-
-	// List of patchs on secret
-	patch, err := s.mutateSecretData(secret)
 	if err != nil {
-		s.sendAdmissionReviewError(w, err)
+		logger.WithError(err).Error("failed to mutate secret")
+		s.sendAdmissionReviewError(w, admissionReview, err)
 		secretFailed.Inc()
 		return
 	}
 
 	// Marshal patches
-	patchBytes, err := json.Marshal(patch)
+	patchBytes, err := json.Marshal(result.Patch)
 	if err != nil {
 		logger.WithError(err).Error("failed to marshal patches")
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -112,6 +66,8 @@ func (s *Server) secretHandler(w http.ResponseWriter, r *http.Request) {
 			pt := admission.PatchTypeJSONPatch
 			return &pt
 		}(),
+		Warnings:         result.Warnings,
+		AuditAnnotations: result.AuditAnnotations,
 	}
 
 	// Send admission review back to kubernetes
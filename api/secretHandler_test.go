@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	admission "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// admissionReviewJSON returns a v1 AdmissionReview request for an object
+func admissionReviewJSON(kind, object string) string {
+	return `{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","request":{"uid":"705ab4f5-6393-11e8-b7cc-42010a800002","kind":{"group":"","version":"v1","kind":"` + kind + `"},"resource":{"group":"","version":"v1","resource":"secrets"},"namespace":"test-namespace","operation":"CREATE","userInfo":{"username":"admin"},"object":` + object + `}}`
+}
+
+func TestServer_secretHandler(t *testing.T) {
+
+	validSecret := `{"apiVersion":"v1","kind":"Secret","metadata":{"name":"test-secret","namespace":"test-namespace"},"data":{"foo":"dmF1bHQ6Zm9vI2Jhcg=="},"type":"Opaque"}`
+	invalidSecret := `{"apiVersion":"v1","kind":"Secret","metadata":{"name":"test-secret","namespace":"test-namespace"},"data":{"foo":"dmF1bHQ6YmFy"},"type":"Opaque"}`
+
+	var handlerTests = []struct {
+		description  string
+		vaultClient  VaultClient
+		vaultPattern string
+		body         string
+		httpCode     int
+		allowed      bool
+		statusCode   int32
+		statusReason metav1.StatusReason
+		patch        string
+	}{
+		{
+			"Test valid secret is mutated",
+			fakeVaultClient{Value: "bar"},
+			"secret/data/{{.Secret}}",
+			admissionReviewJSON("Secret", validSecret),
+			http.StatusOK,
+			true,
+			0,
+			"",
+			`[{"op":"replace","path":"/data/foo","value":"YmFy"}]`,
+		},
+		{
+			"Test invalid placeholder is denied",
+			fakeVaultClient{Value: "bar"},
+			"secret/data/{{.Secret}}",
+			admissionReviewJSON("Secret", invalidSecret),
+			http.StatusOK,
+			false,
+			http.StatusUnprocessableEntity,
+			metav1.StatusReasonInvalid,
+			"",
+		},
+		{
+			"Test vault read error is denied",
+			fakeVaultClient{Value: "error"},
+			"secret/data/{{.Secret}}",
+			admissionReviewJSON("Secret", validSecret),
+			http.StatusOK,
+			false,
+			http.StatusServiceUnavailable,
+			metav1.StatusReasonServiceUnavailable,
+			"",
+		},
+		{
+			"Test invalid vault pattern is an internal error",
+			fakeVaultClient{Value: "bar"},
+			"secret/data/{{.Secret}}/{{.InvalidKey}}",
+			admissionReviewJSON("Secret", validSecret),
+			http.StatusInternalServerError,
+			false,
+			http.StatusInternalServerError,
+			metav1.StatusReasonInternalError,
+			"",
+		},
+		{
+			"Test undecodable secret is denied",
+			fakeVaultClient{Value: "bar"},
+			"secret/data/{{.Secret}}",
+			admissionReviewJSON("Secret", `{"data":"invalid"}`),
+			http.StatusOK,
+			false,
+			http.StatusBadRequest,
+			metav1.StatusReasonBadRequest,
+			"",
+		},
+		{
+			"Test other kind is allowed",
+			fakeVaultClient{Value: "bar"},
+			"secret/data/{{.Secret}}",
+			admissionReviewJSON("ConfigMap", `{"apiVersion":"v1","kind":"ConfigMap"}`),
+			http.StatusOK,
+			true,
+			0,
+			"",
+			"",
+		},
+	}
+
+	for _, test := range handlerTests {
+
+		s := Server{
+			Vault:        test.vaultClient,
+			VaultPattern: test.vaultPattern,
+			Logger:       logrus.New(),
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/secret", strings.NewReader(test.body))
+		rec := httptest.NewRecorder()
+		s.Router().ServeHTTP(rec, req)
+
+		require.Equal(t, test.httpCode, rec.Code, test.description)
+
+		var review admission.AdmissionReview
+		err := json.Unmarshal(rec.Body.Bytes(), &review)
+		require.Nil(t, err, test.description)
+		require.NotNil(t, review.Response, test.description)
+		require.Equal(t, "705ab4f5-6393-11e8-b7cc-42010a800002", string(review.Response.UID), test.description)
+		require.Equal(t, test.allowed, review.Response.Allowed, test.description)
+
+		if test.statusCode != 0 {
+			require.NotNil(t, review.Response.Result, test.description)
+			require.Equal(t, test.statusCode, review.Response.Result.Code, test.description)
+			require.Equal(t, test.statusReason, review.Response.Result.Reason, test.description)
+		}
+		if test.patch != "" {
+			require.JSONEq(t, test.patch, string(review.Response.Patch), test.description)
+			require.Contains(t, review.Response.AuditAnnotations, auditAnnotationReads, test.description)
+		}
+	}
+}
+
+func TestServer_secretHandlerInvalidRequests(t *testing.T) {
+
+	s := Server{
+		Vault:          fakeVaultClient{Value: "bar"},
+		VaultPattern:   "secret/data/{{.Secret}}",
+		Logger:         logrus.New(),
+		MaxRequestBody: 1024,
+	}
+
+	var requestTests = []struct {
+		description string
+		body        string
+		httpCode    int
+	}{
+		{"Test unparsable body", `not json`, http.StatusInternalServerError},
+		{"Test admission review without request", `{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1"}`, http.StatusBadRequest},
+		{"Test body too large", admissionReviewJSON("Secret", `{"data":{"foo":"`+strings.Repeat("a", 2048)+`"}}`), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range requestTests {
+		req := httptest.NewRequest(http.MethodPost, "/secret", strings.NewReader(test.body))
+		rec := httptest.NewRecorder()
+		s.Router().ServeHTTP(rec, req)
+
+		require.Equal(t, test.httpCode, rec.Code, test.description)
+	}
+}
@@ -1,16 +1,17 @@
 package api
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
+	"k8s.io/client-go/kubernetes"
 )
 
 var (
@@ -18,17 +19,72 @@ var (
 	secretMutated   = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_secret_mutated", Help: "The total number of secrets successfuly mutated"})
 	secretIgnored   = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_secret_ignored", Help: "The total number of mutating requests ignored"})
 	secretFailed    = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_secret_failed", Help: "The total number of mutating requests failed"})
+	secretReused    = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_secret_reused", Help: "The total number of secret values reused from previous admission on update"})
+	secretDryRun    = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_secret_dry_run", Help: "The total number of secret values validated on dry-run requests"})
+	secretGenerated = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_secret_generated", Help: "The total number of secret values generated and stored in Vault"})
+
+	secretValidated   = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_secret_validated", Help: "The total number of secrets successfuly validated"})
+	secretRejected    = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_secret_rejected", Help: "The total number of secrets rejected by validation"})
+	validationIgnored = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_validation_ignored", Help: "The total number of validating requests ignored"})
+	validationFailed  = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_validation_failed", Help: "The total number of validating requests failed"})
+
+	podMutated = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_pod_mutated", Help: "The total number of pods successfuly injected"})
+	podIgnored = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_pod_ignored", Help: "The total number of pod requests ignored"})
+	podFailed  = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_pod_failed", Help: "The total number of pod requests failed"})
+
+	certificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{Name: "webhook_certificate_expiry_timestamp_seconds", Help: "The expiry date of the served certificate as a unix timestamp"})
 )
 
 // Server represent vault webhook server
 type Server struct {
-	Listen       string
-	Cert         string
-	Key          string
-	Vault        VaultClient
-	VaultPattern string
-	Logger       *logrus.Logger
-	BasicAuth    []string
+	Listen               string
+	Cert                 string
+	Key                  string
+	Vault                VaultClient
+	Resolvers            map[string]Resolver
+	VaultEndpoints       map[string]Resolver
+	EndpointNamespaces   map[string][]string
+	VaultRoutes          []VaultRoute
+	VaultHealthInterval  time.Duration
+	VaultPattern         string
+	Provenance           bool
+	ReuseOnUpdate        bool
+	ResyncUsername       string
+	DryRunCheckPaths     bool
+	GeneratePaths        []string
+	Kubernetes           kubernetes.Interface
+	ValidateUnresolved   bool
+	ValidateVaultOnly    bool
+	VaultOnlyLabel       string
+	VaultOnlyIgnoreTypes []string
+	InjectImage          string
+	InjectVaultAddr      string
+	InjectAuthMount      string
+	InjectRole           string
+	InjectRoles          []string
+	Logger               *logrus.Logger
+	BasicAuth            []string
+	BasicAuthFile        string
+	BasicAuthCacheTTL    time.Duration
+	AuthFailureLimit     int
+	AuthFailureWindow    time.Duration
+	ClientCA             string
+	ClientNames          []string
+	AuthMode             string
+	CertProvider         CertificateProvider
+	TLSMinVersion        uint16
+	TLSCipherSuites      []uint16
+	TLSCurves            []tls.CurveID
+	HTTP2                bool
+	ReadHeaderTimeout    time.Duration
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	MaxRequestBody       int64
+
+	htpasswd     *htpasswd
+	authCache    *authCache
+	authThrottle *authThrottle
+	vaultHealth  vaultHealth
 }
 
 // VaultClient interface validate a Vault read method
@@ -37,11 +93,70 @@ type VaultClient interface {
 	Read(path, key string) (string, error)
 }
 
+// CertificateProvider interface allows serving certificates from another
+// source than cert and key files
+type CertificateProvider interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
 // Serve is the entrypoint of the API
 func (s *Server) Serve() error {
 
+	err := s.setupAuth()
+	if err != nil {
+		return err
+	}
+
+	// Load certificate from files, reloaded without restart when rotated,
+	// unless another certificate provider is set
+	certs := s.CertProvider
+	if certs == nil {
+		certs, err = newCertReloader(s.Cert, s.Key, s.Logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	srv := &http.Server{
+		Addr:              s.Listen,
+		Handler:           s.Router(),
+		TLSConfig:         s.tlsConfig(),
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+	}
+	srv.TLSConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := certs.GetCertificate(hello)
+		if err == nil && cert.Leaf != nil {
+			certificateExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+		}
+		return cert, err
+	}
+
+	// A non-nil empty TLSNextProto disables HTTP/2 negotiation
+	if !s.HTTP2 {
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	// Ask clients for a certificate when client certificate auth is enabled,
+	// verification is optional at TLS level so that /status and /metrics
+	// stay reachable and RequestAuth enforces it on protected routes
+	if s.ClientCA != "" {
+		pool, err := loadClientCAs(s.ClientCA)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	// Check Vault endpoints health in background
+	if s.VaultHealthInterval > 0 {
+		go s.watchVaultHealth(s.VaultHealthInterval, nil)
+	}
+
 	s.Logger.Infof("webhook started, listening on %s", s.Listen)
-	err := http.ListenAndServeTLS(s.Listen, s.Cert, s.Key, s.Router())
+	err = srv.ListenAndServeTLS("", "")
 	if err != nil {
 		return fmt.Errorf("failed to start http server: %s", err)
 	}
@@ -56,10 +171,14 @@ func (s *Server) Router() *chi.Mux {
 	router.Use(s.RequestCounter)
 
 	router.Get("/status", s.statusHandler)
+	router.Get("/status/vault", s.vaultStatusHandler)
 	router.Get("/metrics", promhttp.Handler().ServeHTTP)
 	router.Group(func(router chi.Router) {
 		router.Use(s.RequestAuth)
+		router.Use(s.RequestLimit)
 		router.Post("/secret", s.secretHandler)
+		router.Post("/validate/secret", s.validateHandler)
+		router.Post("/pod", s.podHandler)
 	})
 
 	return router
@@ -92,40 +211,61 @@ func (s *Server) RequestCounter(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
-// RequestAuth is a middleware checking API servers authentication through basicauth
+// RequestLimit is a middleware limiting request body size
+func (s *Server) RequestLimit(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if s.MaxRequestBody > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, s.MaxRequestBody)
+		}
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// RequestAuth is a middleware checking API servers authentication through
+// basicauth and/or client certificates
 func (s *Server) RequestAuth(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 
-		// Only check for authentication if basicauth is set via flags or config
-		if len(s.BasicAuth) > 0 {
+		// List authentication methods enabled via flags or config
+		checks := []func(*http.Request) error{}
+		if len(s.BasicAuth) > 0 || s.BasicAuthFile != "" {
+			checks = append(checks, s.checkBasicAuth)
+		}
+		if s.ClientCA != "" {
+			checks = append(checks, s.checkClientCert)
+		}
 
-			// Extract user/password from request
-			reqUser, reqPass, ok := r.BasicAuth()
-			if !ok {
-				s.Logger.Error("authentification failed, missing credentials")
-				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		// Only check for authentication if at least one method is enabled
+		if len(checks) > 0 {
+
+			// Reject clients with too many recent failures
+			ip := sourceIP(r)
+			if s.authThrottle.blocked(ip) {
+				s.Logger.Errorf("authentication failed, too many failures from %s", ip)
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 				return
 			}
 
-			// Check if user/password is one of defined by flags or config
-			valid := func() bool {
-				for _, cfgBasicauth := range s.BasicAuth {
-					// Extract brcypt hashed password from basicauth config
-					cfgUserPass := strings.Split(cfgBasicauth, ":")
-					if cfgUserPass[0] != reqUser {
-						continue
-					}
-
-					// Check password
-					err := bcrypt.CompareHashAndPassword([]byte(cfgUserPass[1]), []byte(reqPass))
-					if err == nil {
-						return true
-					}
+			var errs []error
+			for _, check := range checks {
+				if err := check(r); err != nil {
+					errs = append(errs, err)
+				}
+			}
+
+			// With "any" mode one successful method is enough, otherwise
+			// all enabled methods must succeed
+			failed := len(errs) > 0
+			if s.AuthMode == AuthModeAny {
+				failed = len(errs) == len(checks)
+			}
+			if failed {
+				s.authThrottle.fail(ip)
+				for _, err := range errs {
+					s.Logger.Errorf("authentication failed, %s", err)
 				}
-				return false
-			}()
-			if !valid {
-				s.Logger.Error("authentication failed, invalid credentials")
 				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 				return
 			}
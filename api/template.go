@@ -0,0 +1,215 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// AnnotationTemplatePrefix is the prefix of secret annotations holding a Go
+// template rendered into the data key named after the prefix, for example
+// "template-url: jdbc:postgresql://{{ vault "db" "host" }}/app"
+const AnnotationTemplatePrefix = annotationPrefix + "template-"
+
+// templateHelpers are the sprig functions available in templates besides
+// vault, limited to string helpers without access to the environment
+var templateHelpers = []string{
+	"b64dec", "b64enc", "contains", "default", "hasPrefix", "hasSuffix", "indent", "join",
+	"lower", "nindent", "quote", "replace", "squote", "title", "toJson", "trim", "trimAll",
+	"trimPrefix", "trimSuffix", "upper",
+}
+
+// templateErrorRegex extracts the line, optional column and message of
+// text/template parse and execution errors
+var templateErrorRegex = regexp.MustCompile(`(?s)^template: [^:]*:(\d+)(?::(\d+))?: (.*)$`)
+
+// templateRef is a Vault reference read by a template
+type templateRef struct {
+	Value string
+	Ref   string
+}
+
+// templateSecretData renders the data keys of template annotations with a
+// vault function reading Vault references through the vault pattern. Each
+// reference is read once per admission. On dry-run requests templates are
+// rendered with references only validated and no data is built.
+func (s *Server) templateSecretData(secret corev1.Secret, dryRun bool) (builtData, error) {
+	result := builtData{Data: map[string][]byte{}, Provenance: map[string]Provenance{}, Reads: map[string]string{}}
+
+	keys := []string{}
+	for annotation := range secret.Annotations {
+		if strings.HasPrefix(annotation, AnnotationTemplatePrefix) {
+			keys = append(keys, strings.TrimPrefix(annotation, AnnotationTemplatePrefix))
+		}
+	}
+	sort.Strings(keys)
+
+	refs := map[string]templateRef{}
+	for _, key := range keys {
+		location := fmt.Sprintf("annotation '%s%s'", AnnotationTemplatePrefix, key)
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			return result, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "%s: invalid data key: %s", location, strings.Join(errs, ", "))
+		}
+
+		sources := map[string]string{}
+		vault := func(path, key string) (string, error) {
+			source := fmt.Sprintf("%s#%s", path, key)
+			r, ok := refs[source]
+			if !ok {
+				value, ref, err := s.resolveRef(secret, placeholder{Path: path, Key: key}, location, dryRun)
+				if err != nil {
+					return "", err
+				}
+				r = templateRef{Value: value, Ref: ref}
+				refs[source] = r
+			}
+			sources[source] = r.Ref
+			return r.Value, nil
+		}
+
+		rendered, err := renderTemplate(key, secret.Annotations[AnnotationTemplatePrefix+key], vault)
+		if err != nil {
+			return result, templateDenial(location, err)
+		}
+		if dryRun {
+			continue
+		}
+
+		// Provenance has no version as rendered values can't be resynced,
+		// templates without Vault reference are plaintext
+		result.Data[key] = rendered
+		for source, ref := range sources {
+			result.Reads[key+"."+source] = ref
+		}
+		if len(sources) == 0 {
+			continue
+		}
+		result.Provenance[key] = Provenance{
+			Placeholder: "template",
+			Sources:     sources,
+			ResolvedAt:  timeNow().UTC().Truncate(time.Second),
+		}
+	}
+
+	return result, nil
+}
+
+// renderTemplate renders a template with the vault function and string helpers
+func renderTemplate(name, text string, vault func(path, key string) (string, error)) ([]byte, error) {
+	sprigFuncs := sprig.TxtFuncMap()
+	funcs := template.FuncMap{"vault": vault}
+	for _, helper := range templateHelpers {
+		funcs[helper] = sprigFuncs[helper]
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, templateParseError{err: err, text: text, funcs: funcs}
+	}
+
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return rendered.Bytes(), nil
+}
+
+// templateParseError is a template parse error along with the template text,
+// text/template parse errors only have a line and the column is searched
+type templateParseError struct {
+	err   error
+	text  string
+	funcs template.FuncMap
+}
+
+func (e templateParseError) Error() string {
+	return e.err.Error()
+}
+
+func (e templateParseError) Unwrap() error {
+	return e.err
+}
+
+// templateDenial returns an admissionError for a template error with its
+// line and column. Denials returned by the vault function keep their status.
+func templateDenial(location string, err error) error {
+	line, column, msg := 1, 1, err.Error()
+	if sub := templateErrorRegex.FindStringSubmatch(msg); sub != nil {
+		line, _ = strconv.Atoi(sub[1])
+		// Execution error columns are byte offsets starting at 0
+		if sub[2] != "" {
+			column, _ = strconv.Atoi(sub[2])
+			column++
+		}
+		msg = sub[3]
+	}
+	var parseErr templateParseError
+	if errors.As(err, &parseErr) {
+		column = parseErrorColumn(parseErr.text, line, parseErr.funcs)
+	}
+
+	var denial admissionError
+	if errors.As(err, &denial) {
+		return denied(denial.code, denial.reason, "%s: line %d, column %d: %s", location, line, column, denial.message)
+	}
+
+	return denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "%s: line %d, column %d: %s", location, line, column, msg)
+}
+
+// parseErrorColumn returns the column of the action causing a parse error on
+// a template line: the first unclosed action or the first action failing to
+// parse on its own. Actions opening or closing blocks don't parse on their
+// own and are skipped. It defaults to the first action of the line.
+func parseErrorColumn(text string, line int, funcs template.FuncMap) int {
+	lines := strings.Split(text, "\n")
+	if line < 1 || line > len(lines) {
+		return 1
+	}
+	offset := len(strings.Join(lines[:line-1], "\n"))
+	if line > 1 {
+		offset++
+	}
+	content := lines[line-1]
+
+	column := 0
+	for start := 0; ; {
+		i := strings.Index(content[start:], "{{")
+		if i < 0 {
+			break
+		}
+		start += i
+		if column == 0 {
+			column = start + 1
+		}
+
+		end := strings.Index(text[offset+start:], "}}")
+		if end < 0 {
+			return start + 1
+		}
+		action := text[offset+start : offset+start+end+2]
+		_, err := template.New("action").Funcs(funcs).Parse(action)
+		if err != nil && !strings.Contains(err.Error(), "unexpected EOF") && !strings.Contains(err.Error(), "unexpected {{end}}") && !strings.Contains(err.Error(), "unexpected {{else}}") {
+			return start + 1
+		}
+		start += 2
+	}
+
+	if column == 0 {
+		return 1
+	}
+	return column
+}
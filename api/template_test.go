@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// templateSecret returns a secret with template annotations by data key
+func templateSecret(templates map[string]string) corev1.Secret {
+	secret := corev1.Secret{Data: map[string][]byte{"user": []byte("admin")}}
+	secret.Name = "test-secret"
+	secret.Namespace = "test-namespace"
+	secret.Annotations = map[string]string{}
+	for key, text := range templates {
+		secret.Annotations[AnnotationTemplatePrefix+key] = text
+	}
+
+	return secret
+}
+
+// Fake Vault client counting reads for testing
+type fakeCountingVaultClient struct {
+	Values map[string]string
+	Reads  map[string]int
+}
+
+func (f fakeCountingVaultClient) Read(path, key string) (string, error) {
+	f.Reads[path+"#"+key]++
+	return f.Values[path+"#"+key], nil
+}
+
+func TestServer_mutateSecretDataTemplate(t *testing.T) {
+
+	vault := fakeCountingVaultClient{
+		Values: map[string]string{
+			"secret/data/test-namespace/db#host":     "db.example.com",
+			"secret/data/test-namespace/db#password": "s3cr3t",
+		},
+		Reads: map[string]int{},
+	}
+	s := Server{
+		Vault:        vault,
+		VaultPattern: "secret/data/{{.Namespace}}/{{.Secret}}",
+		Provenance:   true,
+		Logger:       logrus.New(),
+	}
+
+	// Templates are rendered into data keys, references are read once
+	secret := templateSecret(map[string]string{
+		"url":         `jdbc:postgresql://{{ vault "db" "host" }}/app`,
+		"config.yaml": "database:\n  host: {{ vault \"db\" \"host\" }}\n  password: {{ vault \"db\" \"password\" | quote }}\n  auth: {{ vault \"db\" \"password\" | b64enc }}",
+	})
+	result, err := s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Equal(t, patchOperation{Op: "add", Path: "/data/config.yaml", Value: base64.StdEncoding.EncodeToString([]byte("database:\n  host: db.example.com\n  password: \"s3cr3t\"\n  auth: czNjcjN0"))}, result.Patch[0], "Test config rendered")
+	require.Equal(t, patchOperation{Op: "add", Path: "/data/url", Value: base64.StdEncoding.EncodeToString([]byte("jdbc:postgresql://db.example.com/app"))}, result.Patch[1], "Test url rendered")
+	require.Equal(t, map[string]int{"secret/data/test-namespace/db#host": 1, "secret/data/test-namespace/db#password": 1}, vault.Reads, "Test references read once")
+	require.JSONEq(t, `{"config.yaml.db#host":"secret/data/test-namespace/db#host","config.yaml.db#password":"secret/data/test-namespace/db#password","url.db#host":"secret/data/test-namespace/db#host"}`, result.AuditAnnotations[auditAnnotationReads], "Test reads audit annotation")
+
+	var provenance map[string]Provenance
+	require.Nil(t, json.Unmarshal([]byte(result.Patch[2].Value.(string)), &provenance))
+	require.Equal(t, Provenance{Placeholder: "template", Sources: map[string]string{"db#host": "secret/data/test-namespace/db#host"}, ResolvedAt: provenance["url"].ResolvedAt}, provenance["url"], "Test template provenance")
+
+	// Templates without Vault reference are plaintext
+	secret = templateSecret(map[string]string{"url": `jdbc:postgresql://{{ "db.example.com" }}/app`})
+	result, err = s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Len(t, result.Patch, 1, "Test template without reference has no provenance")
+
+	// Nothing is rendered on dry-run requests
+	result, err = s.mutateSecretData(secret, mutateOptions{DryRun: true})
+	require.Nil(t, err)
+	require.Empty(t, result.Patch, "Test dry-run")
+}
+
+func TestServer_mutateSecretDataTemplateErrors(t *testing.T) {
+
+	s := Server{
+		Vault:        fakeCountingVaultClient{Values: map[string]string{}, Reads: map[string]int{}},
+		VaultPattern: "secret/data/{{.Namespace}}/{{.Secret}}",
+		Logger:       logrus.New(),
+	}
+
+	var templateTests = []struct {
+		description string
+		templates   map[string]string
+		statusCode  int32
+		errorString string
+	}{
+		{"Test invalid data key", map[string]string{"a/b": "value"}, http.StatusUnprocessableEntity, "annotation 'k8s-vault-webhook.ouest-france.fr/template-a/b': invalid data key"},
+		{"Test unknown function", map[string]string{"url": "host: {{ vault \"db\" \"host\" }}\nenv: {{ env \"HOME\" }}"}, http.StatusUnprocessableEntity, "line 2, column 6: function \"env\" not defined"},
+		{"Test unclosed action", map[string]string{"url": "{{ vault \"db\" \"host\" }} {{ upper"}, http.StatusUnprocessableEntity, "line 1, column 25:"},
+		{"Test unclosed block", map[string]string{"url": "{{ if true }}\n{{ vault \"db\" \"host\" }}"}, http.StatusUnprocessableEntity, "line 2, column 1:"},
+		{"Test wrong arguments", map[string]string{"url": "x{{ vault \"db\" }}"}, http.StatusUnprocessableEntity, "line 1, column 5:"},
+		{"Test execution error", map[string]string{"url": "a\n  {{ index \"abc\" 5 }}"}, http.StatusUnprocessableEntity, "line 2, column 6: executing \"url\" at <index \"abc\" 5>: error calling index"},
+	}
+
+	for _, test := range templateTests {
+		_, err := s.mutateSecretData(templateSecret(test.templates), mutateOptions{})
+		var denial admissionError
+		require.True(t, errors.As(err, &denial), test.description)
+		require.Equal(t, test.statusCode, denial.code, test.description)
+		require.Contains(t, denial.message, test.errorString, test.description)
+	}
+
+	// Vault denials keep their status code with the template position
+	s.Vault = fakeFallbackVaultClient{}
+	_, err := s.mutateSecretData(templateSecret(map[string]string{"url": "x\nhost={{ vault \"db\" \"host\" }}"}), mutateOptions{})
+	var denial admissionError
+	require.True(t, errors.As(err, &denial), "Test missing vault secret")
+	require.Equal(t, int32(http.StatusNotFound), denial.code, "Test missing vault secret")
+	require.Contains(t, denial.message, "line 2, column 9:", "Test missing vault secret")
+}
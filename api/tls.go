@@ -0,0 +1,89 @@
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsVersions maps accepted minimum TLS version names to their values
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves maps accepted curve names to their values
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// ParseTLSVersion returns the TLS version matching name ("1.2" or "1.3")
+func ParseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("TLS version is '%s', must be '1.2' or '1.3'", name)
+	}
+
+	return version, nil
+}
+
+// ParseCipherSuites returns the cipher suites matching names, only suites
+// considered secure by Go are accepted. An empty list keeps Go defaults.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := []uint16{}
+	for _, name := range names {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == strings.TrimSpace(name) {
+				suites = append(suites, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("TLS cipher suite '%s' is unknown or insecure", name)
+		}
+	}
+
+	return suites, nil
+}
+
+// ParseCurves returns the curves matching names (X25519, P256, P384, P521).
+// An empty list keeps Go defaults.
+func ParseCurves(names []string) ([]tls.CurveID, error) {
+	curves := []tls.CurveID{}
+	for _, name := range names {
+		curve, ok := tlsCurves[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("TLS curve '%s' is unknown, must be one of X25519, P256, P384 or P521", name)
+		}
+		curves = append(curves, curve)
+	}
+
+	return curves, nil
+}
+
+// tlsConfig returns the TLS configuration of the HTTPS listener
+func (s *Server) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: s.TLSMinVersion,
+		NextProtos: []string{"http/1.1"},
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if len(s.TLSCipherSuites) > 0 {
+		config.CipherSuites = s.TLSCipherSuites
+	}
+	if len(s.TLSCurves) > 0 {
+		config.CurvePreferences = s.TLSCurves
+	}
+	if s.HTTP2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	return config
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTLSSettings(t *testing.T) {
+
+	version, err := ParseTLSVersion("1.3")
+	require.Nil(t, err, "Test valid TLS version")
+	require.Equal(t, uint16(tls.VersionTLS13), version, "Test valid TLS version")
+
+	_, err = ParseTLSVersion("1.0")
+	require.EqualError(t, err, "TLS version is '1.0', must be '1.2' or '1.3'", "Test insecure TLS version")
+
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"})
+	require.Nil(t, err, "Test valid cipher suites")
+	require.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, suites, "Test valid cipher suites")
+
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	require.EqualError(t, err, "TLS cipher suite 'TLS_RSA_WITH_RC4_128_SHA' is unknown or insecure", "Test insecure cipher suite")
+
+	curves, err := ParseCurves([]string{"X25519", "P256"})
+	require.Nil(t, err, "Test valid curves")
+	require.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, curves, "Test valid curves")
+
+	_, err = ParseCurves([]string{"P224"})
+	require.EqualError(t, err, "TLS curve 'P224' is unknown, must be one of X25519, P256, P384 or P521", "Test unknown curve")
+}
+
+func TestServer_tlsConfig(t *testing.T) {
+
+	s := Server{}
+	config := s.tlsConfig()
+	require.Equal(t, uint16(tls.VersionTLS12), config.MinVersion, "Test default minimum TLS version")
+	require.Equal(t, []string{"http/1.1"}, config.NextProtos, "Test HTTP/2 disabled")
+	require.Nil(t, config.CipherSuites, "Test default cipher suites")
+
+	s = Server{
+		TLSMinVersion:   tls.VersionTLS13,
+		TLSCipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		TLSCurves:       []tls.CurveID{tls.X25519},
+		HTTP2:           true,
+	}
+	config = s.tlsConfig()
+	require.Equal(t, uint16(tls.VersionTLS13), config.MinVersion, "Test configured minimum TLS version")
+	require.Equal(t, []string{"h2", "http/1.1"}, config.NextProtos, "Test HTTP/2 enabled")
+	require.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, config.CipherSuites, "Test configured cipher suites")
+	require.Equal(t, []tls.CurveID{tls.X25519}, config.CurvePreferences, "Test configured curves")
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AnnotationTypedPrefix is the prefix of secret annotations holding a Vault
+// reference or a plaintext value for each field of a typed secret, for
+// example "typed-username: vault:registry#user"
+const AnnotationTypedPrefix = annotationPrefix + "typed-"
+
+// Typed secret fields set by annotation
+const (
+	typedRegistry      = "registry"
+	typedUsername      = "username"
+	typedPassword      = "password"
+	typedEmail         = "email"
+	typedSSHPrivateKey = "ssh-privatekey"
+)
+
+// typedFields lists the fields supported by each secret type and whether
+// they are required
+var typedFields = map[corev1.SecretType]map[string]bool{
+	corev1.SecretTypeDockerConfigJson: {typedRegistry: true, typedUsername: true, typedPassword: true, typedEmail: false},
+	corev1.SecretTypeBasicAuth:        {typedUsername: false, typedPassword: false},
+	corev1.SecretTypeSSHAuth:          {typedSSHPrivateKey: true},
+}
+
+// typedSecretFields lists the fields holding credentials, built keys only
+// have provenance if their credential fields were read from a resolver so
+// that plaintext credentials are denied in vault-only namespaces
+var typedSecretFields = map[string]bool{typedUsername: true, typedPassword: true, typedSSHPrivateKey: true}
+
+// builtData holds data keys built from typed field or template annotations
+type builtData struct {
+	Data       map[string][]byte
+	Provenance map[string]Provenance
+	Reads      map[string]string
+}
+
+// dockerConfigJSON is the content of a kubernetes.io/dockerconfigjson secret
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// dockerConfigEntry holds the credentials of a registry
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Auth     string `json:"auth"`
+}
+
+// typedFieldsOf returns the typed field annotations of a secret by field name
+func typedFieldsOf(secret corev1.Secret) map[string]string {
+	fields := map[string]string{}
+	for annotation, value := range secret.Annotations {
+		if strings.HasPrefix(annotation, AnnotationTypedPrefix) {
+			fields[strings.TrimPrefix(annotation, AnnotationTypedPrefix)] = value
+		}
+	}
+
+	return fields
+}
+
+// typedSecretData builds the data keys of dockerconfigjson, basic-auth and
+// ssh-auth secrets from the Vault references or plaintext values of typed
+// field annotations. Built values are checked against the secret type schema.
+// On dry-run requests references are only validated and no data is built.
+func (s *Server) typedSecretData(secret corev1.Secret, dryRun bool) (builtData, error) {
+	result := builtData{Data: map[string][]byte{}, Provenance: map[string]Provenance{}, Reads: map[string]string{}}
+
+	fields := typedFieldsOf(secret)
+	if len(fields) == 0 {
+		return result, nil
+	}
+
+	supported, ok := typedFields[secret.Type]
+	if !ok {
+		return result, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "'%s' annotations are not supported on secrets of type '%s'", AnnotationTypedPrefix, secret.Type)
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := supported[name]; !ok {
+			return result, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "annotation '%s%s' is not supported on secrets of type '%s'", AnnotationTypedPrefix, name, secret.Type)
+		}
+	}
+	for _, name := range []string{typedRegistry, typedUsername, typedPassword, typedEmail, typedSSHPrivateKey} {
+		if _, ok := fields[name]; supported[name] && !ok {
+			return result, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "annotation '%s%s' is required on secrets of type '%s'", AnnotationTypedPrefix, name, secret.Type)
+		}
+	}
+
+	// Resolve each field, recording Vault references read
+	values := map[string]string{}
+	sources := map[string]string{}
+	for _, name := range names {
+		location := fmt.Sprintf("annotation '%s%s'", AnnotationTypedPrefix, name)
+		value, ref, err := s.annotationValue(secret, location, fields[name], dryRun)
+		if err != nil {
+			return result, err
+		}
+		values[name] = value
+		if ref != "" {
+			sources[name] = ref
+		}
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	data, err := buildTypedData(secret.Type, values)
+	if err != nil {
+		return result, denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "secret of type '%s' is invalid: %s", secret.Type, err)
+	}
+
+	// Provenance has no version as built values can't be resynced
+	for key, value := range data {
+		result.Data[key] = value
+		for name, ref := range sources {
+			result.Reads[key+"."+name] = ref
+		}
+		if !typedResolved(secret.Type, key, values, sources) {
+			continue
+		}
+		result.Provenance[key] = Provenance{
+			Placeholder: "typed:" + string(secret.Type),
+			Sources:     sources,
+			ResolvedAt:  timeNow().UTC().Truncate(time.Second),
+		}
+	}
+
+	return result, nil
+}
+
+// typedResolved returns true if the credential fields a typed data key is
+// built from were all read from a resolver. Basic auth keys are built from
+// the field of the same name, other types from all fields.
+func typedResolved(secretType corev1.SecretType, key string, values, sources map[string]string) bool {
+	for name := range values {
+		if secretType == corev1.SecretTypeBasicAuth && name != key {
+			continue
+		}
+		if typedSecretFields[name] && sources[name] == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// annotationValue returns a value set by annotation, read from Vault for
+// placeholders along with the Vault reference, or the plaintext value
+func (s *Server) annotationValue(secret corev1.Secret, location, value string, dryRun bool) (string, string, error) {
+	ph, ok, err := s.parseSchemePlaceholder(value)
+	if !ok {
+		return value, "", nil
+	}
+	if err == nil {
+		err = checkNoGenerate(ph, location)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	return s.resolveRef(secret, ph, location, dryRun)
+}
+
+// resolveRef returns the value of a Vault reference used to build a secret
+// value along with the templated reference, read from the Vault endpoint of
+// the first route matching the secret if any. On dry-run requests the Vault
+// secret is only checked and an empty value is returned. Fallback values
+// would build an invalid value and are denied.
+func (s *Server) resolveRef(secret corev1.Secret, ph placeholder, location string, dryRun bool) (string, string, error) {
+	ph = s.route(secret, ph)
+	err := s.checkEndpointNamespace(secret, ph)
+	if err != nil {
+		return "", "", err
+	}
+	path, err := s.vaultPath(secret.Name, secret.Namespace, ph)
+	if err != nil {
+		return "", "", err
+	}
+	ref := ph.ref(path)
+
+	if dryRun {
+		return "", ref, s.checkVaultPath(ph, path)
+	}
+
+	vaultValue, _, err := s.resolve(ph, path)
+	var fallback fallbackError
+	if errors.As(err, &fallback) && fallback.Fallback() {
+		return "", "", denied(http.StatusNotFound, metav1.StatusReasonNotFound, "%s: %s", location, err)
+	}
+	if err != nil {
+		return "", "", denied(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, "failed to read secret '%s' in vault: %s", path, err)
+	}
+
+	return vaultValue, ref, nil
+}
+
+// buildTypedData returns the data keys of a typed secret built from field
+// values, checked against the secret type schema
+func buildTypedData(secretType corev1.SecretType, values map[string]string) (map[string][]byte, error) {
+	switch secretType {
+
+	case corev1.SecretTypeDockerConfigJson:
+		for _, name := range []string{typedRegistry, typedUsername, typedPassword} {
+			if values[name] == "" {
+				return nil, fmt.Errorf("%s is empty", name)
+			}
+		}
+		if strings.ContainsAny(values[typedRegistry], " \t\r\n") {
+			return nil, errors.New("registry contains whitespaces")
+		}
+		if strings.Contains(values[typedUsername], ":") {
+			return nil, errors.New("username contains ':'")
+		}
+		config := dockerConfigJSON{Auths: map[string]dockerConfigEntry{
+			values[typedRegistry]: {
+				Username: values[typedUsername],
+				Password: values[typedPassword],
+				Email:    values[typedEmail],
+				Auth:     base64.StdEncoding.EncodeToString([]byte(values[typedUsername] + ":" + values[typedPassword])),
+			},
+		}}
+		raw, err := json.Marshal(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal docker config: %s", err)
+		}
+		return map[string][]byte{corev1.DockerConfigJsonKey: raw}, nil
+
+	case corev1.SecretTypeBasicAuth:
+		data := map[string][]byte{}
+		for _, name := range []string{typedUsername, typedPassword} {
+			if value, ok := values[name]; ok {
+				data[name] = []byte(value)
+			}
+		}
+		if len(data) == 0 {
+			return nil, errors.New("username or password is required")
+		}
+		return data, nil
+
+	case corev1.SecretTypeSSHAuth:
+		_, err := ssh.ParseRawPrivateKey([]byte(values[typedSSHPrivateKey]))
+		if err != nil {
+			return nil, fmt.Errorf("ssh-privatekey is not a valid private key: %s", err)
+		}
+		return map[string][]byte{corev1.SSHAuthPrivateKey: []byte(values[typedSSHPrivateKey])}, nil
+	}
+
+	return nil, fmt.Errorf("secret type %q is not supported", secretType)
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// typedSecret returns a secret of a type with typed field annotations
+func typedSecret(secretType corev1.SecretType, fields map[string]string) corev1.Secret {
+	secret := corev1.Secret{Type: secretType, Data: map[string][]byte{}}
+	secret.Name = "test-secret"
+	secret.Namespace = "test-namespace"
+	secret.Annotations = map[string]string{}
+	for name, value := range fields {
+		secret.Annotations[AnnotationTypedPrefix+name] = value
+	}
+
+	return secret
+}
+
+// sshPrivateKey returns a PEM encoded private key for testing
+func sshPrivateKey(t *testing.T) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestServer_mutateSecretDataTyped(t *testing.T) {
+
+	key := sshPrivateKey(t)
+	s := Server{
+		Vault: fakeVersionVaultClient{Values: map[string]string{
+			"secret/data/test-namespace/registry#user":     "robot",
+			"secret/data/test-namespace/registry#password": "s3cr3t",
+			"secret/data/test-namespace/git#key":           key,
+		}},
+		VaultPattern: "secret/data/{{.Namespace}}/{{.Secret}}",
+		Provenance:   true,
+		Logger:       logrus.New(),
+	}
+
+	// Docker config is built with the auth field
+	secret := typedSecret(corev1.SecretTypeDockerConfigJson, map[string]string{
+		"registry": "registry.example.com",
+		"username": "vault:registry#user",
+		"password": "vault:registry#password",
+	})
+	result, err := s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Equal(t, "add", result.Patch[0].Op)
+	require.Equal(t, "/data/.dockerconfigjson", result.Patch[0].Path)
+	config, err := base64.StdEncoding.DecodeString(result.Patch[0].Value.(string))
+	require.Nil(t, err)
+	require.JSONEq(t, `{"auths":{"registry.example.com":{"username":"robot","password":"s3cr3t","auth":"cm9ib3Q6czNjcjN0"}}}`, string(config), "Test docker config")
+	require.JSONEq(t, `{".dockerconfigjson.password":"secret/data/test-namespace/registry#password",".dockerconfigjson.username":"secret/data/test-namespace/registry#user"}`, result.AuditAnnotations[auditAnnotationReads], "Test reads audit annotation")
+
+	var provenance map[string]Provenance
+	require.Nil(t, json.Unmarshal([]byte(result.Patch[1].Value.(string)), &provenance))
+	require.Equal(t, "typed:kubernetes.io/dockerconfigjson", provenance[".dockerconfigjson"].Placeholder, "Test typed provenance")
+	require.Equal(t, 0, provenance[".dockerconfigjson"].Version, "Test typed provenance has no version")
+	require.Equal(t, map[string]string{"username": "secret/data/test-namespace/registry#user", "password": "secret/data/test-namespace/registry#password"}, provenance[".dockerconfigjson"].Sources)
+
+	// Basic auth keys are set from fields
+	secret = typedSecret(corev1.SecretTypeBasicAuth, map[string]string{"username": "admin", "password": "vault:registry#password"})
+	result, err = s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Equal(t, patchOperation{Op: "add", Path: "/data/password", Value: "czNjcjN0"}, result.Patch[0], "Test basic auth password")
+	require.Equal(t, patchOperation{Op: "add", Path: "/data/username", Value: "YWRtaW4="}, result.Patch[1], "Test basic auth username")
+
+	// Keys built from plaintext credentials have no provenance
+	provenance = nil
+	require.Nil(t, json.Unmarshal([]byte(result.Patch[2].Value.(string)), &provenance))
+	require.Contains(t, provenance, "password", "Test resolved basic auth password provenance")
+	require.NotContains(t, provenance, "username", "Test plaintext basic auth username provenance")
+
+	secret = typedSecret(corev1.SecretTypeDockerConfigJson, map[string]string{
+		"registry": "registry.example.com",
+		"username": "vault:registry#user",
+		"password": "plaintext",
+	})
+	result, err = s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Len(t, result.Patch, 1, "Test plaintext docker config password provenance")
+
+	// SSH private key is checked, data map is created if missing
+	secret = typedSecret(corev1.SecretTypeSSHAuth, map[string]string{"ssh-privatekey": "vault:git#key"})
+	secret.Data = nil
+	result, err = s.mutateSecretData(secret, mutateOptions{})
+	require.Nil(t, err)
+	require.Equal(t, patchOperation{Op: "add", Path: "/data", Value: map[string]string{}}, result.Patch[0], "Test data map created")
+	require.Equal(t, patchOperation{Op: "add", Path: "/data/ssh-privatekey", Value: base64.StdEncoding.EncodeToString([]byte(key))}, result.Patch[1], "Test ssh private key")
+
+	// Nothing is built on dry-run requests
+	secret = typedSecret(corev1.SecretTypeBasicAuth, map[string]string{"username": "vault:registry#user"})
+	result, err = s.mutateSecretData(secret, mutateOptions{DryRun: true})
+	require.Nil(t, err)
+	require.Empty(t, result.Patch, "Test dry-run")
+}
+
+func TestServer_mutateSecretDataTypedErrors(t *testing.T) {
+
+	s := Server{
+		Vault: fakeVersionVaultClient{Values: map[string]string{
+			"secret/data/test-namespace/registry#user": "robot:admin",
+			"secret/data/test-namespace/git#key":       "not a key",
+		}},
+		VaultPattern: "secret/data/{{.Namespace}}/{{.Secret}}",
+		Logger:       logrus.New(),
+	}
+
+	var typedTests = []struct {
+		description string
+		secretType  corev1.SecretType
+		fields      map[string]string
+		statusCode  int32
+		errorString string
+	}{
+		{"Test unsupported secret type", corev1.SecretTypeOpaque, map[string]string{"username": "admin"}, http.StatusUnprocessableEntity, "are not supported on secrets of type 'Opaque'"},
+		{"Test unsupported field", corev1.SecretTypeBasicAuth, map[string]string{"registry": "registry.example.com"}, http.StatusUnprocessableEntity, "annotation 'k8s-vault-webhook.ouest-france.fr/typed-registry' is not supported"},
+		{"Test missing required field", corev1.SecretTypeDockerConfigJson, map[string]string{"registry": "registry.example.com", "username": "robot"}, http.StatusUnprocessableEntity, "typed-password' is required"},
+		{"Test empty field", corev1.SecretTypeDockerConfigJson, map[string]string{"registry": "registry.example.com", "username": "robot", "password": ""}, http.StatusUnprocessableEntity, "password is empty"},
+		{"Test username with colon", corev1.SecretTypeDockerConfigJson, map[string]string{"registry": "registry.example.com", "username": "vault:registry#user", "password": "pass"}, http.StatusUnprocessableEntity, "username contains ':'"},
+		{"Test invalid private key", corev1.SecretTypeSSHAuth, map[string]string{"ssh-privatekey": "vault:git#key"}, http.StatusUnprocessableEntity, "ssh-privatekey is not a valid private key"},
+		{"Test generate placeholder", corev1.SecretTypeBasicAuth, map[string]string{"password": "vault-generate:db#password"}, http.StatusUnprocessableEntity, "only supported in secret data"},
+	}
+
+	for _, test := range typedTests {
+		_, err := s.mutateSecretData(typedSecret(test.secretType, test.fields), mutateOptions{})
+		var denial admissionError
+		require.True(t, errors.As(err, &denial), test.description)
+		require.Equal(t, test.statusCode, denial.code, test.description)
+		require.Contains(t, denial.message, test.errorString, test.description)
+	}
+
+	// Missing Vault secrets are denied instead of building a fallback value
+	s.Vault = fakeFallbackVaultClient{}
+	_, err := s.mutateSecretData(typedSecret(corev1.SecretTypeBasicAuth, map[string]string{"password": "vault:registry#password"}), mutateOptions{})
+	var denial admissionError
+	require.True(t, errors.As(err, &denial), "Test missing vault secret")
+	require.Equal(t, int32(http.StatusNotFound), denial.code, "Test missing vault secret")
+}
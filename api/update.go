@@ -0,0 +1,83 @@
+package api
+
+import (
+	"bytes"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// reusedValue is a value resolved on a previous admission of a secret
+type reusedValue struct {
+	Value      []byte
+	Provenance Provenance
+}
+
+// reusableValues returns the values of the old secret that can be reused for
+// data keys whose placeholder is unchanged since they were resolved. Values
+// are reusable only if the old secret provenance records the same placeholder
+// and the old value was actually mutated.
+func reusableValues(secret corev1.Secret, old corev1.Secret) (map[string]reusedValue, error) {
+	provenance, err := ParseProvenance(old)
+	if err != nil {
+		return nil, err
+	}
+
+	reusable := map[string]reusedValue{}
+	for key, value := range secret.Data {
+		p, ok := provenance[key]
+		if !ok || p.Placeholder != string(value) {
+			continue
+		}
+
+		oldValue, ok := old.Data[key]
+		if !ok || bytes.Equal(oldValue, value) {
+			continue
+		}
+
+		reusable[key] = reusedValue{Value: oldValue, Provenance: p}
+	}
+
+	return reusable, nil
+}
+
+// mergeProvenance returns the provenance of mutated data keys merged with the
+// provenance recorded on the old secret for keys not mutated by this request
+// whose value is unchanged. This keeps provenance on updates that don't send
+// placeholders again, such as a label change, and drops it for keys replaced
+// by plaintext values. Provenance sent by clients is never trusted, so that
+// plaintext values can't be passed off as resolved, except on updates by the
+// resync reconciler with a content hash matching their data.
+func mergeProvenance(secret corev1.Secret, old *corev1.Secret, mutated map[string]Provenance, resync bool) (map[string]Provenance, error) {
+	merged := map[string]Provenance{}
+
+	if old != nil {
+		recorded, err := ParseProvenance(*old)
+		if err != nil {
+			return nil, err
+		}
+		for key, p := range recorded {
+			value, ok := secret.Data[key]
+			if ok && bytes.Equal(old.Data[key], value) {
+				merged[key] = p
+			}
+		}
+	}
+
+	if resync && secret.Annotations[AnnotationContentHash] == ContentHash(secret.Data) {
+		recorded, err := ParseProvenance(secret)
+		if err != nil {
+			return nil, err
+		}
+		for key, p := range recorded {
+			if _, ok := secret.Data[key]; ok {
+				merged[key] = p
+			}
+		}
+	}
+
+	for key, p := range mutated {
+		merged[key] = p
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// provenanceSecret returns a secret with data and provenance annotation
+func provenanceSecret(t *testing.T, data map[string]string, provenance map[string]Provenance) corev1.Secret {
+	secret := corev1.Secret{Data: map[string][]byte{}}
+	secret.Name = "test-secret"
+	secret.Namespace = "test-namespace"
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+	}
+
+	if provenance != nil {
+		raw, err := json.Marshal(provenance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret.Annotations = map[string]string{AnnotationProvenance: string(raw)}
+	}
+
+	return secret
+}
+
+func TestReusableValues(t *testing.T) {
+
+	resolvedAt := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	dbPassword := Provenance{Placeholder: "vault:db#password", Path: "secret/data/db", Key: "password", Version: 2, ResolvedAt: resolvedAt}
+	dbUser := Provenance{Placeholder: "vault:db#user", Path: "secret/data/db", Key: "user", Version: 2, ResolvedAt: resolvedAt}
+
+	var reuseTests = []struct {
+		description string
+		secret      map[string]string
+		old         corev1.Secret
+		reusable    map[string]reusedValue
+	}{
+		{
+			"Test unchanged placeholders are reused",
+			map[string]string{"password": "vault:db#password", "user": "vault:db#user"},
+			provenanceSecret(t, map[string]string{"password": "pass", "user": "admin"}, map[string]Provenance{"password": dbPassword, "user": dbUser}),
+			map[string]reusedValue{"password": {Value: []byte("pass"), Provenance: dbPassword}, "user": {Value: []byte("admin"), Provenance: dbUser}},
+		},
+		{
+			"Test changed placeholder is not reused",
+			map[string]string{"password": "vault:db#password", "user": "vault:db#login"},
+			provenanceSecret(t, map[string]string{"password": "pass", "user": "admin"}, map[string]Provenance{"password": dbPassword, "user": dbUser}),
+			map[string]reusedValue{"password": {Value: []byte("pass"), Provenance: dbPassword}},
+		},
+		{
+			"Test new data key is not reused",
+			map[string]string{"password": "vault:db#password", "token": "vault:db#token"},
+			provenanceSecret(t, map[string]string{"password": "pass"}, map[string]Provenance{"password": dbPassword}),
+			map[string]reusedValue{"password": {Value: []byte("pass"), Provenance: dbPassword}},
+		},
+		{
+			"Test old secret without provenance",
+			map[string]string{"password": "vault:db#password"},
+			provenanceSecret(t, map[string]string{"password": "pass"}, nil),
+			map[string]reusedValue{},
+		},
+		{
+			"Test old value still a placeholder",
+			map[string]string{"password": "vault:db#password"},
+			provenanceSecret(t, map[string]string{"password": "vault:db#password"}, map[string]Provenance{"password": dbPassword}),
+			map[string]reusedValue{},
+		},
+	}
+
+	for _, test := range reuseTests {
+		secret := provenanceSecret(t, test.secret, nil)
+
+		reusable, err := reusableValues(secret, test.old)
+		require.Nil(t, err, test.description)
+		require.Equal(t, test.reusable, reusable, test.description)
+	}
+}
+
+func TestMergeProvenance(t *testing.T) {
+
+	resolvedAt := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	dbPassword := Provenance{Placeholder: "vault:db#password", Path: "secret/data/db", Key: "password", ResolvedAt: resolvedAt}
+	dbUser := Provenance{Placeholder: "vault:db#user", Path: "secret/data/db", Key: "user", ResolvedAt: resolvedAt}
+	recorded := map[string]Provenance{"password": dbPassword, "user": dbUser}
+	old := provenanceSecret(t, map[string]string{"password": "pass", "user": "admin"}, recorded)
+
+	// Label change keeps resolved values and provenance
+	secret := provenanceSecret(t, map[string]string{"password": "pass", "user": "admin"}, recorded)
+	merged, err := mergeProvenance(secret, &old, map[string]Provenance{}, false)
+	require.Nil(t, err)
+	require.Equal(t, recorded, merged, "Test unchanged values keep provenance")
+
+	// Plaintext value replacing a resolved value drops its provenance
+	secret = provenanceSecret(t, map[string]string{"password": "pass", "user": "plaintext"}, recorded)
+	merged, err = mergeProvenance(secret, &old, map[string]Provenance{}, false)
+	require.Nil(t, err)
+	require.Equal(t, map[string]Provenance{"password": dbPassword}, merged, "Test plaintext value drops provenance")
+
+	// Changed value with a matching content hash keeps its provenance on
+	// resync only, clients can compute the hash of forged values
+	secret = provenanceSecret(t, map[string]string{"password": "pass", "user": "rotated"}, recorded)
+	secret.Annotations[AnnotationContentHash] = ContentHash(secret.Data)
+	merged, err = mergeProvenance(secret, &old, map[string]Provenance{}, true)
+	require.Nil(t, err)
+	require.Equal(t, recorded, merged, "Test hashed value keeps provenance on resync")
+
+	merged, err = mergeProvenance(secret, &old, map[string]Provenance{}, false)
+	require.Nil(t, err)
+	require.Equal(t, map[string]Provenance{"password": dbPassword}, merged, "Test hashed value drops provenance")
+
+	// Provenance of created secrets is never trusted
+	merged, err = mergeProvenance(secret, nil, map[string]Provenance{}, false)
+	require.Nil(t, err)
+	require.Equal(t, map[string]Provenance{}, merged, "Test forged provenance on create")
+
+	// Removed data key drops its provenance, mutated keys are updated
+	newUser := Provenance{Placeholder: "vault:db#login", Path: "secret/data/db", Key: "login", ResolvedAt: resolvedAt}
+	secret = provenanceSecret(t, map[string]string{"user": "vault:db#login"}, recorded)
+	merged, err = mergeProvenance(secret, &old, map[string]Provenance{"user": newUser}, false)
+	require.Nil(t, err)
+	require.Equal(t, map[string]Provenance{"user": newUser}, merged, "Test removed key and mutated key")
+}
+
+func TestServer_mutateSecretDataReuseOnUpdate(t *testing.T) {
+
+	resolvedAt := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	dbPassword := Provenance{Placeholder: "vault:db#password", Path: "secret/data/test-namespace/db", Key: "password", Version: 2, ResolvedAt: resolvedAt}
+	dbUser := Provenance{Placeholder: "vault:db#user", Path: "secret/data/test-namespace/db", Key: "user", Version: 2, ResolvedAt: resolvedAt}
+	old := provenanceSecret(t, map[string]string{"password": "old-pass", "user": "old-admin"}, map[string]Provenance{"password": dbPassword, "user": dbUser})
+
+	s := Server{
+		Vault:         fakeVersionVaultClient{Values: map[string]string{"secret/data/test-namespace/db#login": "new-login"}},
+		VaultPattern:  "secret/data/{{.Namespace}}/{{.Secret}}",
+		Provenance:    true,
+		ReuseOnUpdate: true,
+		Logger:        logrus.New(),
+	}
+
+	// Unchanged placeholder is reused, changed one is read from Vault
+	secret := provenanceSecret(t, map[string]string{"password": "vault:db#password", "user": "vault:db#login"}, nil)
+	secret.Annotations = old.Annotations
+	result, err := s.mutateSecretData(secret, mutateOptions{OldSecret: &old})
+	require.Nil(t, err)
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/password", Value: "b2xkLXBhc3M="}, result.Patch[0], "Test unchanged placeholder reused")
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/user", Value: "bmV3LWxvZ2lu"}, result.Patch[1], "Test changed placeholder read from vault")
+	require.Equal(t, `{"password":"secret/data/test-namespace/db#password"}`, result.AuditAnnotations[auditAnnotationReused], "Test reused audit annotation")
+	require.Equal(t, `{"user":"secret/data/test-namespace/db#login"}`, result.AuditAnnotations[auditAnnotationReads], "Test reads audit annotation")
+
+	var provenance map[string]Provenance
+	require.Nil(t, json.Unmarshal([]byte(result.Patch[2].Value.(string)), &provenance))
+	require.Equal(t, dbPassword, provenance["password"], "Test reused value keeps its provenance")
+	require.Equal(t, "vault:db#login", provenance["user"].Placeholder, "Test changed value has new provenance")
+
+	// Placeholder resolving to another path after a pattern change is read again
+	s.VaultPattern = "secret/data/{{.Secret}}"
+	s.Vault = fakeVersionVaultClient{Values: map[string]string{"secret/data/db#password": "new-pass"}}
+	secret = provenanceSecret(t, map[string]string{"password": "vault:db#password"}, nil)
+	result, err = s.mutateSecretData(secret, mutateOptions{OldSecret: &old})
+	require.Nil(t, err)
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/password", Value: "bmV3LXBhc3M="}, result.Patch[0], "Test pattern change read from vault")
+
+	// Reuse is opt-in
+	s.ReuseOnUpdate = false
+	s.VaultPattern = "secret/data/{{.Namespace}}/{{.Secret}}"
+	s.Vault = fakeVersionVaultClient{Values: map[string]string{"secret/data/test-namespace/db#password": "new-pass"}}
+	result, err = s.mutateSecretData(secret, mutateOptions{OldSecret: &old})
+	require.Nil(t, err)
+	require.Equal(t, patchOperation{Op: "replace", Path: "/data/password", Value: "bmV3LXBhc3M="}, result.Patch[0], "Test reuse disabled")
+}
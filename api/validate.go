@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LabelVaultOnly is the default namespace label enabling rejection of
+// plaintext secrets when set to "true"
+const LabelVaultOnly = annotationPrefix + "vault-only"
+
+// DefaultVaultOnlyIgnoreTypes are secret types managed by Kubernetes or
+// tooling that are never rejected as plaintext
+var DefaultVaultOnlyIgnoreTypes = []string{
+	string(corev1.SecretTypeServiceAccountToken),
+	"helm.sh/release.v1",
+}
+
+func (s *Server) validateHandler(w http.ResponseWriter, r *http.Request) {
+
+	logger := s.Logger.WithField("handler", "validate")
+	logger.Debug("request received, handling")
+
+	review, logger, ok := s.readSecretReview(w, r, logger, validationFailed, validationIgnored)
+	if !ok {
+		return
+	}
+	admissionReview := review.Review
+
+	// Secrets breaking a validation rule are denied, internal errors
+	// are reported as webhook failures
+	err := s.validateSecret(r.Context(), review.Secret, review.DryRun)
+	var denial admissionError
+	if errors.As(err, &denial) {
+		logger.WithError(err).Warn("secret rejected")
+		s.sendAdmissionReviewDenied(w, admissionReview, denial)
+		secretRejected.Inc()
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("failed to validate secret")
+		s.sendAdmissionReviewError(w, admissionReview, err)
+		validationFailed.Inc()
+		return
+	}
+
+	admissionReview.Response = &admission.AdmissionResponse{
+		UID:     admissionReview.Request.UID,
+		Allowed: true,
+	}
+	s.sendAdmissionReview(w, admissionReview)
+	secretValidated.Inc()
+}
+
+// validateSecret returns an admissionError if a secret still contains
+// Vault placeholders after mutation, or contains plaintext values in a
+// Vault-only namespace
+func (s *Server) validateSecret(ctx context.Context, secret corev1.Secret, dryRun bool) error {
+
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Placeholders are left unchanged by the mutating webhook on dry-run
+	// requests, they are only unresolved if the mutating webhook was bypassed
+	if s.ValidateUnresolved && !dryRun {
+		for _, key := range keys {
+			if _, ok, _ := s.parseSchemePlaceholder(string(secret.Data[key])); ok {
+				return denied(http.StatusForbidden, metav1.StatusReasonForbidden, "secret data key '%s' contains an unresolved vault placeholder", key)
+			}
+		}
+	}
+
+	if !s.ValidateVaultOnly {
+		return nil
+	}
+
+	vaultOnly, err := s.vaultOnlyNamespace(ctx, secret.Namespace)
+	if err != nil {
+		return err
+	}
+	if !vaultOnly {
+		return nil
+	}
+
+	plaintext := s.plaintextKeys(secret, keys, dryRun)
+	if len(plaintext) > 0 {
+		return denied(http.StatusForbidden, metav1.StatusReasonForbidden, "namespace '%s' only allows values from vault, secret data keys '%s' are plaintext", secret.Namespace, strings.Join(plaintext, "', '"))
+	}
+
+	return nil
+}
+
+// vaultOnlyNamespace returns true if a namespace has the Vault-only label
+func (s *Server) vaultOnlyNamespace(ctx context.Context, name string) (bool, error) {
+	if s.Kubernetes == nil {
+		return false, fmt.Errorf("kubernetes client is required to read namespace labels")
+	}
+
+	namespace, err := s.Kubernetes.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get namespace %q: %s", name, err)
+	}
+
+	label := s.VaultOnlyLabel
+	if label == "" {
+		label = LabelVaultOnly
+	}
+
+	return namespace.Labels[label] == "true", nil
+}
+
+// plaintextKeys returns the secret data keys that were neither resolved from
+// Vault, as recorded by provenance, nor valid placeholders to be resolved.
+// Provenance is only trusted if the content hash matches the secret data,
+// except on dry-run requests where the mutating webhook left placeholders
+// unchanged.
+func (s *Server) plaintextKeys(secret corev1.Secret, keys []string, dryRun bool) []string {
+	for _, t := range s.VaultOnlyIgnoreTypes {
+		if string(secret.Type) == t {
+			return nil
+		}
+	}
+
+	provenance, err := ParseProvenance(secret)
+	if err != nil || (!dryRun && secret.Annotations[AnnotationContentHash] != ContentHash(secret.Data)) {
+		provenance = nil
+	}
+
+	plaintext := []string{}
+	for _, key := range keys {
+		if _, ok := provenance[key]; ok {
+			continue
+		}
+		if _, ok, err := s.parseSchemePlaceholder(string(secret.Data[key])); ok && err == nil {
+			continue
+		}
+		plaintext = append(plaintext, key)
+	}
+
+	return plaintext
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestServer_validateSecret(t *testing.T) {
+
+	resolvedAt := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	dbPassword := Provenance{Placeholder: "vault:db#password", Path: "secret/data/db", Key: "password", ResolvedAt: resolvedAt}
+
+	// Secret resolved by the mutating webhook with a matching content hash
+	resolved := provenanceSecret(t, map[string]string{"password": "pass"}, map[string]Provenance{"password": dbPassword})
+	resolved.Annotations[AnnotationContentHash] = ContentHash(resolved.Data)
+
+	// Secret with a plaintext value added since mutation
+	tampered := provenanceSecret(t, map[string]string{"password": "pass", "token": "plain"}, map[string]Provenance{"password": dbPassword})
+	tampered.Annotations[AnnotationContentHash] = resolved.Annotations[AnnotationContentHash]
+
+	serviceAccountToken := provenanceSecret(t, map[string]string{"token": "plain"}, nil)
+	serviceAccountToken.Type = corev1.SecretTypeServiceAccountToken
+
+	var validateTests = []struct {
+		description string
+		secret      corev1.Secret
+		dryRun      bool
+		vaultOnly   bool
+		denied      bool
+	}{
+		{"Test resolved secret is allowed", resolved, false, true, false},
+		{"Test unresolved placeholder is rejected", provenanceSecret(t, map[string]string{"password": "vault:db#password"}, nil), false, false, true},
+		{"Test malformed placeholder is rejected", provenanceSecret(t, map[string]string{"password": "vault:db"}, nil), false, false, true},
+		{"Test malformed placeholder is plaintext on dry-run", provenanceSecret(t, map[string]string{"password": "vault:db"}, nil), true, true, true},
+		{"Test placeholder is allowed on dry-run", provenanceSecret(t, map[string]string{"password": "vault:db#password"}, nil), true, true, false},
+		{"Test plaintext secret is allowed in other namespaces", provenanceSecret(t, map[string]string{"token": "plain"}, nil), false, false, false},
+		{"Test plaintext secret is rejected in vault-only namespace", provenanceSecret(t, map[string]string{"token": "plain"}, nil), false, true, true},
+		{"Test plaintext value with stale content hash is rejected", tampered, false, true, true},
+		{"Test ignored secret type is allowed", serviceAccountToken, false, true, false},
+	}
+
+	for _, test := range validateTests {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace"}}
+		if test.vaultOnly {
+			namespace.Labels = map[string]string{LabelVaultOnly: "true"}
+		}
+
+		s := Server{
+			Kubernetes:           fake.NewSimpleClientset(namespace),
+			ValidateUnresolved:   true,
+			ValidateVaultOnly:    true,
+			VaultOnlyIgnoreTypes: DefaultVaultOnlyIgnoreTypes,
+			Logger:               logrus.New(),
+		}
+
+		err := s.validateSecret(context.Background(), test.secret, test.dryRun)
+		if !test.denied {
+			require.Nil(t, err, test.description)
+			continue
+		}
+
+		var denial admissionError
+		require.True(t, errors.As(err, &denial), test.description)
+		require.Equal(t, int32(http.StatusForbidden), denial.code, test.description)
+	}
+
+	// Unknown namespace is an internal error
+	s := Server{Kubernetes: fake.NewSimpleClientset(), ValidateVaultOnly: true, Logger: logrus.New()}
+	err := s.validateSecret(context.Background(), resolved, false)
+	require.NotNil(t, err)
+	require.False(t, errors.As(err, &admissionError{}), "Test namespace read error is not a denial")
+}
+
+func TestServer_validateHandler(t *testing.T) {
+
+	s := Server{
+		ValidateUnresolved: true,
+		Logger:             logrus.New(),
+	}
+
+	var handlerTests = []struct {
+		description string
+		secret      string
+		allowed     bool
+	}{
+		{
+			"Test resolved secret is allowed",
+			`{"apiVersion":"v1","kind":"Secret","metadata":{"name":"test-secret","namespace":"test-namespace"},"data":{"foo":"YmFy"},"type":"Opaque"}`,
+			true,
+		},
+		{
+			"Test unresolved secret is rejected",
+			`{"apiVersion":"v1","kind":"Secret","metadata":{"name":"test-secret","namespace":"test-namespace"},"data":{"foo":"dmF1bHQ6Zm9vI2Jhcg=="},"type":"Opaque"}`,
+			false,
+		},
+	}
+
+	for _, test := range handlerTests {
+		req := httptest.NewRequest(http.MethodPost, "/validate/secret", strings.NewReader(admissionReviewJSON("Secret", test.secret)))
+		rec := httptest.NewRecorder()
+		s.Router().ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, test.description)
+
+		var review admission.AdmissionReview
+		require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &review), test.description)
+		require.Equal(t, "705ab4f5-6393-11e8-b7cc-42010a800002", string(review.Response.UID), test.description)
+		require.Equal(t, test.allowed, review.Response.Allowed, test.description)
+		require.Nil(t, review.Response.Patch, test.description)
+	}
+}
@@ -0,0 +1,103 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// copyStringMap returns a copy of a string map, nil if in is nil
+func copyStringMap(in map[string]string) map[string]string {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string]string, len(in))
+	for key, value := range in {
+		out[key] = value
+	}
+	return out
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *VaultSecret) DeepCopyInto(out *VaultSecret) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy returns a copy of the receiver
+func (in *VaultSecret) DeepCopy() *VaultSecret {
+	if in == nil {
+		return nil
+	}
+	out := new(VaultSecret)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a copy of the receiver as a runtime.Object
+func (in *VaultSecret) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *VaultSecretSpec) DeepCopyInto(out *VaultSecretSpec) {
+	*out = *in
+	out.Data = copyStringMap(in.Data)
+	in.Template.DeepCopyInto(&out.Template)
+	if in.RefreshInterval != nil {
+		out.RefreshInterval = new(metav1.Duration)
+		*out.RefreshInterval = *in.RefreshInterval
+	}
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *SecretTemplate) DeepCopyInto(out *SecretTemplate) {
+	*out = *in
+	out.Labels = copyStringMap(in.Labels)
+	out.Annotations = copyStringMap(in.Annotations)
+	out.StringData = copyStringMap(in.StringData)
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *VaultSecretStatus) DeepCopyInto(out *VaultSecretStatus) {
+	*out = *in
+	if in.LastRefreshTime != nil {
+		out.LastRefreshTime = in.LastRefreshTime.DeepCopy()
+	}
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *VaultSecretList) DeepCopyInto(out *VaultSecretList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]VaultSecret, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy returns a copy of the receiver
+func (in *VaultSecretList) DeepCopy() *VaultSecretList {
+	if in == nil {
+		return nil
+	}
+	out := new(VaultSecretList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a copy of the receiver as a runtime.Object
+func (in *VaultSecretList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
@@ -0,0 +1,23 @@
+// Package v1alpha1 contains the VaultSecret custom resource definition of the
+// k8s-vault-webhook.ouest-france.fr API group
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is the API group and version of VaultSecret resources
+	GroupVersion = schema.GroupVersion{Group: "k8s-vault-webhook.ouest-france.fr", Version: "v1alpha1"}
+
+	// SchemeBuilder registers VaultSecret types in a scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds VaultSecret types to a scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	SchemeBuilder.Register(&VaultSecret{}, &VaultSecretList{})
+}
@@ -0,0 +1,72 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition types and reasons published in VaultSecret status
+const (
+	// ConditionReady is true when the target Secret is in sync with Vault
+	ConditionReady = "Ready"
+
+	ReasonSynced           = "Synced"
+	ReasonInvalidReference = "InvalidReference"
+	ReasonVaultError       = "VaultError"
+	ReasonSecretConflict   = "SecretConflict"
+	ReasonSecretError      = "SecretError"
+)
+
+// VaultSecret is reconciled into an owned Secret with values read from Vault
+type VaultSecret struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VaultSecretSpec   `json:"spec,omitempty"`
+	Status VaultSecretStatus `json:"status,omitempty"`
+}
+
+// VaultSecretSpec describes the target Secret and its Vault references
+type VaultSecretSpec struct {
+	// Data maps target Secret data keys to Vault references of the form
+	// "vault:path#key" or "vault@endpoint:path#key", paths are templated with
+	// the vault pattern and references routed like webhook placeholders
+	Data map[string]string `json:"data"`
+
+	// Template of the target Secret
+	Template SecretTemplate `json:"template,omitempty"`
+
+	// RefreshInterval is the interval Vault values are read again at,
+	// values are only read on changes if empty
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
+}
+
+// SecretTemplate describes the target Secret besides Vault values
+type SecretTemplate struct {
+	// Name of the target Secret, the VaultSecret name if empty
+	Name string `json:"name,omitempty"`
+
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Type        corev1.SecretType `json:"type,omitempty"`
+
+	// StringData are plaintext values added to the target Secret,
+	// overridden by Vault values with the same key
+	StringData map[string]string `json:"stringData,omitempty"`
+}
+
+// VaultSecretStatus is the observed state of a VaultSecret
+type VaultSecretStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	SecretName         string             `json:"secretName,omitempty"`
+	LastRefreshTime    *metav1.Time       `json:"lastRefreshTime,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// VaultSecretList is a list of VaultSecret
+type VaultSecretList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []VaultSecret `json:"items"`
+}
@@ -0,0 +1,203 @@
+package awsstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Ouest-France/k8s-vault-webhook/vault"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// requestTimeout is the timeout of AWS API requests
+const requestTimeout = 10 * time.Second
+
+// LoadConfig returns an AWS configuration with credentials of the default
+// chain, such as web identity tokens of IAM roles for service accounts
+// (IRSA) or environment variables, region is read from the environment if
+// empty
+func LoadConfig(region string) (aws.Config, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	opts := []func(*config.LoadOptions) error{}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load aws configuration: %s", err)
+	}
+
+	return cfg, nil
+}
+
+// SecretsManager reads keys of JSON secrets from AWS Secrets Manager,
+// placeholders are "awssm:<secret name>#<json key>"
+type SecretsManager struct {
+	Client  *secretsmanager.Client
+	Pattern string
+}
+
+// NewSecretsManager returns a Secrets Manager resolver, requests are sent to
+// endpoint instead of the regional endpoint if not empty. Secret names are
+// templated with pattern.
+func NewSecretsManager(cfg aws.Config, endpoint, pattern string) SecretsManager {
+	client := secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		if endpoint != "" {
+			o.EndpointResolver = secretsmanager.EndpointResolverFromURL(endpoint)
+		}
+	})
+
+	return SecretsManager{Client: client, Pattern: pattern}
+}
+
+// Read returns the value of a key of a JSON secret, missing secrets and keys
+// return a fallback value with a vault.FallbackError as the Vault client does
+func (c SecretsManager) Read(name, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	output, err := c.Client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+	var notFound *smtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return fallback("secret %q does not exist in AWS Secrets Manager", name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %q in AWS Secrets Manager: %s", name, err)
+	}
+	if output.SecretString == nil {
+		return "", fmt.Errorf("secret %q in AWS Secrets Manager is not a string secret", name)
+	}
+
+	data := map[string]interface{}{}
+	err = json.Unmarshal([]byte(aws.ToString(output.SecretString)), &data)
+	if err != nil {
+		return "", fmt.Errorf("secret %q in AWS Secrets Manager is not a JSON object: %s", name, err)
+	}
+
+	value, ok := data[key]
+	if !ok || value == nil {
+		return fallback("key %q not found in AWS Secrets Manager", key)
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+
+	return fallback("key %q is not a string in AWS Secrets Manager", key)
+}
+
+// Exists returns true if a secret exists, by describing it so that secret
+// values are never retrieved
+func (c SecretsManager) Exists(name string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := c.Client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(name)})
+	var notFound *smtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to describe secret %q in AWS Secrets Manager: %s", name, err)
+	}
+
+	return true, nil
+}
+
+// PathPattern returns the pattern secret names are templated with
+func (c SecretsManager) PathPattern() string {
+	return c.Pattern
+}
+
+// ParameterStore reads parameters from AWS Systems Manager Parameter Store,
+// decrypting SecureString parameters, placeholders are "ssm:<parameter>"
+type ParameterStore struct {
+	Client  *ssm.Client
+	Pattern string
+}
+
+// NewParameterStore returns a Parameter Store resolver, requests are sent to
+// endpoint instead of the regional endpoint if not empty. Parameter names
+// are templated with pattern.
+func NewParameterStore(cfg aws.Config, endpoint, pattern string) ParameterStore {
+	client := ssm.NewFromConfig(cfg, func(o *ssm.Options) {
+		if endpoint != "" {
+			o.EndpointResolver = ssm.EndpointResolverFromURL(endpoint)
+		}
+	})
+
+	return ParameterStore{Client: client, Pattern: pattern}
+}
+
+// Read returns the value of a parameter, key is always empty as parameters
+// hold a single value. Missing parameters return a fallback value with a
+// vault.FallbackError as the Vault client does.
+func (c ParameterStore) Read(name, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	output, err := c.Client.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+	var notFound *ssmtypes.ParameterNotFound
+	if errors.As(err, &notFound) {
+		return fallback("parameter %q does not exist in AWS Parameter Store", name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read parameter %q in AWS Parameter Store: %s", name, err)
+	}
+	if output.Parameter == nil {
+		return "", fmt.Errorf("failed to read parameter %q in AWS Parameter Store: no parameter returned", name)
+	}
+
+	return aws.ToString(output.Parameter.Value), nil
+}
+
+// Exists returns true if a parameter exists, by describing it so that
+// parameter values are never retrieved
+func (c ParameterStore) Exists(name string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	output, err := c.Client.DescribeParameters(ctx, &ssm.DescribeParametersInput{
+		ParameterFilters: []ssmtypes.ParameterStringFilter{{
+			Key:    aws.String("Name"),
+			Option: aws.String("Equals"),
+			Values: []string{name},
+		}},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to describe parameter %q in AWS Parameter Store: %s", name, err)
+	}
+
+	return len(output.Parameters) > 0, nil
+}
+
+// PathPattern returns the pattern parameter names are templated with
+func (c ParameterStore) PathPattern() string {
+	return c.Pattern
+}
+
+// Keyless returns true as placeholders reference parameters without key
+func (c ParameterStore) Keyless() bool {
+	return true
+}
+
+// fallback returns a message as fallback value with a vault.FallbackError
+func fallback(format string, a ...interface{}) (string, error) {
+	msg := fmt.Sprintf(format, a...)
+	return msg, vault.FallbackError{Message: msg}
+}
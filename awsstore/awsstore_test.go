@@ -0,0 +1,169 @@
+package awsstore
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Ouest-France/k8s-vault-webhook/vault"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAWS returns a fake AWS JSON API server answering operations of the
+// X-Amz-Target header with the handler of the request name
+func fakeAWS(t *testing.T, handlers map[string]func(input map[string]interface{}) (int, interface{})) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// Requests must be signed with the configured credentials
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKIDTEST/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		handler, ok := handlers[r.Header.Get("X-Amz-Target")]
+		if !ok {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		input := map[string]interface{}{}
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&input))
+
+		status, output := handler(input)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(status)
+		require.Nil(t, json.NewEncoder(w).Encode(output))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// notFound returns an AWS JSON API error of type errorType
+func notFound(errorType string) (int, interface{}) {
+	return http.StatusBadRequest, map[string]string{"__type": errorType, "message": "not found"}
+}
+
+// testConfig returns an AWS configuration with static credentials
+func testConfig() aws.Config {
+	return aws.Config{
+		Region:      "eu-west-3",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDTEST", "secret", ""),
+	}
+}
+
+func TestSecretsManager_Read(t *testing.T) {
+
+	secrets := map[string]string{
+		"prod/db":    `{"password": "s3cr3t", "port": 5432, "nested": {"key": "value"}}`,
+		"prod/plain": "not json",
+	}
+	server := fakeAWS(t, map[string]func(map[string]interface{}) (int, interface{}){
+		"secretsmanager.GetSecretValue": func(input map[string]interface{}) (int, interface{}) {
+			secret, ok := secrets[input["SecretId"].(string)]
+			if !ok {
+				return notFound("ResourceNotFoundException")
+			}
+			return http.StatusOK, map[string]string{"Name": input["SecretId"].(string), "SecretString": secret}
+		},
+		"secretsmanager.DescribeSecret": func(input map[string]interface{}) (int, interface{}) {
+			if _, ok := secrets[input["SecretId"].(string)]; !ok {
+				return notFound("ResourceNotFoundException")
+			}
+			return http.StatusOK, map[string]string{"Name": input["SecretId"].(string)}
+		},
+	})
+
+	c := NewSecretsManager(testConfig(), server.URL, "{{.Secret}}")
+
+	var readTests = []struct {
+		description string
+		name        string
+		key         string
+		value       string
+		fallback    bool
+		errorString string
+	}{
+		{"Test string key", "prod/db", "password", "s3cr3t", false, ""},
+		{"Test number key", "prod/db", "port", "5432", false, ""},
+		{"Test nested key", "prod/db", "nested", `key "nested" is not a string in AWS Secrets Manager`, true, ""},
+		{"Test missing key", "prod/db", "user", `key "user" not found in AWS Secrets Manager`, true, ""},
+		{"Test missing secret", "prod/other", "password", `secret "prod/other" does not exist in AWS Secrets Manager`, true, ""},
+		{"Test secret not json", "prod/plain", "password", "", false, `secret "prod/plain" in AWS Secrets Manager is not a JSON object`},
+	}
+
+	for _, test := range readTests {
+		value, err := c.Read(test.name, test.key)
+		require.Equal(t, test.value, value, test.description)
+		if test.fallback {
+			var fallback vault.FallbackError
+			require.True(t, errors.As(err, &fallback), test.description)
+			continue
+		}
+		if test.errorString != "" {
+			require.Contains(t, err.Error(), test.errorString, test.description)
+			continue
+		}
+		require.Nil(t, err, test.description)
+	}
+
+	exists, err := c.Exists("prod/db")
+	require.Nil(t, err)
+	require.True(t, exists, "Test existing secret")
+	exists, err = c.Exists("prod/other")
+	require.Nil(t, err)
+	require.False(t, exists, "Test missing secret")
+
+	// Unsigned requests are rejected
+	c = NewSecretsManager(aws.Config{Region: "eu-west-3", Credentials: credentials.NewStaticCredentialsProvider("AKIDOTHER", "secret", "")}, server.URL, "")
+	_, err = c.Read("prod/db", "password")
+	var fallback vault.FallbackError
+	require.Error(t, err, "Test forbidden request")
+	require.False(t, errors.As(err, &fallback), "Test forbidden request has no fallback")
+}
+
+func TestParameterStore_Read(t *testing.T) {
+
+	parameters := map[string]string{"/prod/db/password": "s3cr3t"}
+	server := fakeAWS(t, map[string]func(map[string]interface{}) (int, interface{}){
+		"AmazonSSM.GetParameter": func(input map[string]interface{}) (int, interface{}) {
+			require.Equal(t, true, input["WithDecryption"], "Test parameters are decrypted")
+			value, ok := parameters[input["Name"].(string)]
+			if !ok {
+				return notFound("ParameterNotFound")
+			}
+			return http.StatusOK, map[string]interface{}{"Parameter": map[string]string{"Name": input["Name"].(string), "Type": "SecureString", "Value": value}}
+		},
+		"AmazonSSM.DescribeParameters": func(input map[string]interface{}) (int, interface{}) {
+			filter := input["ParameterFilters"].([]interface{})[0].(map[string]interface{})
+			name := filter["Values"].([]interface{})[0].(string)
+			found := []map[string]string{}
+			if _, ok := parameters[name]; ok {
+				found = append(found, map[string]string{"Name": name})
+			}
+			return http.StatusOK, map[string]interface{}{"Parameters": found}
+		},
+	})
+
+	c := NewParameterStore(testConfig(), server.URL, "{{.Secret}}")
+
+	value, err := c.Read("/prod/db/password", "")
+	require.Nil(t, err)
+	require.Equal(t, "s3cr3t", value, "Test parameter value")
+
+	value, err = c.Read("/prod/db/user", "")
+	var fallback vault.FallbackError
+	require.True(t, errors.As(err, &fallback), "Test missing parameter")
+	require.Equal(t, `parameter "/prod/db/user" does not exist in AWS Parameter Store`, value)
+
+	exists, err := c.Exists("/prod/db/password")
+	require.Nil(t, err)
+	require.True(t, exists, "Test existing parameter")
+	exists, err = c.Exists("/prod/db/user")
+	require.Nil(t, err)
+	require.False(t, exists, "Test missing parameter")
+}
@@ -0,0 +1,116 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// keyPair represent a parsed certificate with its PEM encoded certificate and key
+type keyPair struct {
+	Cert    *x509.Certificate
+	Key     *ecdsa.PrivateKey
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// generateCA returns a new self-signed CA valid for validity
+func generateCA(commonName string, validity time.Duration) (keyPair, error) {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	return generate(template, nil, validity)
+}
+
+// generateServing returns a new serving certificate for dnsNames signed by ca
+func generateServing(ca keyPair, dnsNames []string, validity time.Duration) (keyPair, error) {
+	if len(dnsNames) == 0 {
+		return keyPair{}, errors.New("at least one DNS name is required for serving certificate")
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:    dnsNames,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	return generate(template, &ca, validity)
+}
+
+// generate creates a key and a certificate from template, signed by parent
+// or self-signed if parent is nil
+func generate(template *x509.Certificate, parent *keyPair, validity time.Duration) (keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return keyPair{}, fmt.Errorf("failed to generate key: %s", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return keyPair{}, fmt.Errorf("failed to generate serial number: %s", err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-5 * time.Minute)
+	template.NotAfter = time.Now().Add(validity)
+
+	signerCert, signerKey := template, key
+	if parent != nil {
+		signerCert, signerKey = parent.Cert, parent.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		return keyPair{}, fmt.Errorf("failed to create certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return keyPair{}, fmt.Errorf("failed to marshal key: %s", err)
+	}
+
+	return parseKeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	)
+}
+
+// parseKeyPair parses the first PEM encoded certificate and EC key
+func parseKeyPair(certPEM, keyPEM []byte) (keyPair, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return keyPair{}, errors.New("no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return keyPair{}, fmt.Errorf("failed to parse certificate: %s", err)
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return keyPair{}, errors.New("no PEM key found")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return keyPair{}, fmt.Errorf("failed to parse key: %s", err)
+	}
+
+	// Only the first certificate is kept when certPEM is a bundle
+	return keyPair{Cert: cert, Key: key, CertPEM: pem.EncodeToMemory(certBlock), KeyPEM: keyPEM}, nil
+}
+
+// needsRenewal returns true if cert expires within renewBefore
+func needsRenewal(cert *x509.Certificate, renewBefore time.Duration) bool {
+	return time.Now().Add(renewBefore).After(cert.NotAfter)
+}
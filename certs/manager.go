@@ -0,0 +1,341 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// Secret keys holding certificates and keys
+	secretCert   = "tls.crt"
+	secretKey    = "tls.key"
+	secretCACert = "ca.crt"
+	secretCAKey  = "ca.key"
+
+	// syncInterval is the interval at which replicas reload the serving
+	// certificate from the Secret
+	syncInterval = 30 * time.Second
+
+	// rotateInterval is the interval at which the leader checks certificates expiry
+	rotateInterval = time.Hour
+)
+
+// Manager generates a CA and a serving certificate, stores them in a
+// Kubernetes Secret and injects the CA in the webhook configuration caBundle.
+// Only the elected leader writes the Secret and the webhook configuration,
+// all replicas serve the certificate stored in the Secret.
+type Manager struct {
+	Client            kubernetes.Interface
+	Namespace         string
+	SecretName        string
+	ServiceName       string
+	MutatingWebhook   string
+	ValidatingWebhook string
+	Validity          time.Duration
+	RenewBefore       time.Duration
+	Identity          string
+	Logger            *logrus.Logger
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Start runs leader election for certificates rotation and keeps the served
+// certificate in sync with the Secret until stop is closed
+func (m *Manager) Start(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	go m.runLeaderElection(ctx)
+
+	go func() {
+		ticker := time.NewTicker(syncInterval)
+		defer ticker.Stop()
+
+		for {
+			err := m.load(ctx)
+			if err != nil {
+				m.Logger.WithError(err).Warn("failed to load serving certificate from secret")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// GetCertificate returns the current serving certificate for tls.Config
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.cert == nil {
+		return nil, errors.New("serving certificate is not available yet")
+	}
+
+	return m.cert, nil
+}
+
+// runLeaderElection campaigns for leadership until ctx is done, the leader
+// rotates certificates as long as it holds the lease
+func (m *Manager) runLeaderElection(ctx context.Context) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      m.SecretName,
+			Namespace: m.Namespace,
+		},
+		Client:     m.Client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: m.Identity},
+	}
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   30 * time.Second,
+			RenewDeadline:   20 * time.Second,
+			RetryPeriod:     5 * time.Second,
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					m.Logger.Info("elected as certificates leader")
+					m.rotateLoop(ctx)
+				},
+				OnStoppedLeading: func() {
+					m.Logger.Info("stopped being certificates leader")
+				},
+			},
+		})
+	}
+}
+
+// rotateLoop reconciles certificates at startup and every rotateInterval
+func (m *Manager) rotateLoop(ctx context.Context) {
+	ticker := time.NewTicker(rotateInterval)
+	defer ticker.Stop()
+
+	for {
+		err := m.Reconcile(ctx)
+		if err != nil {
+			m.Logger.WithError(err).Error("failed to reconcile certificates")
+		} else if err := m.load(ctx); err != nil {
+			m.Logger.WithError(err).Warn("failed to load serving certificate from secret")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile generates missing or expiring certificates, stores them in the
+// Secret and injects the CA bundle in the webhook configuration
+func (m *Manager) Reconcile(ctx context.Context) error {
+
+	// Get current Secret, created if it doesn't exist
+	secret, err := m.Client.CoreV1().Secrets(m.Namespace).Get(ctx, m.SecretName, metav1.GetOptions{})
+	exists := true
+	if apierrors.IsNotFound(err) {
+		exists = false
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: m.SecretName, Namespace: m.Namespace},
+			Type:       corev1.SecretTypeTLS,
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to get secret %q: %s", m.SecretName, err)
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+
+	changed := false
+
+	// Generate a new CA if missing or expiring, previous CA is kept in
+	// bundle so certificates it signed stay trusted during rotation
+	bundle := secret.Data[secretCACert]
+	ca, err := parseKeyPair(secret.Data[secretCACert], secret.Data[secretCAKey])
+	if err != nil || needsRenewal(ca.Cert, m.RenewBefore) {
+		newCA, err := generateCA(fmt.Sprintf("%s.%s CA", m.ServiceName, m.Namespace), m.Validity)
+		if err != nil {
+			return fmt.Errorf("failed to generate CA: %s", err)
+		}
+		newBundle := newCA.CertPEM
+		if ca.Cert != nil && time.Now().Before(ca.Cert.NotAfter) {
+			newBundle = append(append([]byte{}, newBundle...), ca.CertPEM...)
+		}
+
+		m.Logger.Info("generated new CA certificate")
+		ca, bundle, changed = newCA, newBundle, true
+		secret.Data[secretCACert] = bundle
+		secret.Data[secretCAKey] = ca.KeyPEM
+	}
+
+	// Generate a new serving certificate if missing, expiring, not signed by
+	// current CA or not matching service names
+	serving, err := parseKeyPair(secret.Data[secretCert], secret.Data[secretKey])
+	if err != nil || needsRenewal(serving.Cert, m.RenewBefore) || serving.Cert.CheckSignatureFrom(ca.Cert) != nil || !matchNames(serving.Cert, m.dnsNames()) {
+		serving, err = generateServing(ca, m.dnsNames(), m.Validity)
+		if err != nil {
+			return fmt.Errorf("failed to generate serving certificate: %s", err)
+		}
+
+		m.Logger.Info("generated new serving certificate")
+		changed = true
+		secret.Data[secretCert] = serving.CertPEM
+		secret.Data[secretKey] = serving.KeyPEM
+	}
+
+	// Write Secret
+	if changed && exists {
+		_, err = m.Client.CoreV1().Secrets(m.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	} else if changed {
+		_, err = m.Client.CoreV1().Secrets(m.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write secret %q: %s", m.SecretName, err)
+	}
+
+	return m.injectCABundle(ctx, bundle)
+}
+
+// injectCABundle sets caBundle on all webhooks of the webhook configurations
+func (m *Manager) injectCABundle(ctx context.Context, bundle []byte) error {
+	err := m.injectMutatingCABundle(ctx, bundle)
+	if err != nil {
+		return err
+	}
+
+	return m.injectValidatingCABundle(ctx, bundle)
+}
+
+// injectMutatingCABundle sets caBundle on all webhooks of the mutating
+// webhook configuration
+func (m *Manager) injectMutatingCABundle(ctx context.Context, bundle []byte) error {
+	if m.MutatingWebhook == "" {
+		return nil
+	}
+
+	config, err := m.Client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, m.MutatingWebhook, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get mutating webhook configuration %q: %s", m.MutatingWebhook, err)
+	}
+
+	changed := false
+	for i := range config.Webhooks {
+		if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, bundle) {
+			config.Webhooks[i].ClientConfig.CABundle = bundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err = m.Client.AdmissionregistrationV1().MutatingWebhookConfigurations().Update(ctx, config, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to update mutating webhook configuration %q: %s", m.MutatingWebhook, err)
+	}
+	m.Logger.Infof("caBundle injected in mutating webhook configuration %q", m.MutatingWebhook)
+
+	return nil
+}
+
+// injectValidatingCABundle sets caBundle on all webhooks of the validating
+// webhook configuration
+func (m *Manager) injectValidatingCABundle(ctx context.Context, bundle []byte) error {
+	if m.ValidatingWebhook == "" {
+		return nil
+	}
+
+	config, err := m.Client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, m.ValidatingWebhook, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get validating webhook configuration %q: %s", m.ValidatingWebhook, err)
+	}
+
+	changed := false
+	for i := range config.Webhooks {
+		if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, bundle) {
+			config.Webhooks[i].ClientConfig.CABundle = bundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err = m.Client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Update(ctx, config, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to update validating webhook configuration %q: %s", m.ValidatingWebhook, err)
+	}
+	m.Logger.Infof("caBundle injected in validating webhook configuration %q", m.ValidatingWebhook)
+
+	return nil
+}
+
+// load reads the serving certificate from the Secret
+func (m *Manager) load(ctx context.Context) error {
+	secret, err := m.Client.CoreV1().Secrets(m.Namespace).Get(ctx, m.SecretName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get secret %q: %s", m.SecretName, err)
+	}
+
+	cert, err := tls.X509KeyPair(secret.Data[secretCert], secret.Data[secretKey])
+	if err != nil {
+		return fmt.Errorf("failed to load serving certificate: %s", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse serving certificate: %s", err)
+	}
+
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+
+	return nil
+}
+
+// dnsNames returns the service DNS names the serving certificate is valid for
+func (m *Manager) dnsNames() []string {
+	return []string{
+		fmt.Sprintf("%s.%s.svc", m.ServiceName, m.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", m.ServiceName, m.Namespace),
+		fmt.Sprintf("%s.%s", m.ServiceName, m.Namespace),
+		m.ServiceName,
+	}
+}
+
+// matchNames returns true if cert is valid for exactly names
+func matchNames(cert *x509.Certificate, names []string) bool {
+	if len(cert.DNSNames) != len(names) {
+		return false
+	}
+	for i := range names {
+		if cert.DNSNames[i] != names[i] {
+			return false
+		}
+	}
+
+	return true
+}
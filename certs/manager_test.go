@@ -0,0 +1,95 @@
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestManager_Reconcile(t *testing.T) {
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "k8s-vault-webhook"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "secrets.k8s-vault-webhook.webhook"}},
+	}, &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "k8s-vault-webhook-validate"},
+		Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "secrets.k8s-vault-webhook-validate.webhook"}},
+	})
+
+	m := &Manager{
+		Client:            client,
+		Namespace:         "vault",
+		SecretName:        "k8s-vault-webhook-certs",
+		ServiceName:       "k8s-vault-webhook",
+		MutatingWebhook:   "k8s-vault-webhook",
+		ValidatingWebhook: "k8s-vault-webhook-validate",
+		Validity:          24 * time.Hour,
+		RenewBefore:       time.Hour,
+		Logger:            logrus.New(),
+	}
+
+	// Certificates are generated on first reconcile
+	require.Nil(t, m.Reconcile(ctx), "Test first reconcile")
+
+	secret, err := client.CoreV1().Secrets("vault").Get(ctx, "k8s-vault-webhook-certs", metav1.GetOptions{})
+	require.Nil(t, err)
+	ca, err := parseKeyPair(secret.Data[secretCACert], secret.Data[secretCAKey])
+	require.Nil(t, err)
+	serving, err := parseKeyPair(secret.Data[secretCert], secret.Data[secretKey])
+	require.Nil(t, err)
+	require.True(t, ca.Cert.IsCA, "Test CA certificate generated")
+	require.Nil(t, serving.Cert.CheckSignatureFrom(ca.Cert), "Test serving certificate signed by CA")
+	require.Contains(t, serving.Cert.DNSNames, "k8s-vault-webhook.vault.svc", "Test serving certificate names")
+
+	config, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "k8s-vault-webhook", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, secret.Data[secretCACert], config.Webhooks[0].ClientConfig.CABundle, "Test caBundle injected")
+
+	validating, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "k8s-vault-webhook-validate", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, secret.Data[secretCACert], validating.Webhooks[0].ClientConfig.CABundle, "Test caBundle injected in validating webhook")
+
+	// Served certificate is loaded from secret
+	require.Nil(t, m.load(ctx))
+	cert, err := m.GetCertificate(nil)
+	require.Nil(t, err)
+	require.Equal(t, serving.Cert.SerialNumber, cert.Leaf.SerialNumber, "Test serving certificate loaded")
+
+	// Valid certificates are kept
+	require.Nil(t, m.Reconcile(ctx), "Test second reconcile")
+	unchanged, err := client.CoreV1().Secrets("vault").Get(ctx, "k8s-vault-webhook-certs", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, secret.Data, unchanged.Data, "Test valid certificates kept")
+
+	// Expiring certificates are rotated, previous CA stays in bundle
+	m.RenewBefore = 48 * time.Hour
+	require.Nil(t, m.Reconcile(ctx), "Test rotation reconcile")
+
+	rotated, err := client.CoreV1().Secrets("vault").Get(ctx, "k8s-vault-webhook-certs", metav1.GetOptions{})
+	require.Nil(t, err)
+	newCA, err := parseKeyPair(rotated.Data[secretCACert], rotated.Data[secretCAKey])
+	require.Nil(t, err)
+	newServing, err := parseKeyPair(rotated.Data[secretCert], rotated.Data[secretKey])
+	require.Nil(t, err)
+	require.NotEqual(t, ca.Cert.SerialNumber, newCA.Cert.SerialNumber, "Test CA rotated")
+	require.NotEqual(t, serving.Cert.SerialNumber, newServing.Cert.SerialNumber, "Test serving certificate rotated")
+
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(rotated.Data[secretCACert]))
+	_, err = serving.Cert.Verify(x509.VerifyOptions{Roots: pool, DNSName: "k8s-vault-webhook.vault.svc"})
+	require.Nil(t, err, "Test previous serving certificate still trusted by bundle")
+	_, err = newServing.Cert.Verify(x509.VerifyOptions{Roots: pool, DNSName: "k8s-vault-webhook.vault.svc"})
+	require.Nil(t, err, "Test new serving certificate trusted by bundle")
+
+	config, err = client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "k8s-vault-webhook", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, rotated.Data[secretCACert], config.Webhooks[0].ClientConfig.CABundle, "Test rotated caBundle injected")
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Ouest-France/k8s-vault-webhook/api"
+	"github.com/Ouest-France/k8s-vault-webhook/awsstore"
+	"github.com/Ouest-France/k8s-vault-webhook/filestore"
+	"github.com/Ouest-France/k8s-vault-webhook/vault"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// fileStoreWatchInterval is the polling interval of file store changes
+const fileStoreWatchInterval = 10 * time.Second
+
+// backendSchemes lists the placeholder schemes of backends that can be
+// enabled with the backends flag
+var backendSchemes = []string{api.SchemeVault, api.SchemeVaultTransit, api.SchemeFile, api.SchemeAWSSM, api.SchemeAWSSSM}
+
+// Backends resolving vault placeholders
+const (
+	vaultBackendVault = "vault"
+	vaultBackendFile  = "file"
+)
+
+// backendEnabled returns true if a backend is enabled with the backends flag
+func backendEnabled(scheme string) bool {
+	for _, backend := range viper.GetStringSlice("backends") {
+		if backend == scheme {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vaultRequired returns true if enabled backends or features use Vault,
+// vault placeholders may be read from files on development clusters
+func vaultRequired() bool {
+	if backendEnabled(api.SchemeVault) && viper.GetString("vault-backend") == vaultBackendVault {
+		return true
+	}
+
+	return backendEnabled(api.SchemeVaultTransit) || viper.GetBool("resync")
+}
+
+// fileStoreRequired returns true if enabled backends read the file store
+func fileStoreRequired() bool {
+	return backendEnabled(api.SchemeFile) || (backendEnabled(api.SchemeVault) && viper.GetString("vault-backend") == vaultBackendFile)
+}
+
+// checkBackends returns an error if an enabled backend is unknown or
+// misconfigured
+func checkBackends() error {
+	for _, backend := range viper.GetStringSlice("backends") {
+		known := false
+		for _, scheme := range backendSchemes {
+			if backend == scheme {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("backend %q is unknown, must be one of %s", backend, strings.Join(backendSchemes, ", "))
+		}
+	}
+
+	if viper.GetString("transit-mount") == "" {
+		return errors.New("transit-mount must not be empty")
+	}
+	if viper.GetString("transit-pattern") == "" {
+		return errors.New("transit-pattern must not be empty")
+	}
+
+	switch viper.GetString("vault-backend") {
+	case vaultBackendVault:
+	case vaultBackendFile:
+		if viper.GetBool("resync") {
+			return errors.New("resync requires vault-backend to be 'vault'")
+		}
+	default:
+		return fmt.Errorf("vault-backend is '%s', must be '%s' or '%s'", viper.GetString("vault-backend"), vaultBackendVault, vaultBackendFile)
+	}
+
+	if fileStoreRequired() && viper.GetString("file-root") == "" {
+		return errors.New("file-root is required with the file backend")
+	}
+
+	return nil
+}
+
+// newResolvers returns the resolvers of enabled backends by scheme, the file
+// store is loaded and watched for changes if a backend reads it
+func newResolvers(vc vault.Client, logger *logrus.Logger) (map[string]api.Resolver, error) {
+	var store *filestore.Store
+	if fileStoreRequired() {
+		var err error
+		store, err = filestore.New(viper.GetString("file-root"), logger)
+		if err != nil {
+			return nil, err
+		}
+		go store.Watch(fileStoreWatchInterval, nil)
+	}
+
+	// AWS backends share credentials of the default chain, such as IRSA
+	// web identity tokens
+	var awsConfig aws.Config
+	if backendEnabled(api.SchemeAWSSM) || backendEnabled(api.SchemeAWSSSM) {
+		var err error
+		awsConfig, err = awsstore.LoadConfig(viper.GetString("aws-region"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resolvers := map[string]api.Resolver{}
+	for _, backend := range viper.GetStringSlice("backends") {
+		switch backend {
+		case api.SchemeVault:
+			resolvers[backend] = vc
+			if viper.GetString("vault-backend") == vaultBackendFile {
+				resolvers[backend] = store
+			}
+		case api.SchemeVaultTransit:
+			resolvers[backend] = vault.TransitClient{Vault: vc, Mount: viper.GetString("transit-mount"), Pattern: viper.GetString("transit-pattern")}
+		case api.SchemeFile:
+			resolvers[backend] = store
+		case api.SchemeAWSSM:
+			resolvers[backend] = awsstore.NewSecretsManager(awsConfig, viper.GetString("aws-endpoint"), viper.GetString("awssm-pattern"))
+		case api.SchemeAWSSSM:
+			resolvers[backend] = awsstore.NewParameterStore(awsConfig, viper.GetString("aws-endpoint"), viper.GetString("ssm-pattern"))
+		}
+	}
+
+	return resolvers, nil
+}
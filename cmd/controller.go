@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/Ouest-France/k8s-vault-webhook/api"
+	"github.com/Ouest-France/k8s-vault-webhook/apis/v1alpha1"
+	"github.com/Ouest-France/k8s-vault-webhook/controller"
+	"github.com/Ouest-France/k8s-vault-webhook/vault"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// controllerCmd represents the controller command
+var controllerCmd = &cobra.Command{
+	Use:          "controller",
+	Short:        "Reconcile VaultSecret resources into Secrets with values read from Vault",
+	SilenceUsage: true,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+
+		// Flags share names with root command flags, they are bound
+		// here so that only the running command flags are read
+		err := viper.BindPFlags(cmd.Flags())
+		if err != nil {
+			return fmt.Errorf("failed to bind flags: %s", err)
+		}
+
+		for _, param := range []string{"vault-addr", "vault-token"} {
+			if viper.GetString(param) == "" {
+				return fmt.Errorf("required parameter %q is not defined", param)
+			}
+		}
+
+		if format := viper.GetString("logformat"); format != "text" && format != "json" {
+			return fmt.Errorf("logformat is '%s', must be 'text' or 'json'", format)
+		}
+
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		logger, err := newLogger()
+		if err != nil {
+			return err
+		}
+		ctrl.SetLogger(controllerLogger(logger))
+
+		vc, err := vault.NewClient(
+			viper.GetString("vault-addr"),
+			viper.GetString("vault-token"),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create new vault client: %s", err)
+		}
+
+		config, err := kubernetesConfig()
+		if err != nil {
+			return err
+		}
+
+		scheme := runtime.NewScheme()
+		for _, add := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme} {
+			err = add(scheme)
+			if err != nil {
+				return fmt.Errorf("failed to register scheme: %s", err)
+			}
+		}
+
+		// All namespaces are watched if namespace is empty
+		options := ctrl.Options{
+			Scheme:                 scheme,
+			MetricsBindAddress:     viper.GetString("metrics-address"),
+			HealthProbeBindAddress: viper.GetString("health-address"),
+			LeaderElection:         viper.GetBool("leader-elect"),
+			LeaderElectionID:       "k8s-vault-webhook-controller",
+		}
+		if namespace := viper.GetString("watch-namespace"); namespace != "" {
+			options.Cache = cache.Options{Namespaces: []string{namespace}}
+		}
+
+		mgr, err := ctrl.NewManager(config, options)
+		if err != nil {
+			return fmt.Errorf("failed to create controller manager: %s", err)
+		}
+
+		// References are resolved like placeholders of mutated secrets
+		endpoints, err := newVaultEndpoints()
+		if err != nil {
+			return err
+		}
+		resolver := &api.Server{
+			Resolvers:          map[string]api.Resolver{api.SchemeVault: vc},
+			VaultEndpoints:     endpoints.resolvers(),
+			EndpointNamespaces: endpoints.Namespaces,
+			VaultRoutes:        endpoints.Routes,
+			VaultPattern:       viper.GetString("vault-pattern"),
+			Logger:             logger,
+		}
+
+		reconciler := &controller.VaultSecretReconciler{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Resolver: resolver,
+			Logger:   logger,
+		}
+		err = reconciler.SetupWithManager(mgr)
+		if err != nil {
+			return fmt.Errorf("failed to setup vaultsecret controller: %s", err)
+		}
+
+		err = mgr.AddHealthzCheck("healthz", healthz.Ping)
+		if err != nil {
+			return fmt.Errorf("failed to add health check: %s", err)
+		}
+		err = mgr.AddReadyzCheck("readyz", healthz.Ping)
+		if err != nil {
+			return fmt.Errorf("failed to add ready check: %s", err)
+		}
+
+		logger.Info("starting vaultsecret controller")
+		return mgr.Start(ctrl.SetupSignalHandler())
+	},
+}
+
+// controllerLogger returns a controller-runtime logger writing to logger
+func controllerLogger(logger *logrus.Logger) logr.Logger {
+	return funcr.New(func(prefix, args string) {
+		logger.WithField("logger", prefix).Debug(args)
+	}, funcr.Options{})
+}
+
+func init() {
+	controllerCmd.Flags().StringP("vault-addr", "v", "", "Vault address (required) [$KVW_VAULT-ADDR]")
+	controllerCmd.Flags().StringP("vault-token", "t", "", "Vault token path (required) [$KVW_VAULT-TOKEN]")
+	controllerCmd.Flags().StringP("vault-pattern", "p", "{{namespace}}", "Vault search pattern [$KVW_VAULT-PATTERN]")
+	controllerCmd.Flags().String("vault-endpoints", "", "YAML file of named Vault endpoints with their auth and TLS settings, and routes of references to them by namespace or label [$KVW_VAULT-ENDPOINTS]")
+	controllerCmd.Flags().String("kubeconfig", "", "Kubeconfig file, in-cluster config if empty [$KVW_KUBECONFIG]")
+	controllerCmd.Flags().String("watch-namespace", "", "Namespace VaultSecrets are reconciled in, all namespaces if empty [$KVW_WATCH-NAMESPACE]")
+	controllerCmd.Flags().Bool("leader-elect", true, "Enable leader election between controller replicas [$KVW_LEADER-ELECT]")
+	controllerCmd.Flags().String("metrics-address", ":8080", "Metrics address to listen [$KVW_METRICS-ADDRESS]")
+	controllerCmd.Flags().String("health-address", ":8081", "Health probes address to listen [$KVW_HEALTH-ADDRESS]")
+	controllerCmd.Flags().StringP("loglevel", "l", "info", "Controller loglevel [$KVW_LOGLEVEL]")
+	controllerCmd.Flags().StringP("logformat", "f", "text", "Controller logformat (text or json) [$KVW_LOGFORMAT]")
+
+	rootCmd.AddCommand(controllerCmd)
+}
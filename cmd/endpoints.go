@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/Ouest-France/k8s-vault-webhook/api"
+	"github.com/Ouest-France/k8s-vault-webhook/resync"
+	"github.com/Ouest-France/k8s-vault-webhook/vault"
+	"github.com/spf13/viper"
+	"sigs.k8s.io/yaml"
+)
+
+// endpointNameRegex validates Vault endpoint names used in placeholders
+var endpointNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// vaultEndpointsConfig is the file of named Vault endpoints, in addition to
+// the default endpoint configured by flags, and routes of vault
+// placeholders to them
+type vaultEndpointsConfig struct {
+	Endpoints []vault.EndpointConfig `json:"endpoints"`
+	Routes    []api.VaultRoute       `json:"routes"`
+}
+
+// loadVaultEndpoints reads and validates the Vault endpoints file
+func loadVaultEndpoints(path string) (vaultEndpointsConfig, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return vaultEndpointsConfig{}, fmt.Errorf("failed to read vault endpoints file: %s", err)
+	}
+
+	config := vaultEndpointsConfig{}
+	err = yaml.UnmarshalStrict(raw, &config)
+	if err != nil {
+		return vaultEndpointsConfig{}, fmt.Errorf("failed to parse vault endpoints file: %s", err)
+	}
+
+	names := map[string]bool{api.DefaultVaultEndpoint: true}
+	for _, endpoint := range config.Endpoints {
+		if !endpointNameRegex.MatchString(endpoint.Name) {
+			return vaultEndpointsConfig{}, fmt.Errorf("vault endpoint name %q must match %q", endpoint.Name, endpointNameRegex)
+		}
+		if names[endpoint.Name] {
+			return vaultEndpointsConfig{}, fmt.Errorf("vault endpoint %q is defined twice or reserved", endpoint.Name)
+		}
+		names[endpoint.Name] = true
+
+		if err := endpoint.Validate(); err != nil {
+			return vaultEndpointsConfig{}, fmt.Errorf("vault endpoint %q is invalid: %s", endpoint.Name, err)
+		}
+	}
+
+	for _, route := range config.Routes {
+		if err := route.Validate(); err != nil {
+			return vaultEndpointsConfig{}, err
+		}
+		if !names[route.Endpoint] {
+			return vaultEndpointsConfig{}, fmt.Errorf("route to endpoint %q uses an unknown vault endpoint", route.Endpoint)
+		}
+	}
+
+	return config, nil
+}
+
+// checkVaultEndpoints returns an error if the Vault endpoints file is invalid
+func checkVaultEndpoints() error {
+	if viper.GetString("vault-endpoints") == "" {
+		return nil
+	}
+	if !backendEnabled(api.SchemeVault) || viper.GetString("vault-backend") != vaultBackendVault {
+		return errors.New("vault-endpoints requires the vault backend with vault-backend 'vault'")
+	}
+	if viper.GetDuration("vault-health-interval") < 0 {
+		return errors.New("vault-health-interval must not be negative")
+	}
+
+	_, err := loadVaultEndpoints(viper.GetString("vault-endpoints"))
+	return err
+}
+
+// vaultEndpoints holds the clients of named Vault endpoints, their allowed
+// namespaces and routes
+type vaultEndpoints struct {
+	Clients    map[string]vault.Client
+	Namespaces map[string][]string
+	Routes     []api.VaultRoute
+}
+
+// resolvers returns endpoint clients as resolvers
+func (e vaultEndpoints) resolvers() map[string]api.Resolver {
+	resolvers := map[string]api.Resolver{}
+	for name, client := range e.Clients {
+		resolvers[name] = client
+	}
+
+	return resolvers
+}
+
+// resyncClients returns endpoint clients as resync clients
+func (e vaultEndpoints) resyncClients() map[string]resync.VaultClient {
+	clients := map[string]resync.VaultClient{}
+	for name, client := range e.Clients {
+		clients[name] = client
+	}
+
+	return clients
+}
+
+// newVaultEndpoints returns the clients of Vault endpoints and routes of the
+// Vault endpoints file, if any
+func newVaultEndpoints() (vaultEndpoints, error) {
+	endpoints := vaultEndpoints{Clients: map[string]vault.Client{}, Namespaces: map[string][]string{}}
+	if viper.GetString("vault-endpoints") == "" {
+		return endpoints, nil
+	}
+
+	config, err := loadVaultEndpoints(viper.GetString("vault-endpoints"))
+	if err != nil {
+		return vaultEndpoints{}, err
+	}
+
+	for _, endpoint := range config.Endpoints {
+		client, err := vault.NewEndpointClient(endpoint)
+		if err != nil {
+			return vaultEndpoints{}, err
+		}
+		endpoints.Clients[endpoint.Name] = client
+		endpoints.Namespaces[endpoint.Name] = endpoint.Namespaces
+	}
+	endpoints.Routes = config.Routes
+
+	return endpoints, nil
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/Ouest-France/k8s-vault-webhook/api"
+	"github.com/spf13/cobra"
+)
+
+// envReference is the Vault secret path and key of an env value
+type envReference struct {
+	Path string
+	Key  string
+}
+
+// execCmd represents the exec command
+var execCmd = &cobra.Command{
+	Use:   "exec -- command [args...]",
+	Short: "Resolve Vault references in env values and exec a command, used as entrypoint of injected containers",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		env := os.Environ()
+
+		// Find env values referencing Vault secrets
+		refs := map[int]envReference{}
+		for i, kv := range env {
+			name, value, _ := strings.Cut(kv, "=")
+			path, key, ok, err := api.ParsePlaceholder(value)
+			if !ok {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("env %q: %s", name, err)
+			}
+			refs[i] = envReference{Path: path, Key: key}
+		}
+
+		// Login to Vault only if there are references to resolve
+		if len(refs) > 0 {
+			vc, err := vaultLoginClient(cmd)
+			if err != nil {
+				return err
+			}
+
+			for i, ref := range refs {
+				name, _, _ := strings.Cut(env[i], "=")
+				value, err := vc.Read(ref.Path, ref.Key)
+				if err != nil {
+					return fmt.Errorf("failed to resolve env %q: %s", name, err)
+				}
+				env[i] = name + "=" + value
+			}
+		}
+
+		path, err := exec.LookPath(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to find command %q: %s", args[0], err)
+		}
+
+		// Replace this process so that the command receives signals
+		// and its exit code is the container exit code
+		return syscall.Exec(path, args, env)
+	},
+}
+
+func init() {
+	addVaultLoginFlags(execCmd)
+
+	rootCmd.AddCommand(execCmd)
+}
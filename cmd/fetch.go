@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// fetchCmd represents the fetch command
+var fetchCmd = &cobra.Command{
+	Use:   "fetch file=path#key...",
+	Short: "Write Vault secrets to files, run as init container in injected pods",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir, _ := cmd.Flags().GetString("dir")
+
+		// Parse all references before logging in to Vault
+		type reference struct{ file, path, key string }
+		refs := []reference{}
+		for _, arg := range args {
+			file, ref, ok := strings.Cut(arg, "=")
+			sep := strings.LastIndex(ref, "#")
+			if !ok || file == "" || sep < 0 || strings.Contains(file, "/") {
+				return fmt.Errorf("secret reference %q doesn't match file=path#key", arg)
+			}
+			refs = append(refs, reference{file: file, path: ref[:sep], key: ref[sep+1:]})
+		}
+
+		vc, err := vaultLoginClient(cmd)
+		if err != nil {
+			return err
+		}
+
+		// All secrets are read before writing any file, missing secrets
+		// fail the pod start instead of injecting a fallback message
+		values := make([]string, len(refs))
+		for i, ref := range refs {
+			values[i], err = vc.Read(ref.path, ref.key)
+			if err != nil {
+				return fmt.Errorf("failed to read %q key of %q secret: %s", ref.key, ref.path, err)
+			}
+		}
+
+		// Files are only readable by the owner and the pod fsGroup, files
+		// of a previous run are removed as they are read-only
+		for i, ref := range refs {
+			file := filepath.Join(dir, ref.file)
+			err = os.Remove(file)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove %q file: %s", ref.file, err)
+			}
+			err = ioutil.WriteFile(file, []byte(values[i]), 0440)
+			if err != nil {
+				return fmt.Errorf("failed to write %q file: %s", ref.file, err)
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	addVaultLoginFlags(fetchCmd)
+	fetchCmd.Flags().String("dir", "/vault/secrets", "Directory secrets are written to")
+
+	rootCmd.AddCommand(fetchCmd)
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// installCmd represents the install command
+var installCmd = &cobra.Command{
+	Use:   "install dir",
+	Short: "Copy this binary to a directory, run as init container to install the exec wrapper in pods",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		self, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to find executable: %s", err)
+		}
+
+		src, err := os.Open(self)
+		if err != nil {
+			return fmt.Errorf("failed to open executable: %s", err)
+		}
+		defer src.Close()
+
+		// Injected containers run the wrapper by this name
+		target := filepath.Join(args[0], "k8s-vault-webhook")
+		dst, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create %q: %s", target, err)
+		}
+
+		_, err = io.Copy(dst, src)
+		if err != nil {
+			dst.Close()
+			return fmt.Errorf("failed to copy executable to %q: %s", target, err)
+		}
+
+		return dst.Close()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(installCmd)
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// namespaceFile is the service account namespace file mounted in pods
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// kubernetesConfig returns a Kubernetes client config from kubeconfig
+// flag, or from in-cluster service account if not set
+func kubernetesConfig() (*rest.Config, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", viper.GetString("kubeconfig"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubernetes config: %s", err)
+	}
+
+	return config, nil
+}
+
+// kubernetesClient returns a Kubernetes client configured from kubeconfig
+// flag, or from in-cluster service account if not set
+func kubernetesClient() (kubernetes.Interface, error) {
+	config, err := kubernetesConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %s", err)
+	}
+
+	return client, nil
+}
+
+// podNamespace returns the namespace flag, or the namespace the webhook runs in
+func podNamespace() (string, error) {
+	if namespace := viper.GetString("namespace"); namespace != "" {
+		return namespace, nil
+	}
+
+	namespace, err := ioutil.ReadFile(namespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("namespace is not defined and can't be read from service account: %s", err)
+	}
+
+	return strings.TrimSpace(string(namespace)), nil
+}
+
+// podIdentity returns a unique identity of the webhook replica
+func podIdentity() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname: %s", err)
+	}
+
+	return hostname, nil
+}
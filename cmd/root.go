@@ -5,12 +5,20 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"time"
 
 	"github.com/Ouest-France/k8s-vault-webhook/api"
+	"github.com/Ouest-France/k8s-vault-webhook/certs"
+	"github.com/Ouest-France/k8s-vault-webhook/resync"
+	"github.com/Ouest-France/k8s-vault-webhook/rollout"
 	"github.com/Ouest-France/k8s-vault-webhook/vault"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 var rootCmd = &cobra.Command{
@@ -19,14 +27,32 @@ var rootCmd = &cobra.Command{
 	SilenceUsage: true,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 
-		// Checks all required params are set
-		required := []string{"cert", "key", "vault-addr", "vault-token"}
+		// Checks all required params are set, cert and key are
+		// generated when self-signed certificates are enabled and Vault
+		// isn't used when vault placeholders are read from files
+		required := []string{}
+		if vaultRequired() {
+			required = append(required, "vault-addr", "vault-token")
+		}
+		if !viper.GetBool("self-signed") {
+			required = append(required, "cert", "key")
+		}
 		for _, param := range required {
 			if viper.GetString(param) == "" {
 				return fmt.Errorf("required parameter %q is not defined", param)
 			}
 		}
 
+		// Check enabled backends
+		if err := checkBackends(); err != nil {
+			return err
+		}
+
+		// Check named Vault endpoints and routes
+		if err := checkVaultEndpoints(); err != nil {
+			return err
+		}
+
 		// Check logformat
 		validLogformat := func() bool {
 			for _, validFormat := range []string{"text", "json"} {
@@ -51,6 +77,76 @@ var rootCmd = &cobra.Command{
 			}
 		}
 
+		// Check auth mode
+		if mode := viper.GetString("auth-mode"); mode != api.AuthModeAll && mode != api.AuthModeAny {
+			return fmt.Errorf("auth-mode is '%s', must be '%s' or '%s'", mode, api.AuthModeAll, api.AuthModeAny)
+		}
+
+		// Check client certificate names are only used with a client CA
+		if len(viper.GetStringSlice("client-names")) > 0 && viper.GetString("client-ca") == "" {
+			return errors.New("client-names requires client-ca to be defined")
+		}
+
+		// Check reuse on update relies on provenance annotations
+		if viper.GetBool("reuse-on-update") && !viper.GetBool("provenance") {
+			return errors.New("reuse-on-update requires provenance to be enabled")
+		}
+
+		// Check plaintext secrets can be identified by provenance
+		if viper.GetBool("validate-vault-only") && !viper.GetBool("provenance") {
+			return errors.New("validate-vault-only requires provenance to be enabled")
+		}
+
+		// Check resync relies on provenance annotations
+		if viper.GetBool("resync") {
+			if !viper.GetBool("provenance") {
+				return errors.New("resync requires provenance to be enabled")
+			}
+			if viper.GetDuration("resync-interval") <= 0 {
+				return errors.New("resync-interval must be greater than 0")
+			}
+			if viper.GetFloat64("resync-jitter") < 0 {
+				return errors.New("resync-jitter must not be negative")
+			}
+			if viper.GetInt("resync-concurrency") < 1 {
+				return errors.New("resync-concurrency must be greater than 0")
+			}
+			if viper.GetString("resync-username") == "" {
+				return errors.New("resync requires resync-username to be defined")
+			}
+		}
+
+		// Check rollouts are triggered by resync
+		if viper.GetBool("rollout") && !viper.GetBool("resync") {
+			return errors.New("rollout requires resync to be enabled")
+		}
+
+		// Check TLS settings
+		if _, err := api.ParseTLSVersion(viper.GetString("tls-min-version")); err != nil {
+			return err
+		}
+		if _, err := api.ParseCipherSuites(viper.GetStringSlice("tls-cipher-suites")); err != nil {
+			return err
+		}
+		if _, err := api.ParseCurves(viper.GetStringSlice("tls-curves")); err != nil {
+			return err
+		}
+		if viper.GetInt64("max-request-body") <= 0 {
+			return errors.New("max-request-body must be greater than 0")
+		}
+
+		// Check self-signed certificates params
+		if viper.GetBool("self-signed") {
+			for _, param := range []string{"self-signed-secret", "self-signed-service"} {
+				if viper.GetString(param) == "" {
+					return fmt.Errorf("parameter %q is required with self-signed", param)
+				}
+			}
+			if viper.GetDuration("self-signed-renew-before") >= viper.GetDuration("self-signed-validity") {
+				return errors.New("self-signed-renew-before must be lower than self-signed-validity")
+			}
+		}
+
 		return nil
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -64,31 +160,96 @@ var rootCmd = &cobra.Command{
 		}
 
 		// Setup logger
-		logger := logrus.New()
-		level, err := logrus.ParseLevel(viper.GetString("loglevel"))
+		logger, err := newLogger()
+		if err != nil {
+			return err
+		}
+
+		// Resolvers of enabled backends
+		resolvers, err := newResolvers(vc, logger)
 		if err != nil {
-			return fmt.Errorf("failed to parse loglevel: %s", err)
+			return err
 		}
-		logger.SetLevel(level)
-		formatter := map[string]logrus.Formatter{
-			"text": &logrus.TextFormatter{},
-			"json": &logrus.JSONFormatter{FieldMap: logrus.FieldMap{
-				logrus.FieldKeyTime:  "timestamp",
-				logrus.FieldKeyLevel: "level",
-				logrus.FieldKeyMsg:   "message",
-				logrus.FieldKeyFunc:  "caller",
-			}},
+
+		// Named Vault endpoints in addition to the default one
+		endpoints, err := newVaultEndpoints()
+		if err != nil {
+			return err
 		}
-		logger.SetFormatter(formatter[viper.GetString("logformat")])
+
+		// TLS settings are validated in PreRunE
+		tlsMinVersion, _ := api.ParseTLSVersion(viper.GetString("tls-min-version"))
+		tlsCipherSuites, _ := api.ParseCipherSuites(viper.GetStringSlice("tls-cipher-suites"))
+		tlsCurves, _ := api.ParseCurves(viper.GetStringSlice("tls-curves"))
 
 		server := api.Server{
-			Listen:       viper.GetString("address"),
-			Cert:         viper.GetString("cert"),
-			Key:          viper.GetString("key"),
-			Vault:        vc,
-			VaultPattern: viper.GetString("vault-pattern"),
-			Logger:       logger,
-			BasicAuth:    viper.GetStringSlice("basicauth"),
+			Listen:               viper.GetString("address"),
+			Cert:                 viper.GetString("cert"),
+			Key:                  viper.GetString("key"),
+			Resolvers:            resolvers,
+			VaultEndpoints:       endpoints.resolvers(),
+			EndpointNamespaces:   endpoints.Namespaces,
+			VaultRoutes:          endpoints.Routes,
+			VaultHealthInterval:  viper.GetDuration("vault-health-interval"),
+			VaultPattern:         viper.GetString("vault-pattern"),
+			Provenance:           viper.GetBool("provenance"),
+			ReuseOnUpdate:        viper.GetBool("reuse-on-update"),
+			ResyncUsername:       viper.GetString("resync-username"),
+			DryRunCheckPaths:     viper.GetBool("dry-run-check-paths"),
+			GeneratePaths:        viper.GetStringSlice("generate-paths"),
+			ValidateUnresolved:   viper.GetBool("validate-unresolved"),
+			ValidateVaultOnly:    viper.GetBool("validate-vault-only"),
+			VaultOnlyLabel:       viper.GetString("vault-only-label"),
+			VaultOnlyIgnoreTypes: viper.GetStringSlice("vault-only-ignore-types"),
+			InjectImage:          viper.GetString("inject-image"),
+			InjectVaultAddr:      viper.GetString("inject-vault-addr"),
+			InjectAuthMount:      viper.GetString("inject-auth-mount"),
+			InjectRole:           viper.GetString("inject-role"),
+			InjectRoles:          viper.GetStringSlice("inject-roles"),
+			Logger:               logger,
+			BasicAuth:            viper.GetStringSlice("basicauth"),
+			BasicAuthFile:        viper.GetString("basicauth-file"),
+			BasicAuthCacheTTL:    viper.GetDuration("basicauth-cache-ttl"),
+			AuthFailureLimit:     viper.GetInt("auth-failure-limit"),
+			AuthFailureWindow:    viper.GetDuration("auth-failure-window"),
+			ClientCA:             viper.GetString("client-ca"),
+			ClientNames:          viper.GetStringSlice("client-names"),
+			AuthMode:             viper.GetString("auth-mode"),
+			TLSMinVersion:        tlsMinVersion,
+			TLSCipherSuites:      tlsCipherSuites,
+			TLSCurves:            tlsCurves,
+			HTTP2:                viper.GetBool("http2"),
+			ReadHeaderTimeout:    viper.GetDuration("read-header-timeout"),
+			ReadTimeout:          viper.GetDuration("read-timeout"),
+			WriteTimeout:         viper.GetDuration("write-timeout"),
+			MaxRequestBody:       viper.GetInt64("max-request-body"),
+		}
+
+		// Namespace labels are read to validate Vault-only namespaces
+		if server.ValidateVaultOnly {
+			server.Kubernetes, err = kubernetesClient()
+			if err != nil {
+				return err
+			}
+		}
+
+		// Generate and rotate serving certificates
+		if viper.GetBool("self-signed") {
+			manager, err := selfSignedManager(logger)
+			if err != nil {
+				return err
+			}
+			manager.Start(nil)
+			server.CertProvider = manager
+		}
+
+		// Update mutated secrets with newer Vault versions
+		if viper.GetBool("resync") {
+			reconciler, err := resyncReconciler(logger, vc, endpoints)
+			if err != nil {
+				return err
+			}
+			reconciler.Start(nil)
 		}
 
 		return server.Serve()
@@ -110,11 +271,66 @@ func init() {
 	rootCmd.Flags().StringP("vault-addr", "v", "", "Vault address (required) [$KVW_VAULT-ADDR]")
 	rootCmd.Flags().StringP("vault-token", "t", "", "Vault token path (required) [$KVW_VAULT-TOKEN]")
 	rootCmd.Flags().StringP("vault-pattern", "p", "{{namespace}}", "Vault search pattern [$KVW_VAULT-PATTERN]")
+	rootCmd.Flags().String("vault-endpoints", "", "YAML file of named Vault endpoints with their auth and TLS settings, and routes of vault placeholders to them by namespace or label [$KVW_VAULT-ENDPOINTS]")
+	rootCmd.Flags().Duration("vault-health-interval", 30*time.Second, "Interval Vault endpoints health is checked at for metrics and /status/vault, disabled if 0 [$KVW_VAULT-HEALTH-INTERVAL]")
+	rootCmd.Flags().StringSlice("backends", []string{api.SchemeVault}, "Secret backends resolving placeholders of their scheme: vault, vault-transit, file, awssm, ssm [$KVW_BACKENDS]")
+	rootCmd.Flags().String("vault-backend", "vault", "Backend resolving vault placeholders: vault, or file to read them from file-root on development clusters without Vault [$KVW_VAULT-BACKEND]")
+	rootCmd.Flags().String("file-root", "", "Directory of YAML or JSON secret files mirroring Vault paths, read by the file backend and reloaded on change [$KVW_FILE-ROOT]")
+	rootCmd.Flags().String("aws-region", "", "AWS region of awssm and ssm backends, read from AWS_REGION if empty [$KVW_AWS-REGION]")
+	rootCmd.Flags().String("aws-endpoint", "", "AWS API endpoint of awssm and ssm backends instead of regional endpoints, such as a VPC endpoint [$KVW_AWS-ENDPOINT]")
+	rootCmd.Flags().String("awssm-pattern", "{{.Namespace}}/{{.Secret}}", "AWS Secrets Manager secret name pattern of awssm placeholders [$KVW_AWSSM-PATTERN]")
+	rootCmd.Flags().String("ssm-pattern", "/{{.Namespace}}/{{.Secret}}", "AWS Parameter Store parameter name pattern of ssm placeholders [$KVW_SSM-PATTERN]")
+	rootCmd.Flags().String("transit-mount", "transit", "Vault transit secrets engine mount decrypting vault-transit placeholders [$KVW_TRANSIT-MOUNT]")
+	rootCmd.Flags().String("transit-pattern", "{{.Namespace}}-{{.Secret}}", "Vault transit key name pattern of vault-transit placeholders [$KVW_TRANSIT-PATTERN]")
+	rootCmd.Flags().Bool("provenance", false, "Record Vault provenance and content hash annotations on mutated secrets, required by reuse-on-update, validate-vault-only and resync [$KVW_PROVENANCE]")
+	rootCmd.Flags().Bool("reuse-on-update", false, "Reuse values resolved on previous admission for unchanged placeholders on update, requires provenance [$KVW_REUSE-ON-UPDATE]")
+	rootCmd.Flags().Bool("dry-run-check-paths", false, "Check Vault secrets exist on dry-run requests through KV2 metadata, without reading values [$KVW_DRY-RUN-CHECK-PATHS]")
+	rootCmd.Flags().StringSlice("generate-paths", []string{}, "Vault path glob patterns random values of vault-generate placeholders may be stored at, generation disabled if empty [$KVW_GENERATE-PATHS]")
+	rootCmd.Flags().Bool("validate-unresolved", true, "Reject secrets with unresolved Vault placeholders on /validate/secret [$KVW_VALIDATE-UNRESOLVED]")
+	rootCmd.Flags().Bool("validate-vault-only", false, "Reject secrets with plaintext values in Vault-only namespaces on /validate/secret, requires provenance [$KVW_VALIDATE-VAULT-ONLY]")
+	rootCmd.Flags().String("vault-only-label", api.LabelVaultOnly, "Namespace label set to \"true\" on Vault-only namespaces [$KVW_VAULT-ONLY-LABEL]")
+	rootCmd.Flags().StringSlice("vault-only-ignore-types", api.DefaultVaultOnlyIgnoreTypes, "Secret types never rejected as plaintext in Vault-only namespaces [$KVW_VAULT-ONLY-IGNORE-TYPES]")
+	rootCmd.Flags().String("inject-image", "", "Image of the init container injected in pods on /pod, usually this webhook image [$KVW_INJECT-IMAGE]")
+	rootCmd.Flags().String("inject-vault-addr", "", "Vault address the init container injected in pods reads secrets from [$KVW_INJECT-VAULT-ADDR]")
+	rootCmd.Flags().String("inject-auth-mount", "kubernetes", "Vault Kubernetes auth method mount the injected init container logs in with [$KVW_INJECT-AUTH-MOUNT]")
+	rootCmd.Flags().String("inject-role", "", "Default Vault role the injected init container logs in with [$KVW_INJECT-ROLE]")
+	rootCmd.Flags().StringSlice("inject-roles", []string{}, "Vault roles pods may choose with the role annotation instead of the default role, none if empty [$KVW_INJECT-ROLES]")
+	rootCmd.Flags().Bool("resync", false, "Periodically update mutated secrets whose Vault secrets have a newer KV version, requires provenance [$KVW_RESYNC]")
+	rootCmd.Flags().Duration("resync-interval", time.Hour, "Interval mutated secrets are resynced at [$KVW_RESYNC-INTERVAL]")
+	rootCmd.Flags().Float64("resync-jitter", 0.1, "Maximum resync interval jitter as a factor of the interval [$KVW_RESYNC-JITTER]")
+	rootCmd.Flags().Int("resync-concurrency", 4, "Number of secrets resynced concurrently [$KVW_RESYNC-CONCURRENCY]")
+	rootCmd.Flags().Bool("rollout", false, "Restart Deployments, StatefulSets and DaemonSets using resynced secrets, requires resync [$KVW_ROLLOUT]")
+	rootCmd.Flags().String("resync-username", "", "Kubernetes username of the webhook service account, whose secret writes by resync and the VaultSecret controller keep their provenance, required with resync [$KVW_RESYNC-USERNAME]")
+	rootCmd.Flags().String("resync-lease", "k8s-vault-webhook-resync", "Lease used for resync leader election [$KVW_RESYNC-LEASE]")
 	rootCmd.Flags().StringP("loglevel", "l", "info", "Webhook loglevel [$KVW_LOGLEVEL]")
 	rootCmd.Flags().StringP("logformat", "f", "text", "Webhook logformat (text or json) [$KVW_LOGFORMAT]")
 	rootCmd.Flags().StringSliceP("basicauth", "b", []string{}, "Basic auth list of user:hashed_pass [$KVW_BASICAUTH]")
+	rootCmd.Flags().String("basicauth-file", "", "Basic auth htpasswd-style file of user:hashed_pass lines, reloaded on change [$KVW_BASICAUTH-FILE]")
+	rootCmd.Flags().Duration("basicauth-cache-ttl", time.Minute, "Duration successful basic auth verifications are cached, 0 to disable [$KVW_BASICAUTH-CACHE-TTL]")
+	rootCmd.Flags().Int("auth-failure-limit", 10, "Authentication failures allowed per source IP and window, 0 to disable [$KVW_AUTH-FAILURE-LIMIT]")
+	rootCmd.Flags().Duration("auth-failure-window", time.Minute, "Authentication failures counting window [$KVW_AUTH-FAILURE-WINDOW]")
+	rootCmd.Flags().String("client-ca", "", "CA bundle file to verify client certificates, enables client certificate auth [$KVW_CLIENT-CA]")
+	rootCmd.Flags().StringSlice("client-names", []string{}, "Allowed client certificate subject CNs or SANs, any verified certificate if empty [$KVW_CLIENT-NAMES]")
+	rootCmd.Flags().String("auth-mode", "all", "Require 'all' or 'any' of basicauth and client certificate auth when both are enabled [$KVW_AUTH-MODE]")
+	rootCmd.Flags().String("tls-min-version", "1.2", "Minimum TLS version (1.2 or 1.3) [$KVW_TLS-MIN-VERSION]")
+	rootCmd.Flags().StringSlice("tls-cipher-suites", []string{}, "TLS 1.2 cipher suites by IANA name, Go defaults if empty [$KVW_TLS-CIPHER-SUITES]")
+	rootCmd.Flags().StringSlice("tls-curves", []string{}, "TLS curve preferences (X25519, P256, P384, P521), Go defaults if empty [$KVW_TLS-CURVES]")
+	rootCmd.Flags().Bool("http2", true, "Enable HTTP/2 negotiation through ALPN [$KVW_HTTP2]")
+	rootCmd.Flags().Duration("read-header-timeout", 10*time.Second, "HTTPS request header read timeout [$KVW_READ-HEADER-TIMEOUT]")
+	rootCmd.Flags().Duration("read-timeout", 30*time.Second, "HTTPS request read timeout [$KVW_READ-TIMEOUT]")
+	rootCmd.Flags().Duration("write-timeout", 30*time.Second, "HTTPS response write timeout [$KVW_WRITE-TIMEOUT]")
+	rootCmd.Flags().Int64("max-request-body", 4<<20, "Maximum admission request body size in bytes [$KVW_MAX-REQUEST-BODY]")
+	rootCmd.Flags().String("kubeconfig", "", "Kubeconfig file, in-cluster config if empty [$KVW_KUBECONFIG]")
+	rootCmd.Flags().String("namespace", "", "Namespace the webhook runs in, read from service account if empty [$KVW_NAMESPACE]")
+	rootCmd.Flags().Bool("self-signed", false, "Generate serving certificates and inject CA in webhook configuration [$KVW_SELF-SIGNED]")
+	rootCmd.Flags().String("self-signed-secret", "k8s-vault-webhook-certs", "Secret storing self-signed certificates [$KVW_SELF-SIGNED-SECRET]")
+	rootCmd.Flags().String("self-signed-service", "k8s-vault-webhook", "Service name the serving certificate is issued for [$KVW_SELF-SIGNED-SERVICE]")
+	rootCmd.Flags().String("self-signed-webhook", "k8s-vault-webhook", "MutatingWebhookConfiguration to inject CA bundle in [$KVW_SELF-SIGNED-WEBHOOK]")
+	rootCmd.Flags().String("self-signed-validating-webhook", "", "ValidatingWebhookConfiguration to inject CA bundle in, none if empty [$KVW_SELF-SIGNED-VALIDATING-WEBHOOK]")
+	rootCmd.Flags().Duration("self-signed-validity", 365*24*time.Hour, "Self-signed certificates validity [$KVW_SELF-SIGNED-VALIDITY]")
+	rootCmd.Flags().Duration("self-signed-renew-before", 30*24*time.Hour, "Renew self-signed certificates this long before expiry [$KVW_SELF-SIGNED-RENEW-BEFORE]")
 
-	flags := []string{"address", "cert", "key", "vault-addr", "vault-token", "vault-pattern", "loglevel", "logformat", "basicauth"}
+	flags := []string{"address", "cert", "key", "vault-addr", "vault-token", "vault-pattern", "vault-endpoints", "vault-health-interval", "backends", "vault-backend", "file-root", "transit-mount", "transit-pattern", "aws-region", "aws-endpoint", "awssm-pattern", "ssm-pattern", "provenance", "reuse-on-update", "dry-run-check-paths", "generate-paths", "validate-unresolved", "validate-vault-only", "vault-only-label", "vault-only-ignore-types", "inject-image", "inject-vault-addr", "inject-auth-mount", "inject-role", "inject-roles", "resync", "resync-interval", "resync-jitter", "resync-concurrency", "resync-lease", "resync-username", "rollout", "loglevel", "logformat", "basicauth", "basicauth-file", "basicauth-cache-ttl", "auth-failure-limit", "auth-failure-window", "client-ca", "client-names", "auth-mode", "tls-min-version", "tls-cipher-suites", "tls-curves", "http2", "read-header-timeout", "read-timeout", "write-timeout", "max-request-body", "kubeconfig", "namespace", "self-signed", "self-signed-secret", "self-signed-service", "self-signed-webhook", "self-signed-validating-webhook", "self-signed-validity", "self-signed-renew-before"}
 	for _, flag := range flags {
 		err := viper.BindPFlag(flag, rootCmd.Flags().Lookup(flag))
 		if err != nil {
@@ -124,7 +340,104 @@ func init() {
 	}
 }
 
+// selfSignedManager returns a certificates manager configured from flags
+func selfSignedManager(logger *logrus.Logger) (*certs.Manager, error) {
+	client, err := kubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+
+	namespace, err := podNamespace()
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := podIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	return &certs.Manager{
+		Client:            client,
+		Namespace:         namespace,
+		SecretName:        viper.GetString("self-signed-secret"),
+		ServiceName:       viper.GetString("self-signed-service"),
+		MutatingWebhook:   viper.GetString("self-signed-webhook"),
+		ValidatingWebhook: viper.GetString("self-signed-validating-webhook"),
+		Validity:          viper.GetDuration("self-signed-validity"),
+		RenewBefore:       viper.GetDuration("self-signed-renew-before"),
+		Identity:          identity,
+		Logger:            logger,
+	}, nil
+}
+
+// resyncReconciler returns a resync reconciler configured from flags,
+// recording events on resynced secrets and restarted workloads
+func resyncReconciler(logger *logrus.Logger, vc vault.Client, endpoints vaultEndpoints) (*resync.Reconciler, error) {
+	client, err := kubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+
+	namespace, err := podNamespace()
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := podIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "k8s-vault-webhook"})
+
+	var trigger *rollout.Trigger
+	if viper.GetBool("rollout") {
+		trigger = &rollout.Trigger{Client: client, Recorder: recorder, Logger: logger}
+	}
+
+	return &resync.Reconciler{
+		Client:      client,
+		Vault:       vc,
+		Endpoints:   endpoints.resyncClients(),
+		Pattern:     viper.GetString("vault-pattern"),
+		Recorder:    recorder,
+		Interval:    viper.GetDuration("resync-interval"),
+		Jitter:      viper.GetFloat64("resync-jitter"),
+		Concurrency: viper.GetInt("resync-concurrency"),
+		Rollout:     trigger,
+		Namespace:   namespace,
+		LeaseName:   viper.GetString("resync-lease"),
+		Identity:    identity,
+		Logger:      logger,
+	}, nil
+}
+
 func initConfig() {
 	viper.SetEnvPrefix("kvw")
 	viper.AutomaticEnv()
 }
+
+// newLogger returns a logger configured from loglevel and logformat flags
+func newLogger() (*logrus.Logger, error) {
+	logger := logrus.New()
+	level, err := logrus.ParseLevel(viper.GetString("loglevel"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse loglevel: %s", err)
+	}
+	logger.SetLevel(level)
+	formatter := map[string]logrus.Formatter{
+		"text": &logrus.TextFormatter{},
+		"json": &logrus.JSONFormatter{FieldMap: logrus.FieldMap{
+			logrus.FieldKeyTime:  "timestamp",
+			logrus.FieldKeyLevel: "level",
+			logrus.FieldKeyMsg:   "message",
+			logrus.FieldKeyFunc:  "caller",
+		}},
+	}
+	logger.SetFormatter(formatter[viper.GetString("logformat")])
+
+	return logger, nil
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Ouest-France/k8s-vault-webhook/vault"
+	"github.com/spf13/cobra"
+)
+
+// serviceAccountTokenFile is the service account token mounted in pods
+const serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// addVaultLoginFlags adds flags to login to Vault from injected containers
+func addVaultLoginFlags(cmd *cobra.Command) {
+	cmd.Flags().String("vault-addr", "", "Vault address (required)")
+	cmd.Flags().String("vault-token", "", "Vault token path, Kubernetes auth method is used if empty")
+	cmd.Flags().String("vault-auth-mount", "kubernetes", "Vault Kubernetes auth method mount")
+	cmd.Flags().String("vault-role", "", "Vault Kubernetes auth method role")
+	cmd.Flags().String("vault-jwt", serviceAccountTokenFile, "Service account token used to login to Vault")
+}
+
+// vaultLoginClient returns a Vault client configured from login flags, with
+// a token file if set or logged in with the Kubernetes auth method otherwise
+func vaultLoginClient(cmd *cobra.Command) (vault.Client, error) {
+	flags := cmd.Flags()
+	addr, _ := flags.GetString("vault-addr")
+	token, _ := flags.GetString("vault-token")
+	mount, _ := flags.GetString("vault-auth-mount")
+	role, _ := flags.GetString("vault-role")
+	jwt, _ := flags.GetString("vault-jwt")
+
+	if addr == "" {
+		return vault.Client{}, errors.New("required parameter \"vault-addr\" is not defined")
+	}
+
+	var vc vault.Client
+	var err error
+	if token != "" {
+		vc, err = vault.NewClient(addr, token)
+	} else {
+		if role == "" {
+			return vault.Client{}, errors.New("parameter \"vault-role\" is required without vault-token")
+		}
+		vc, err = vault.NewKubernetesClient(addr, mount, role, jwt)
+	}
+	if err != nil {
+		return vault.Client{}, fmt.Errorf("failed to create new vault client: %s", err)
+	}
+
+	return vc, nil
+}
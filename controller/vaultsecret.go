@@ -0,0 +1,242 @@
+// Package controller reconciles VaultSecret resources into Secrets with
+// values read from Vault
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Ouest-France/k8s-vault-webhook/api"
+	"github.com/Ouest-France/k8s-vault-webhook/apis/v1alpha1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// retryInterval is the interval failed reconciliations are retried at
+const retryInterval = time.Minute
+
+// Resolver interface is implemented by the webhook server, resolving
+// references like placeholders of mutated secrets
+type Resolver interface {
+	Resolve(secret corev1.Secret, value string) (string, api.Provenance, error)
+}
+
+// VaultSecretReconciler reconciles VaultSecret resources into owned Secrets,
+// with provenance and content hash annotations as written by the webhook
+type VaultSecretReconciler struct {
+	Client   client.Client
+	Scheme   *runtime.Scheme
+	Resolver Resolver
+	Logger   *logrus.Logger
+}
+
+// SetupWithManager registers the reconciler in a manager, VaultSecrets are
+// reconciled on spec changes and when their owned Secret changes
+func (r *VaultSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.VaultSecret{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Owns(&corev1.Secret{}).
+		Complete(r)
+}
+
+// Reconcile writes the Secret of a VaultSecret with values read from Vault
+// and publishes the result in the VaultSecret status
+func (r *VaultSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := r.Logger.WithFields(logrus.Fields{
+		"kubernetes_vaultsecret_name":      req.Name,
+		"kubernetes_vaultsecret_namespace": req.Namespace,
+	})
+
+	var vs v1alpha1.VaultSecret
+	err := r.Client.Get(ctx, req.NamespacedName, &vs)
+	if apierrors.IsNotFound(err) {
+		// Owned Secret is garbage collected
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get vaultsecret: %s", err)
+	}
+
+	result, condition := r.sync(ctx, &vs)
+	if condition.Status == metav1.ConditionTrue {
+		logger.Info("vaultsecret synced")
+	} else {
+		logger.WithField("reason", condition.Reason).Error(condition.Message)
+	}
+
+	// Publish sync result in status
+	condition.Type = v1alpha1.ConditionReady
+	condition.ObservedGeneration = vs.Generation
+	meta.SetStatusCondition(&vs.Status.Conditions, condition)
+	vs.Status.ObservedGeneration = vs.Generation
+	err = r.Client.Status().Update(ctx, &vs)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to update vaultsecret status: %s", err)
+	}
+
+	return result, nil
+}
+
+// sync writes the Secret of a VaultSecret and returns the Ready condition,
+// updating the secret name and refresh time in status on success
+func (r *VaultSecretReconciler) sync(ctx context.Context, vs *v1alpha1.VaultSecret) (ctrl.Result, metav1.Condition) {
+
+	// References must be fixed in spec, no retry
+	data, provenance, condition := r.resolve(vs)
+	if condition.Status != metav1.ConditionTrue {
+		if condition.Reason == v1alpha1.ReasonVaultError {
+			return ctrl.Result{RequeueAfter: retryInterval}, condition
+		}
+		return ctrl.Result{}, condition
+	}
+
+	name := vs.Spec.Template.Name
+	if name == "" {
+		name = vs.Name
+	}
+
+	// Secrets not created by this VaultSecret are never overwritten
+	var existing corev1.Secret
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: vs.Namespace, Name: name}, &existing)
+	if err == nil && !metav1.IsControlledBy(&existing, vs) {
+		return ctrl.Result{}, failed(v1alpha1.ReasonSecretConflict, "secret %q exists and is not owned by this vaultsecret", name)
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{RequeueAfter: retryInterval}, failed(v1alpha1.ReasonSecretError, "failed to get secret %q: %s", name, err)
+	}
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: vs.Namespace}}
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+		template := vs.Spec.Template
+
+		// Secret type is immutable
+		secretType := template.Type
+		if secretType == "" {
+			secretType = corev1.SecretTypeOpaque
+		}
+		if secret.CreationTimestamp.IsZero() {
+			secret.Type = secretType
+		} else if secret.Type != secretType {
+			return fmt.Errorf("secret type %q can't be changed to %q", secret.Type, secretType)
+		}
+
+		annotations, err := provenanceAnnotations(*secret, template.Annotations, data, provenance)
+		if err != nil {
+			return err
+		}
+
+		secret.Labels = template.Labels
+		secret.Annotations = annotations
+		secret.Data = data
+
+		return controllerutil.SetControllerReference(vs, secret, r.Scheme)
+	})
+	if err != nil {
+		return ctrl.Result{RequeueAfter: retryInterval}, failed(v1alpha1.ReasonSecretError, "failed to write secret %q: %s", name, err)
+	}
+
+	now := metav1.Now()
+	vs.Status.SecretName = name
+	vs.Status.LastRefreshTime = &now
+
+	result := ctrl.Result{}
+	if vs.Spec.RefreshInterval != nil && vs.Spec.RefreshInterval.Duration > 0 {
+		result.RequeueAfter = vs.Spec.RefreshInterval.Duration
+	}
+
+	return result, metav1.Condition{
+		Status:  metav1.ConditionTrue,
+		Reason:  v1alpha1.ReasonSynced,
+		Message: fmt.Sprintf("secret %q synced with %d values from vault", name, len(vs.Spec.Data)),
+	}
+}
+
+// resolve returns the target Secret data with references resolved and
+// their provenance, the returned condition is not true if a reference can't
+// be resolved. References are resolved for a Secret named after the
+// VaultSecret, with the template labels matched by routes.
+func (r *VaultSecretReconciler) resolve(vs *v1alpha1.VaultSecret) (map[string][]byte, map[string]api.Provenance, metav1.Condition) {
+	data := map[string][]byte{}
+	for key, value := range vs.Spec.Template.StringData {
+		data[key] = []byte(value)
+	}
+
+	keys := make([]string, 0, len(vs.Spec.Data))
+	for key := range vs.Spec.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: vs.Name, Namespace: vs.Namespace, Labels: vs.Spec.Template.Labels}}
+	provenance := map[string]api.Provenance{}
+	for _, key := range keys {
+
+		// Fallback values of missing secrets are never written
+		value, p, err := r.Resolver.Resolve(secret, vs.Spec.Data[key])
+		if api.IsDenied(err) {
+			return nil, nil, failed(v1alpha1.ReasonInvalidReference, "data key %q: %s", key, err)
+		}
+		if err != nil {
+			return nil, nil, failed(v1alpha1.ReasonVaultError, "data key %q: %s", key, err)
+		}
+		data[key] = []byte(value)
+		provenance[key] = p
+	}
+
+	return data, provenance, metav1.Condition{Status: metav1.ConditionTrue}
+}
+
+// provenanceAnnotations returns the template annotations with provenance and
+// content hash annotations of resolved data. Provenance of values unchanged
+// in the existing Secret keeps its resolution time, so that refreshes don't
+// update the Secret.
+func provenanceAnnotations(existing corev1.Secret, template map[string]string, data map[string][]byte, provenance map[string]api.Provenance) (map[string]string, error) {
+	// Invalid annotations are replaced
+	recorded, _ := api.ParseProvenance(existing)
+
+	merged := map[string]api.Provenance{}
+	for key, p := range provenance {
+		old, ok := recorded[key]
+		if ok && bytes.Equal(existing.Data[key], data[key]) && old.Placeholder == p.Placeholder && old.Scheme == p.Scheme && old.Endpoint == p.Endpoint && old.Path == p.Path && old.Key == p.Key && old.Version == p.Version {
+			p.ResolvedAt = old.ResolvedAt
+		}
+		merged[key] = p
+	}
+
+	raw, err := json.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal provenance annotation: %s", err)
+	}
+
+	annotations := map[string]string{}
+	for name, value := range template {
+		annotations[name] = value
+	}
+	annotations[api.AnnotationProvenance] = string(raw)
+	annotations[api.AnnotationContentHash] = api.ContentHash(data)
+
+	return annotations, nil
+}
+
+// failed returns a false condition with a reason and message
+func failed(reason, format string, a ...interface{}) metav1.Condition {
+	return metav1.Condition{
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Ouest-France/k8s-vault-webhook/api"
+	"github.com/Ouest-France/k8s-vault-webhook/apis/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// Fake Vault client for testing
+type fakeVaultClient struct {
+	Values map[string]string
+}
+
+func (f fakeVaultClient) Read(path, key string) (string, error) {
+	value, ok := f.Values[path+"#"+key]
+	if !ok {
+		return "secret does not exist in Vault", errors.New("secret does not exist in Vault")
+	}
+	return value, nil
+}
+
+// newReconciler returns a reconciler with a fake client holding objects
+func newReconciler(t *testing.T, vault fakeVaultClient, objects ...client.Object) *VaultSecretReconciler {
+	scheme := runtime.NewScheme()
+	require.Nil(t, clientgoscheme.AddToScheme(scheme))
+	require.Nil(t, v1alpha1.AddToScheme(scheme))
+
+	resolver := &api.Server{
+		Resolvers:          map[string]api.Resolver{api.SchemeVault: vault},
+		VaultEndpoints:     map[string]api.Resolver{"prod": fakeVaultClient{Values: map[string]string{"secret/data/prod-app/db#password": "pr0d"}}},
+		EndpointNamespaces: map[string][]string{"prod": {"prod-*"}},
+		VaultRoutes:        []api.VaultRoute{{Endpoint: "prod", Labels: map[string]string{"env": "prod"}}},
+		VaultPattern:       "secret/data/{{.Namespace}}/{{.Secret}}",
+		Logger:             logrus.New(),
+	}
+
+	return &VaultSecretReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).WithStatusSubresource(&v1alpha1.VaultSecret{}).Build(),
+		Scheme:   scheme,
+		Resolver: resolver,
+		Logger:   logrus.New(),
+	}
+}
+
+// vaultSecret returns a VaultSecret with a spec
+func vaultSecret(spec v1alpha1.VaultSecretSpec) *v1alpha1.VaultSecret {
+	return &v1alpha1.VaultSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "test-namespace", Generation: 1},
+		Spec:       spec,
+	}
+}
+
+// reconcile runs a reconciliation and returns the updated VaultSecret
+func reconcile(t *testing.T, r *VaultSecretReconciler) (ctrl.Result, v1alpha1.VaultSecret) {
+	ctx := context.Background()
+	name := types.NamespacedName{Namespace: "test-namespace", Name: "db"}
+
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+	require.Nil(t, err)
+
+	var vs v1alpha1.VaultSecret
+	require.Nil(t, r.Client.Get(ctx, name, &vs))
+
+	return result, vs
+}
+
+func TestVaultSecretReconciler_Reconcile(t *testing.T) {
+
+	ctx := context.Background()
+	vault := fakeVaultClient{Values: map[string]string{
+		"secret/data/test-namespace/db#password": "s3cr3t",
+		"secret/data/test-namespace/db#user":     "admin",
+	}}
+	vs := vaultSecret(v1alpha1.VaultSecretSpec{
+		Data: map[string]string{"password": "vault:db#password", "user": "vault:db#user"},
+		Template: v1alpha1.SecretTemplate{
+			Name:       "db-credentials",
+			Labels:     map[string]string{"app": "db"},
+			StringData: map[string]string{"host": "db.local", "user": "overridden"},
+		},
+		RefreshInterval: &metav1.Duration{Duration: time.Hour},
+	})
+	r := newReconciler(t, vault, vs)
+
+	result, updated := reconcile(t, r)
+	require.Equal(t, time.Hour, result.RequeueAfter, "Test requeued after refresh interval")
+
+	var secret corev1.Secret
+	require.Nil(t, r.Client.Get(ctx, types.NamespacedName{Namespace: "test-namespace", Name: "db-credentials"}, &secret))
+	require.Equal(t, map[string][]byte{"password": []byte("s3cr3t"), "user": []byte("admin"), "host": []byte("db.local")}, secret.Data, "Test secret data")
+	require.Equal(t, map[string]string{"app": "db"}, secret.Labels, "Test secret labels from template")
+	require.Equal(t, corev1.SecretTypeOpaque, secret.Type, "Test default secret type")
+	require.True(t, metav1.IsControlledBy(&secret, &updated), "Test secret owned by vaultsecret")
+
+	// Provenance and content hash are recorded as by the webhook
+	provenance, err := api.ParseProvenance(secret)
+	require.Nil(t, err)
+	require.Equal(t, api.Provenance{Placeholder: "vault:db#password", Path: "secret/data/test-namespace/db", Key: "password", ResolvedAt: provenance["password"].ResolvedAt}, provenance["password"], "Test provenance annotation")
+	require.NotContains(t, provenance, "host", "Test plaintext value without provenance")
+	require.Equal(t, api.ContentHash(secret.Data), secret.Annotations[api.AnnotationContentHash], "Test content hash annotation")
+
+	ready := meta.FindStatusCondition(updated.Status.Conditions, v1alpha1.ConditionReady)
+	require.NotNil(t, ready)
+	require.Equal(t, metav1.ConditionTrue, ready.Status, "Test ready condition")
+	require.Equal(t, v1alpha1.ReasonSynced, ready.Reason)
+	require.Equal(t, int64(1), updated.Status.ObservedGeneration)
+	require.Equal(t, "db-credentials", updated.Status.SecretName)
+	require.NotNil(t, updated.Status.LastRefreshTime)
+
+	// Values changed in Vault are written on refresh
+	vault.Values["secret/data/test-namespace/db#password"] = "n3w-s3cr3t"
+	reconcile(t, r)
+	require.Nil(t, r.Client.Get(ctx, types.NamespacedName{Namespace: "test-namespace", Name: "db-credentials"}, &secret))
+	require.Equal(t, []byte("n3w-s3cr3t"), secret.Data["password"], "Test secret refreshed")
+
+	// Unchanged values keep their resolution time, secrets aren't updated
+	resolvedAt := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	provenance, err = api.ParseProvenance(secret)
+	require.Nil(t, err)
+	for key, p := range provenance {
+		p.ResolvedAt = resolvedAt
+		provenance[key] = p
+	}
+	raw, err := json.Marshal(provenance)
+	require.Nil(t, err)
+	secret.Annotations[api.AnnotationProvenance] = string(raw)
+	require.Nil(t, r.Client.Update(ctx, &secret))
+	version := secret.ResourceVersion
+	reconcile(t, r)
+	require.Nil(t, r.Client.Get(ctx, types.NamespacedName{Namespace: "test-namespace", Name: "db-credentials"}, &secret))
+	require.Equal(t, version, secret.ResourceVersion, "Test unchanged secret not updated")
+}
+
+func TestVaultSecretReconciler_ReconcileErrors(t *testing.T) {
+
+	foreign := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "test-namespace"}}
+
+	var reconcileTests = []struct {
+		description string
+		data        map[string]string
+		objects     []client.Object
+		reason      string
+		requeue     time.Duration
+	}{
+		{"Test reference without prefix", map[string]string{"password": "db#password"}, nil, v1alpha1.ReasonInvalidReference, 0},
+		{"Test malformed reference", map[string]string{"password": "vault:db"}, nil, v1alpha1.ReasonInvalidReference, 0},
+		{"Test missing vault secret", map[string]string{"password": "vault:missing#password"}, nil, v1alpha1.ReasonVaultError, retryInterval},
+		{"Test endpoint not allowed", map[string]string{"password": "vault@prod:db#password"}, nil, v1alpha1.ReasonInvalidReference, 0},
+		{"Test generate placeholder", map[string]string{"password": "vault-generate:db#password"}, nil, v1alpha1.ReasonInvalidReference, 0},
+		{"Test secret not owned", map[string]string{"password": "vault:db#password"}, []client.Object{foreign}, v1alpha1.ReasonSecretConflict, 0},
+	}
+
+	for _, test := range reconcileTests {
+		vault := fakeVaultClient{Values: map[string]string{"secret/data/test-namespace/db#password": "s3cr3t"}}
+		objects := append([]client.Object{vaultSecret(v1alpha1.VaultSecretSpec{Data: test.data})}, test.objects...)
+		r := newReconciler(t, vault, objects...)
+
+		result, updated := reconcile(t, r)
+		require.Equal(t, test.requeue, result.RequeueAfter, test.description)
+
+		ready := meta.FindStatusCondition(updated.Status.Conditions, v1alpha1.ConditionReady)
+		require.NotNil(t, ready, test.description)
+		require.Equal(t, metav1.ConditionFalse, ready.Status, test.description)
+		require.Equal(t, test.reason, ready.Reason, test.description)
+		require.NotContains(t, ready.Message, "s3cr3t", test.description)
+	}
+
+	// Foreign secret is left unchanged
+	r := newReconciler(t, fakeVaultClient{Values: map[string]string{"secret/data/test-namespace/db#password": "s3cr3t"}}, vaultSecret(v1alpha1.VaultSecretSpec{Data: map[string]string{"password": "vault:db#password"}}), foreign.DeepCopy())
+	reconcile(t, r)
+	var secret corev1.Secret
+	require.Nil(t, r.Client.Get(context.Background(), types.NamespacedName{Namespace: "test-namespace", Name: "db"}, &secret))
+	require.Empty(t, secret.Data, "Test foreign secret unchanged")
+}
@@ -0,0 +1,167 @@
+package filestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ouest-France/k8s-vault-webhook/filewatch"
+	"github.com/Ouest-France/k8s-vault-webhook/vault"
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// extensions are the file extensions of secrets, YAML is a superset of JSON
+var extensions = []string{".yaml", ".yml", ".json"}
+
+// Store answers secret reads from a directory tree of YAML or JSON files
+// mirroring Vault layout, for development clusters without Vault. The
+// secret at Vault path "secret/data/app/db" is read from the file
+// "secret/data/app/db.yaml" under root, holding a map of keys to values.
+type Store struct {
+	Root   string
+	Logger *logrus.Logger
+
+	mu      sync.RWMutex
+	secrets map[string]map[string]interface{}
+}
+
+// New returns a store with secrets loaded from files under root
+func New(root string, logger *logrus.Logger) (*Store, error) {
+	s := &Store{Root: root, Logger: logger}
+	err := s.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Watch reloads secrets when files under root change, previous secrets are
+// kept if files are invalid. Watch blocks until stop is closed.
+func (s *Store) Watch(interval time.Duration, stop <-chan struct{}) {
+	filewatch.WatchTree(interval, stop, func() {
+		err := s.reload()
+		if err != nil {
+			s.Logger.WithError(err).Error("failed to reload file store secrets, keeping previous ones")
+			return
+		}
+		s.Logger.Info("file store secrets reloaded")
+	}, s.Root)
+}
+
+// reload reads all secret files under root, hidden files and directories
+// such as Kubernetes ConfigMap "..data" links are skipped
+func (s *Store) reload() error {
+	secrets := map[string]map[string]interface{}{}
+	files := map[string]string{}
+
+	err := filepath.Walk(s.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != s.Root && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		ext := filepath.Ext(path)
+		known := false
+		for _, e := range extensions {
+			if ext == e {
+				known = true
+			}
+		}
+		if !known {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Root, path)
+		if err != nil {
+			return err
+		}
+		secretPath := filepath.ToSlash(strings.TrimSuffix(rel, ext))
+		if other, ok := files[secretPath]; ok {
+			return fmt.Errorf("files %q and %q define the same secret %q", other, path, secretPath)
+		}
+		files[secretPath] = path
+
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read file %q: %s", path, err)
+		}
+		data := map[string]interface{}{}
+		err = yaml.Unmarshal(raw, &data)
+		if err != nil {
+			return fmt.Errorf("failed to parse file %q: %s", path, err)
+		}
+		secrets[secretPath] = data
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load file store at %q: %s", s.Root, err)
+	}
+
+	s.mu.Lock()
+	s.secrets = secrets
+	s.mu.Unlock()
+
+	return nil
+}
+
+// secret returns the keys of the secret at a Vault path
+func (s *Store) secret(path string) (map[string]interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok := s.secrets[strings.Trim(path, "/")]
+	return data, ok
+}
+
+// Read returns the value of a secret key, missing secrets and keys return a
+// fallback value with a vault.FallbackError as the Vault client does
+func (s *Store) Read(path, key string) (string, error) {
+	data, ok := s.secret(path)
+	if !ok {
+		return fallback("secret %q does not exist in file store", path)
+	}
+
+	value, ok := data[key]
+	if !ok || value == nil {
+		return fallback("key %q not found in file store", key)
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+
+	return fallback("key %q is not a string in file store", key)
+}
+
+// Exists returns true if a secret exists at path
+func (s *Store) Exists(path string) (bool, error) {
+	_, ok := s.secret(path)
+	return ok, nil
+}
+
+// fallback returns a message as fallback value with a vault.FallbackError
+func fallback(format string, a ...interface{}) (string, error) {
+	msg := fmt.Sprintf(format, a...)
+	return msg, vault.FallbackError{Message: msg}
+}
@@ -0,0 +1,100 @@
+package filestore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Ouest-France/k8s-vault-webhook/vault"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFile writes a file under root, creating directories
+func writeFile(t *testing.T, root, name, content string) {
+	path := filepath.Join(root, name)
+	require.Nil(t, os.MkdirAll(filepath.Dir(path), 0700))
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+}
+
+func TestStore_Read(t *testing.T) {
+
+	root := t.TempDir()
+	writeFile(t, root, "secret/data/app/db.yaml", "password: s3cr3t\nport: 5432\ntls: true\nnested:\n  key: value\n")
+	writeFile(t, root, "secret/data/app/api.json", `{"token": "t0k3n"}`)
+	writeFile(t, root, "secret/data/app/README.md", "not a secret")
+	writeFile(t, root, "..2023_05_01/secret/data/app/hidden.yaml", "password: hidden")
+
+	store, err := New(root, logrus.New())
+	require.Nil(t, err)
+
+	var readTests = []struct {
+		description string
+		path        string
+		key         string
+		value       string
+		fallback    bool
+	}{
+		{"Test yaml string", "secret/data/app/db", "password", "s3cr3t", false},
+		{"Test yaml number", "secret/data/app/db", "port", "5432", false},
+		{"Test yaml bool", "secret/data/app/db", "tls", "true", false},
+		{"Test json string", "secret/data/app/api", "token", "t0k3n", false},
+		{"Test slashes trimmed", "/secret/data/app/api/", "token", "t0k3n", false},
+		{"Test nested value", "secret/data/app/db", "nested", `key "nested" is not a string in file store`, true},
+		{"Test missing key", "secret/data/app/db", "user", `key "user" not found in file store`, true},
+		{"Test missing secret", "secret/data/app/other", "password", `secret "secret/data/app/other" does not exist in file store`, true},
+		{"Test hidden directory skipped", "..2023_05_01/secret/data/app/hidden", "password", `secret "..2023_05_01/secret/data/app/hidden" does not exist in file store`, true},
+	}
+
+	for _, test := range readTests {
+		value, err := store.Read(test.path, test.key)
+		require.Equal(t, test.value, value, test.description)
+		if test.fallback {
+			var fallback vault.FallbackError
+			require.True(t, errors.As(err, &fallback), test.description)
+			continue
+		}
+		require.Nil(t, err, test.description)
+	}
+
+	exists, err := store.Exists("secret/data/app/db")
+	require.Nil(t, err)
+	require.True(t, exists, "Test existing secret")
+	exists, err = store.Exists("secret/data/app/other")
+	require.Nil(t, err)
+	require.False(t, exists, "Test missing secret")
+}
+
+func TestStore_reload(t *testing.T) {
+
+	root := t.TempDir()
+	writeFile(t, root, "app/db.yaml", "password: s3cr3t")
+
+	store, err := New(root, logrus.New())
+	require.Nil(t, err)
+
+	// Changed files are reloaded
+	writeFile(t, root, "app/db.yaml", "password: n3w-s3cr3t")
+	require.Nil(t, store.reload())
+	value, err := store.Read("app/db", "password")
+	require.Nil(t, err)
+	require.Equal(t, "n3w-s3cr3t", value, "Test reloaded value")
+
+	// Invalid files keep previous secrets
+	writeFile(t, root, "app/db.yaml", "password: [")
+	require.Error(t, store.reload(), "Test invalid file")
+	value, err = store.Read("app/db", "password")
+	require.Nil(t, err)
+	require.Equal(t, "n3w-s3cr3t", value, "Test previous value kept")
+
+	// Secrets defined twice are rejected
+	writeFile(t, root, "app/db.yaml", "password: s3cr3t")
+	writeFile(t, root, "app/db.json", `{"password": "other"}`)
+	require.Error(t, store.reload(), "Test duplicate secret")
+
+	// Missing root fails
+	_, err = New(filepath.Join(root, "missing"), logrus.New())
+	require.Error(t, err, "Test missing root")
+}
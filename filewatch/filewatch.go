@@ -0,0 +1,79 @@
+package filewatch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Watch polls files at interval and calls onChange when one of them is
+// created, modified or removed. Polling is used rather than inotify because
+// Kubernetes updates mounted Secrets and ConfigMaps by swapping symlinks,
+// which inotify watches on the file itself do not report. Watch blocks until
+// stop is closed.
+func Watch(interval time.Duration, stop <-chan struct{}, onChange func(), paths ...string) {
+	poll(interval, stop, onChange, func() string { return state(paths) })
+}
+
+// WatchTree polls files in a directory tree at interval and calls onChange
+// when one of them is created, modified or removed. WatchTree blocks until
+// stop is closed.
+func WatchTree(interval time.Duration, stop <-chan struct{}, onChange func(), root string) {
+	poll(interval, stop, onChange, func() string { return treeState(root) })
+}
+
+// poll calls onChange when a fingerprint changes, until stop is closed
+func poll(interval time.Duration, stop <-chan struct{}, onChange func(), fingerprint func() string) {
+	last := fingerprint()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			current := fingerprint()
+			if current != last {
+				last = current
+				onChange()
+			}
+		}
+	}
+}
+
+// state returns a fingerprint of files modification times and sizes
+func state(paths []string) string {
+	fingerprint := ""
+	for _, path := range paths {
+		fingerprint += fmt.Sprintf("%s:%s;", path, fileState(path))
+	}
+
+	return fingerprint
+}
+
+// treeState returns a fingerprint of the files of a directory tree, in
+// lexical order, following symlinks
+func treeState(root string) string {
+	paths := []string{}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+
+	return state(paths)
+}
+
+// fileState returns a file modification time and size, following symlinks
+func fileState(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "absent"
+	}
+
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+}
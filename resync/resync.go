@@ -0,0 +1,323 @@
+// Package resync updates Secrets mutated by the webhook when the Vault
+// secrets their values were resolved from have a newer KV version
+package resync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ouest-France/k8s-vault-webhook/api"
+	"github.com/Ouest-France/k8s-vault-webhook/rollout"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// AnnotationRolloutPending is set on Secrets updated with newer values
+	// until the workloads using them are restarted, so that failed restarts
+	// are retried by any leader
+	AnnotationRolloutPending = "k8s-vault-webhook.ouest-france.fr/rollout-pending"
+
+	// Event reasons recorded on resynced Secrets
+	ReasonResynced      = "VaultResynced"
+	ReasonResyncFailed  = "VaultResyncFailed"
+	ReasonRolloutFailed = "VaultRolloutFailed"
+
+	// listLimit is the number of Secrets listed per page
+	listLimit = 500
+)
+
+var (
+	secretResynced     = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_secret_resynced", Help: "The total number of secrets updated with newer Vault versions"})
+	secretResyncFailed = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_secret_resync_failed", Help: "The total number of secrets failed to resync"})
+)
+
+// timeNow returns the current time, replaced in tests
+var timeNow = time.Now
+
+// VaultClient interface is implemented by Vault clients able to read the
+// current KV version of a secret from its metadata
+type VaultClient interface {
+	api.VaultVersionReader
+	CurrentVersion(path string) (int, error)
+}
+
+// Reconciler periodically compares the KV versions recorded in provenance
+// annotations of mutated Secrets with the current Vault versions, and updates
+// Secrets with values of newer versions. Only the elected leader updates
+// Secrets. Workloads using updated Secrets are restarted if Rollout is set,
+// Secrets are annotated until their restart succeeds so that failed restarts
+// are retried on next runs, by this leader or the next one.
+// Recorded Vault paths are checked against placeholders templated with the
+// vault Pattern.
+type Reconciler struct {
+	Client      kubernetes.Interface
+	Vault       VaultClient
+	Endpoints   map[string]VaultClient
+	Pattern     string
+	Recorder    record.EventRecorder
+	Interval    time.Duration
+	Jitter      float64
+	Concurrency int
+	Rollout     *rollout.Trigger
+	Namespace   string
+	LeaseName   string
+	Identity    string
+	Logger      *logrus.Logger
+}
+
+// Start runs leader election until stop is closed, the leader resyncs
+// Secrets every interval as long as it holds the lease
+func (r *Reconciler) Start(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	go r.runLeaderElection(ctx)
+}
+
+// runLeaderElection campaigns for leadership until ctx is done
+func (r *Reconciler) runLeaderElection(ctx context.Context) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      r.LeaseName,
+			Namespace: r.Namespace,
+		},
+		Client:     r.Client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: r.Identity},
+	}
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   30 * time.Second,
+			RenewDeadline:   20 * time.Second,
+			RetryPeriod:     5 * time.Second,
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					r.Logger.Info("elected as resync leader")
+					wait.JitterUntilWithContext(ctx, r.Run, r.Interval, r.Jitter, false)
+				},
+				OnStoppedLeading: func() {
+					r.Logger.Info("stopped being resync leader")
+				},
+			},
+		})
+	}
+}
+
+// Run resyncs all Secrets with provenance annotations, at most Concurrency
+// Secrets at a time
+func (r *Reconciler) Run(ctx context.Context) {
+	concurrency := r.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	opts := metav1.ListOptions{Limit: listLimit}
+	for {
+		secrets, err := r.Client.CoreV1().Secrets("").List(ctx, opts)
+		if err != nil {
+			r.Logger.WithError(err).Error("failed to list secrets to resync")
+			break
+		}
+
+		for i := range secrets.Items {
+			secret := secrets.Items[i]
+			if _, ok := secret.Annotations[api.AnnotationProvenance]; !ok {
+				continue
+			}
+
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				r.resyncSecret(ctx, secret)
+			}()
+		}
+
+		if secrets.Continue == "" {
+			break
+		}
+		opts.Continue = secrets.Continue
+	}
+
+	wg.Wait()
+}
+
+// resyncSecret resyncs a Secret, logging and recording the result as event
+func (r *Reconciler) resyncSecret(ctx context.Context, secret corev1.Secret) {
+	logger := r.Logger.WithFields(logrus.Fields{
+		"kubernetes_secret_name":      secret.Name,
+		"kubernetes_secret_namespace": secret.Namespace,
+	})
+
+	updated, keys, err := r.Resync(ctx, secret)
+	if err != nil {
+		secretResyncFailed.Inc()
+		logger.WithError(err).Error("failed to resync secret")
+		r.Recorder.Eventf(&secret, corev1.EventTypeWarning, ReasonResyncFailed, "Failed to resync secret: %s", err)
+		return
+	}
+	if len(keys) == 0 {
+		if _, ok := secret.Annotations[AnnotationRolloutPending]; ok && r.Rollout != nil {
+			r.rollout(ctx, logger, secret)
+		}
+		return
+	}
+
+	secretResynced.Inc()
+	logger.WithField("keys", keys).Info("kubernetes secret resynced with newer vault versions")
+	r.Recorder.Eventf(&secret, corev1.EventTypeNormal, ReasonResynced, "Updated keys %s with newer Vault versions", strings.Join(keys, ", "))
+
+	if r.Rollout == nil {
+		return
+	}
+	r.rollout(ctx, logger, *updated)
+}
+
+// rollout restarts the workloads using an updated Secret and clears its
+// pending annotation, failures are recorded as event and the annotation is
+// kept to retry on next runs
+func (r *Reconciler) rollout(ctx context.Context, logger *logrus.Entry, secret corev1.Secret) {
+	_, err := r.Rollout.Rollout(ctx, secret)
+	if err != nil {
+		logger.WithError(err).Error("failed to restart workloads using secret, retrying on next resync")
+		r.Recorder.Eventf(&secret, corev1.EventTypeWarning, ReasonRolloutFailed, "Failed to restart workloads using secret: %s", err)
+		return
+	}
+
+	update := secret.DeepCopy()
+	delete(update.Annotations, AnnotationRolloutPending)
+	_, err = r.Client.CoreV1().Secrets(secret.Namespace).Update(ctx, update, metav1.UpdateOptions{})
+	if err != nil {
+		logger.WithError(err).Error("failed to clear pending rollout of secret, retrying on next resync")
+	}
+}
+
+// Resync updates the values of a Secret whose Vault secrets have a newer KV
+// version than recorded in provenance, and returns the updated Secret and
+// data keys.
+// Secrets with data changed since mutation and values with unknown version
+// are left unchanged, and nothing is written if any newer value can't be read
+// or any recorded path doesn't match its placeholder.
+func (r *Reconciler) Resync(ctx context.Context, secret corev1.Secret) (*corev1.Secret, []string, error) {
+
+	// Secret data changed outside of the webhook is never overwritten
+	if secret.Annotations[api.AnnotationContentHash] != api.ContentHash(secret.Data) {
+		return nil, nil, nil
+	}
+
+	provenance, err := api.ParseProvenance(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]string, 0, len(provenance))
+	for key := range provenance {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	data := map[string][]byte{}
+	for key, value := range secret.Data {
+		data[key] = value
+	}
+
+	// Vault secrets are read once per endpoint and path
+	versions := map[string]int{}
+	updated := []string{}
+	for _, key := range keys {
+		// Only values read from Vault have versions to resync
+		p := provenance[key]
+		if p.Version == 0 || (p.Scheme != "" && p.Scheme != api.SchemeVault) {
+			continue
+		}
+
+		// Recorded paths must be those of the placeholder for the secret
+		// namespace and name, the webhook token can read other namespaces
+		path, vaultKey, err := api.PlaceholderRef(r.Pattern, secret, p.Placeholder)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to check provenance of key %q: %s", key, err)
+		}
+		if path != p.Path || vaultKey != p.Key {
+			return nil, nil, fmt.Errorf("provenance of key %q doesn't match placeholder '%s' with vault pattern", key, p.Placeholder)
+		}
+
+		// Values are read from the Vault endpoint they were resolved from,
+		// values of endpoints no longer configured are left unchanged
+		vc := r.Vault
+		if p.Endpoint != "" && p.Endpoint != api.DefaultVaultEndpoint {
+			var ok bool
+			vc, ok = r.Endpoints[p.Endpoint]
+			if !ok {
+				continue
+			}
+		}
+
+		current, ok := versions[p.Endpoint+"@"+p.Path]
+		if !ok {
+			current, err = vc.CurrentVersion(p.Path)
+			if err != nil {
+				return nil, nil, err
+			}
+			versions[p.Endpoint+"@"+p.Path] = current
+		}
+		if current <= p.Version {
+			continue
+		}
+
+		// Fallback values of missing secrets are never written
+		value, version, err := vc.ReadVersion(p.Path, p.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read key %q of secret %q: %s", p.Key, p.Path, err)
+		}
+
+		data[key] = []byte(value)
+		p.Version = version
+		p.ResolvedAt = timeNow().UTC().Truncate(time.Second)
+		provenance[key] = p
+		updated = append(updated, key)
+	}
+	if len(updated) == 0 {
+		return nil, nil, nil
+	}
+
+	provenanceJSON, err := json.Marshal(provenance)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal provenance annotation: %s", err)
+	}
+
+	// Resource version makes concurrent changes fail the update
+	update := secret.DeepCopy()
+	update.Data = data
+	update.Annotations[api.AnnotationProvenance] = string(provenanceJSON)
+	update.Annotations[api.AnnotationContentHash] = api.ContentHash(data)
+	if r.Rollout != nil {
+		update.Annotations[AnnotationRolloutPending] = "true"
+	}
+	update, err = r.Client.CoreV1().Secrets(secret.Namespace).Update(ctx, update, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to update secret: %s", err)
+	}
+
+	return update, updated, nil
+}
@@ -0,0 +1,242 @@
+package resync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ouest-France/k8s-vault-webhook/api"
+	"github.com/Ouest-France/k8s-vault-webhook/rollout"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+// Fake Vault client for testing, values are keyed by path#key
+type fakeVaultClient struct {
+	Values   map[string]string
+	Versions map[string]int
+}
+
+func (f fakeVaultClient) ReadVersion(path, key string) (string, int, error) {
+	value, ok := f.Values[path+"#"+key]
+	if !ok {
+		return "secret does not exist in Vault", 0, errors.New("secret does not exist in Vault")
+	}
+	return value, f.Versions[path], nil
+}
+
+func (f fakeVaultClient) CurrentVersion(path string) (int, error) {
+	version, ok := f.Versions[path]
+	if !ok {
+		return 0, errors.New("secret does not exist in Vault")
+	}
+	return version, nil
+}
+
+// testPattern is the vault pattern of mutated secrets
+const testPattern = "secret/data/{{.Namespace}}/{{.Secret}}"
+
+// mutatedSecret returns a secret as mutated by the webhook, with provenance
+// recorded at version for all keys
+func mutatedSecret(t *testing.T, name string, data map[string]string, version int) *corev1.Secret {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test-namespace"}, Data: map[string][]byte{}}
+	provenance := map[string]api.Provenance{}
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+		provenance[key] = api.Provenance{Placeholder: "vault:db#" + key, Path: "secret/data/test-namespace/db", Key: key, Version: version}
+	}
+
+	raw, err := json.Marshal(provenance)
+	require.Nil(t, err)
+	secret.Annotations = map[string]string{
+		api.AnnotationProvenance:  string(raw),
+		api.AnnotationContentHash: api.ContentHash(secret.Data),
+	}
+
+	return secret
+}
+
+func TestReconciler_Run(t *testing.T) {
+
+	timeNow = func() time.Time { return time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC) }
+	defer func() { timeNow = time.Now }()
+
+	ctx := context.Background()
+	vault := fakeVaultClient{
+		Values:   map[string]string{"secret/data/test-namespace/db#password": "n3w-s3cr3t", "secret/data/test-namespace/db#user": "admin"},
+		Versions: map[string]int{"secret/data/test-namespace/db": 3},
+	}
+
+	outdated := mutatedSecret(t, "outdated", map[string]string{"password": "s3cr3t", "user": "admin"}, 2)
+	current := mutatedSecret(t, "current", map[string]string{"password": "n3w-s3cr3t"}, 3)
+	unknown := mutatedSecret(t, "unknown", map[string]string{"password": "s3cr3t"}, 0)
+	modified := mutatedSecret(t, "modified", map[string]string{"password": "s3cr3t"}, 2)
+	modified.Data["password"] = []byte("plaintext")
+	other := mutatedSecret(t, "other", map[string]string{"password": "s3cr3t"}, 2)
+	other.Annotations[api.AnnotationProvenance] = strings.Replace(other.Annotations[api.AnnotationProvenance], `"path"`, `"scheme":"file","path"`, 1)
+	plain := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "test-namespace"}, Data: map[string][]byte{"password": []byte("plaintext")}}
+
+	client := fake.NewSimpleClientset(outdated, current, unknown, modified, other, plain)
+	recorder := record.NewFakeRecorder(10)
+	r := &Reconciler{Client: client, Vault: vault, Recorder: recorder, Concurrency: 2, Pattern: testPattern, Logger: logrus.New()}
+	r.Run(ctx)
+
+	// Outdated secret is updated with values and provenance of newer version
+	secret, err := client.CoreV1().Secrets("test-namespace").Get(ctx, "outdated", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, map[string][]byte{"password": []byte("n3w-s3cr3t"), "user": []byte("admin")}, secret.Data, "Test outdated secret updated")
+	require.Equal(t, api.ContentHash(secret.Data), secret.Annotations[api.AnnotationContentHash], "Test content hash updated")
+	provenance, err := api.ParseProvenance(*secret)
+	require.Nil(t, err)
+	require.Equal(t, 3, provenance["password"].Version, "Test provenance version updated")
+	require.Equal(t, timeNow(), provenance["password"].ResolvedAt)
+	require.Equal(t, 3, provenance["user"].Version)
+
+	require.Len(t, recorder.Events, 1, "Test only updated secret has an event")
+	require.Equal(t, "Normal VaultResynced Updated keys password, user with newer Vault versions", <-recorder.Events)
+
+	// Other secrets are left unchanged
+	for _, expected := range []*corev1.Secret{current, unknown, modified, other, plain} {
+		secret, err := client.CoreV1().Secrets("test-namespace").Get(ctx, expected.Name, metav1.GetOptions{})
+		require.Nil(t, err)
+		require.Equal(t, expected.Data, secret.Data, "Test %s secret unchanged", expected.Name)
+		require.Equal(t, expected.Annotations, secret.Annotations, "Test %s secret annotations unchanged", expected.Name)
+	}
+}
+
+func TestReconciler_RunFailure(t *testing.T) {
+
+	ctx := context.Background()
+
+	// Newer version without the recorded key is never written
+	vault := fakeVaultClient{
+		Values:   map[string]string{},
+		Versions: map[string]int{"secret/data/test-namespace/db": 3},
+	}
+	outdated := mutatedSecret(t, "outdated", map[string]string{"password": "s3cr3t"}, 2)
+
+	client := fake.NewSimpleClientset(outdated)
+	recorder := record.NewFakeRecorder(10)
+	r := &Reconciler{Client: client, Vault: vault, Recorder: recorder, Pattern: testPattern, Logger: logrus.New()}
+	r.Run(ctx)
+
+	secret, err := client.CoreV1().Secrets("test-namespace").Get(ctx, "outdated", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, outdated.Data, secret.Data, "Test failed secret unchanged")
+
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, "Warning VaultResyncFailed Failed to resync secret")
+}
+
+func TestReconciler_ResyncEndpoints(t *testing.T) {
+
+	ctx := context.Background()
+	prod := fakeVaultClient{
+		Values:   map[string]string{"secret/data/test-namespace/db#password": "pr0d-s3cr3t"},
+		Versions: map[string]int{"secret/data/test-namespace/db": 3},
+	}
+
+	secret := mutatedSecret(t, "endpoints", map[string]string{"password": "s3cr3t", "user": "admin"}, 2)
+	provenance, err := api.ParseProvenance(*secret)
+	require.Nil(t, err)
+	password := provenance["password"]
+	password.Endpoint = "prod"
+	provenance["password"] = password
+	user := provenance["user"]
+	user.Endpoint = "removed"
+	provenance["user"] = user
+	raw, err := json.Marshal(provenance)
+	require.Nil(t, err)
+	secret.Annotations[api.AnnotationProvenance] = string(raw)
+
+	// Values are read from the endpoint they were resolved from, the default
+	// Vault client has no secrets and endpoints no longer configured are skipped
+	client := fake.NewSimpleClientset(secret)
+	r := &Reconciler{Client: client, Vault: fakeVaultClient{}, Endpoints: map[string]VaultClient{"prod": prod}, Pattern: testPattern, Logger: logrus.New()}
+	updated, keys, err := r.Resync(ctx, *secret)
+	require.Nil(t, err)
+	require.Equal(t, []string{"password"}, keys, "Test only prod endpoint key updated")
+	require.Equal(t, []byte("pr0d-s3cr3t"), updated.Data["password"], "Test value read from prod endpoint")
+	require.Equal(t, []byte("admin"), updated.Data["user"], "Test removed endpoint value unchanged")
+}
+
+func TestReconciler_ResyncPathMismatch(t *testing.T) {
+
+	ctx := context.Background()
+	vault := fakeVaultClient{
+		Values:   map[string]string{"secret/data/other-namespace/db#password": "0th3r-s3cr3t"},
+		Versions: map[string]int{"secret/data/other-namespace/db": 3},
+	}
+
+	// Paths not matching the placeholder for the secret namespace are never read
+	secret := mutatedSecret(t, "forged", map[string]string{"password": "s3cr3t"}, 2)
+	secret.Annotations[api.AnnotationProvenance] = strings.Replace(secret.Annotations[api.AnnotationProvenance], "test-namespace", "other-namespace", 1)
+
+	r := &Reconciler{Client: fake.NewSimpleClientset(secret), Vault: vault, Pattern: testPattern, Logger: logrus.New()}
+	_, _, err := r.Resync(ctx, *secret)
+	require.EqualError(t, err, `provenance of key "password" doesn't match placeholder 'vault:db#password' with vault pattern`)
+}
+
+func TestReconciler_RunRolloutRetry(t *testing.T) {
+
+	ctx := context.Background()
+	vault := fakeVaultClient{
+		Values:   map[string]string{"secret/data/test-namespace/db#password": "n3w-s3cr3t"},
+		Versions: map[string]int{"secret/data/test-namespace/db": 3},
+	}
+
+	outdated := mutatedSecret(t, "outdated", map[string]string{"password": "s3cr3t"}, 2)
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-namespace"}}
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "app", EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "outdated"}}}}}}
+
+	// First restart fails
+	client := fake.NewSimpleClientset(outdated, deployment)
+	failed := false
+	client.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failed {
+			return false, nil, nil
+		}
+		failed = true
+		return true, nil, errors.New("deployment patch failed")
+	})
+
+	recorder := record.NewFakeRecorder(10)
+	logger := logrus.New()
+	r := &Reconciler{Client: client, Vault: vault, Recorder: recorder, Pattern: testPattern, Logger: logger}
+	r.Rollout = &rollout.Trigger{Client: client, Recorder: recorder, Logger: logger}
+	r.Run(ctx)
+
+	require.Len(t, recorder.Events, 2)
+	require.Equal(t, "Normal VaultResynced Updated keys password with newer Vault versions", <-recorder.Events)
+	require.Contains(t, <-recorder.Events, "Warning VaultRolloutFailed Failed to restart workloads using secret", "Test failed rollout event")
+	secret, err := client.CoreV1().Secrets("test-namespace").Get(ctx, "outdated", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Contains(t, secret.Annotations, AnnotationRolloutPending, "Test pending rollout annotation")
+
+	// Failed restart is retried on next run although the secret is current,
+	// by another leader too
+	r = &Reconciler{Client: client, Vault: vault, Recorder: recorder, Pattern: testPattern, Logger: logger, Rollout: r.Rollout}
+	r.Run(ctx)
+	updated, err := client.AppsV1().Deployments("test-namespace").Get(ctx, "app", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Contains(t, updated.Spec.Template.Annotations[rollout.AnnotationSecretHashes], "outdated", "Test rollout retried")
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, "Normal VaultSecretRolledOut")
+	secret, err = client.CoreV1().Secrets("test-namespace").Get(ctx, "outdated", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.NotContains(t, secret.Annotations, AnnotationRolloutPending, "Test pending rollout annotation cleared")
+
+	// Successful restart isn't retried
+	r.Run(ctx)
+	require.Len(t, recorder.Events, 0, "Test rollout not retried")
+}
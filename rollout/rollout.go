@@ -0,0 +1,198 @@
+// Package rollout triggers rolling restarts of workloads using a Secret
+// whose Vault values changed
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Ouest-France/k8s-vault-webhook/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// AnnotationSecretHashes is the pod template annotation recording the
+	// content hash of each Secret used by a workload as a JSON object, a
+	// changed hash triggers a rolling restart
+	AnnotationSecretHashes = "k8s-vault-webhook.ouest-france.fr/secret-hashes"
+
+	// ReasonRolledOut is the event reason recorded on restarted workloads
+	ReasonRolledOut = "VaultSecretRolledOut"
+)
+
+var workloadRolledOut = promauto.NewCounter(prometheus.CounterOpts{Name: "webhook_workload_rolled_out", Help: "The total number of workloads restarted after a secret change"})
+
+// Trigger patches the pod template of Deployments, StatefulSets and
+// DaemonSets using a Secret with its content hash to restart their pods
+type Trigger struct {
+	Client   kubernetes.Interface
+	Recorder record.EventRecorder
+	Logger   *logrus.Logger
+}
+
+// workload is a Deployment, StatefulSet or DaemonSet pod template
+type workload struct {
+	Kind     string
+	Object   runtime.Object
+	Name     string
+	Template corev1.PodTemplateSpec
+	Patch    func(ctx context.Context, name string, data []byte) error
+}
+
+// Rollout restarts the workloads in the Secret namespace using the Secret
+// and returns them as kind/name. Workloads already restarted for the Secret
+// content hash are left unchanged.
+func (t *Trigger) Rollout(ctx context.Context, secret corev1.Secret) ([]string, error) {
+	hash := secret.Annotations[api.AnnotationContentHash]
+	if hash == "" {
+		return nil, fmt.Errorf("secret %q has no content hash annotation", secret.Name)
+	}
+
+	workloads, err := t.workloads(ctx, secret.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	restarted := []string{}
+	for _, w := range workloads {
+		if !UsesSecret(w.Template.Spec, secret.Name) {
+			continue
+		}
+
+		hashes := map[string]string{}
+		if raw, ok := w.Template.Annotations[AnnotationSecretHashes]; ok {
+			// Invalid annotations are replaced
+			_ = json.Unmarshal([]byte(raw), &hashes)
+		}
+		if hashes[secret.Name] == hash {
+			continue
+		}
+		hashes[secret.Name] = hash
+
+		patch, err := hashesPatch(hashes)
+		if err != nil {
+			return restarted, err
+		}
+		err = w.Patch(ctx, w.Name, patch)
+		if err != nil {
+			return restarted, fmt.Errorf("failed to patch %s %q: %s", w.Kind, w.Name, err)
+		}
+
+		workloadRolledOut.Inc()
+		t.Logger.WithFields(logrus.Fields{
+			"kubernetes_secret_name":      secret.Name,
+			"kubernetes_secret_namespace": secret.Namespace,
+			"kubernetes_workload":         w.Kind + "/" + w.Name,
+		}).Info("workload restarted after secret change")
+		t.Recorder.Eventf(w.Object, corev1.EventTypeNormal, ReasonRolledOut, "Restarting pods after secret %q change", secret.Name)
+		restarted = append(restarted, w.Kind+"/"+w.Name)
+	}
+
+	return restarted, nil
+}
+
+// workloads returns the Deployments, StatefulSets and DaemonSets of a namespace
+func (t *Trigger) workloads(ctx context.Context, namespace string) ([]workload, error) {
+	apps := t.Client.AppsV1()
+	workloads := []workload{}
+
+	deployments, err := apps.Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployments: %s", err)
+	}
+	for i := range deployments.Items {
+		d := &deployments.Items[i]
+		workloads = append(workloads, workload{Kind: "Deployment", Object: d, Name: d.Name, Template: d.Spec.Template, Patch: func(ctx context.Context, name string, data []byte) error {
+			_, err := apps.Deployments(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+			return err
+		}})
+	}
+
+	statefulSets, err := apps.StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list statefulsets: %s", err)
+	}
+	for i := range statefulSets.Items {
+		s := &statefulSets.Items[i]
+		workloads = append(workloads, workload{Kind: "StatefulSet", Object: s, Name: s.Name, Template: s.Spec.Template, Patch: func(ctx context.Context, name string, data []byte) error {
+			_, err := apps.StatefulSets(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+			return err
+		}})
+	}
+
+	daemonSets, err := apps.DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list daemonsets: %s", err)
+	}
+	for i := range daemonSets.Items {
+		d := &daemonSets.Items[i]
+		workloads = append(workloads, workload{Kind: "DaemonSet", Object: d, Name: d.Name, Template: d.Spec.Template, Patch: func(ctx context.Context, name string, data []byte) error {
+			_, err := apps.DaemonSets(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+			return err
+		}})
+	}
+
+	return workloads, nil
+}
+
+// hashesPatch returns a merge patch setting the secret hashes annotation
+// on a workload pod template
+func hashesPatch(hashes map[string]string) ([]byte, error) {
+	raw, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal secret hashes annotation: %s", err)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{AnnotationSecretHashes: string(raw)},
+				},
+			},
+		},
+	})
+}
+
+// UsesSecret returns true if a pod spec uses a Secret through a volume, a
+// projected volume, envFrom or an env value
+func UsesSecret(spec corev1.PodSpec, name string) bool {
+	for _, v := range spec.Volumes {
+		if v.Secret != nil && v.Secret.SecretName == name {
+			return true
+		}
+		if v.Projected == nil {
+			continue
+		}
+		for _, source := range v.Projected.Sources {
+			if source.Secret != nil && source.Secret.Name == name {
+				return true
+			}
+		}
+	}
+
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, envFrom := range c.EnvFrom {
+			if envFrom.SecretRef != nil && envFrom.SecretRef.Name == name {
+				return true
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
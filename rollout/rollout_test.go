@@ -0,0 +1,112 @@
+package rollout
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Ouest-France/k8s-vault-webhook/api"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// podTemplate returns a pod template with a container using env and volumes
+func podTemplate(container corev1.Container, volumes ...corev1.Volume) corev1.PodTemplateSpec {
+	container.Name = "app"
+	return corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{container}, Volumes: volumes}}
+}
+
+func TestUsesSecret(t *testing.T) {
+
+	secretKeyRef := &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "db"}, Key: "password"}}
+	configMapKeyRef := &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "db"}, Key: "password"}}
+
+	var usesTests = []struct {
+		description string
+		spec        corev1.PodSpec
+		uses        bool
+	}{
+		{"Test secret volume", corev1.PodSpec{Volumes: []corev1.Volume{{Name: "db", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "db"}}}}}, true},
+		{"Test other secret volume", corev1.PodSpec{Volumes: []corev1.Volume{{Name: "db", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "other"}}}}}, false},
+		{"Test projected volume", corev1.PodSpec{Volumes: []corev1.Volume{{Name: "db", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{{Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "db"}}}}}}}}}, true},
+		{"Test envFrom", corev1.PodSpec{Containers: []corev1.Container{{EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "db"}}}}}}}, true},
+		{"Test init container env", corev1.PodSpec{InitContainers: []corev1.Container{{Env: []corev1.EnvVar{{Name: "PASSWORD", ValueFrom: secretKeyRef}}}}}, true},
+		{"Test configmap env", corev1.PodSpec{Containers: []corev1.Container{{Env: []corev1.EnvVar{{Name: "PASSWORD", ValueFrom: configMapKeyRef}}}}}, false},
+		{"Test env value", corev1.PodSpec{Containers: []corev1.Container{{Env: []corev1.EnvVar{{Name: "PASSWORD", Value: "db"}}}}}, false},
+	}
+
+	for _, test := range usesTests {
+		require.Equal(t, test.uses, UsesSecret(test.spec, "db"), test.description)
+	}
+}
+
+func TestTrigger_Rollout(t *testing.T) {
+
+	ctx := context.Background()
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:        "db",
+		Namespace:   "test-namespace",
+		Annotations: map[string]string{api.AnnotationContentHash: "sha256:new"},
+	}}
+
+	envFrom := corev1.Container{EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "db"}}}}}
+	volume := corev1.Volume{Name: "db", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "db"}}}
+	env := corev1.Container{Env: []corev1.EnvVar{{Name: "PASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "db"}, Key: "password"}}}}}
+
+	// Workload already restarted for the secret content hash
+	current := podTemplate(envFrom)
+	current.Annotations = map[string]string{AnnotationSecretHashes: `{"db":"sha256:new"}`}
+
+	// Workload restarted for a previous content hash, other secret hashes are kept
+	previous := podTemplate(corev1.Container{}, volume)
+	previous.Annotations = map[string]string{AnnotationSecretHashes: `{"db":"sha256:old","other":"sha256:other"}`, "app": "previous"}
+
+	client := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "env-from", Namespace: "test-namespace"}, Spec: appsv1.DeploymentSpec{Template: podTemplate(envFrom)}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "current", Namespace: "test-namespace"}, Spec: appsv1.DeploymentSpec{Template: current}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "test-namespace"}, Spec: appsv1.DeploymentSpec{Template: podTemplate(corev1.Container{})}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "other-namespace", Namespace: "other-namespace"}, Spec: appsv1.DeploymentSpec{Template: podTemplate(envFrom)}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "volume", Namespace: "test-namespace"}, Spec: appsv1.StatefulSetSpec{Template: previous}},
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "env", Namespace: "test-namespace"}, Spec: appsv1.DaemonSetSpec{Template: podTemplate(env)}},
+	)
+	recorder := record.NewFakeRecorder(10)
+	trigger := &Trigger{Client: client, Recorder: recorder, Logger: logrus.New()}
+
+	restarted, err := trigger.Rollout(ctx, secret)
+	require.Nil(t, err)
+	require.Equal(t, []string{"Deployment/env-from", "StatefulSet/volume", "DaemonSet/env"}, restarted, "Test restarted workloads")
+	require.Len(t, recorder.Events, 3, "Test event per restarted workload")
+
+	deployment, err := client.AppsV1().Deployments("test-namespace").Get(ctx, "env-from", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, `{"db":"sha256:new"}`, deployment.Spec.Template.Annotations[AnnotationSecretHashes], "Test deployment annotated")
+
+	statefulSet, err := client.AppsV1().StatefulSets("test-namespace").Get(ctx, "volume", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{AnnotationSecretHashes: `{"db":"sha256:new","other":"sha256:other"}`, "app": "previous"}, statefulSet.Spec.Template.Annotations, "Test statefulset annotations merged")
+
+	daemonSet, err := client.AppsV1().DaemonSets("test-namespace").Get(ctx, "env", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, `{"db":"sha256:new"}`, daemonSet.Spec.Template.Annotations[AnnotationSecretHashes], "Test daemonset annotated")
+
+	deployment, err = client.AppsV1().Deployments("test-namespace").Get(ctx, "unrelated", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Empty(t, deployment.Spec.Template.Annotations, "Test unrelated deployment unchanged")
+
+	deployment, err = client.AppsV1().Deployments("other-namespace").Get(ctx, "other-namespace", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Empty(t, deployment.Spec.Template.Annotations, "Test deployment in other namespace unchanged")
+
+	// Rollout is idempotent for a content hash
+	restarted, err = trigger.Rollout(ctx, secret)
+	require.Nil(t, err)
+	require.Empty(t, restarted, "Test no workload restarted twice")
+
+	// Secrets without content hash can't be rolled out
+	_, err = trigger.Rollout(ctx, corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "test-namespace"}})
+	require.Error(t, err)
+}
@@ -1,8 +1,10 @@
 package vault
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strings"
 
 	vault "github.com/hashicorp/vault/api"
 )
@@ -11,6 +13,8 @@ import (
 type Client struct {
 	Client *vault.Client
 	Token  string
+
+	login *kubernetesLogin
 }
 
 // NewClient return a Vault client with token and address configured
@@ -23,41 +27,256 @@ func NewClient(address, tokenPath string) (Client, error) {
 	return Client{Client: vc, Token: tokenPath}, nil
 }
 
+// NewKubernetesClient return a Vault client logged in with the Kubernetes
+// auth method, using a service account token read from jwtPath
+func NewKubernetesClient(address, mount, role, jwtPath string) (Client, error) {
+	vc, err := vault.NewClient(&vault.Config{Address: address})
+	if err != nil {
+		return Client{}, err
+	}
+
+	jwt, err := ioutil.ReadFile(jwtPath)
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to read service account token: %s", err)
+	}
+
+	secret, err := vc.Logical().Write(fmt.Sprintf("auth/%s/login", mount), map[string]interface{}{
+		"role": role,
+		"jwt":  string(jwt),
+	})
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to login with kubernetes auth method: %s", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return Client{}, fmt.Errorf("failed to login with kubernetes auth method: no token returned")
+	}
+	vc.SetToken(secret.Auth.ClientToken)
+
+	return Client{Client: vc}, nil
+}
+
+// FallbackError is returned along with a fallback value describing why a
+// secret couldn't be read, the fallback value is injected in place of the secret
+type FallbackError struct {
+	Message string
+}
+
+func (e FallbackError) Error() string {
+	return e.Message
+}
+
+// Fallback returns true as the error comes with a fallback value
+func (e FallbackError) Fallback() bool {
+	return true
+}
+
+// fallback returns a message as fallback value with a FallbackError
+func fallback(format string, a ...interface{}) (string, int, error) {
+	msg := fmt.Sprintf(format, a...)
+	return msg, 0, FallbackError{Message: msg}
+}
+
 // Read return a secret at a path and key from Vault
 func (c Client) Read(path, key string) (string, error) {
+	value, _, err := c.ReadVersion(path, key)
+	return value, err
+}
+
+// ReadVersion return a secret at a path and key from Vault
+// with the KV version it was read at
+func (c Client) ReadVersion(path, key string) (string, int, error) {
 
 	// Load token from disk
 	err := c.refreshToken()
 	if err != nil {
-		return "", fmt.Errorf("failed to refresh token: %s", err)
+		return "", 0, fmt.Errorf("failed to refresh token: %s", err)
 	}
 
 	// Read vault secret
 	secret, err := c.Client.Logical().Read(path)
 	if err != nil {
-		return fmt.Sprintf("failed to read secret at %q: %s", path, err), nil
+		return fallback("failed to read secret at %q: %s", path, err)
 	}
 	if secret == nil {
-		return fmt.Sprintf("secret %q does not exist in Vault", path), nil
+		return fallback("secret %q does not exist in Vault", path)
 	}
 
 	// Check data key for KV2 is present
 	_, ok := secret.Data["data"]
 	if !ok {
-		return fmt.Sprintf("failed to read secret at %q: no data returned", path), nil
+		return fallback("failed to read secret at %q: no data returned", path)
 	}
 
 	// Check if requested key is present
 	data, ok := secret.Data["data"].(map[string]interface{})[key]
 	if !ok || data == nil {
-		return fmt.Sprintf("key %q not found in Vault", key), nil
+		return fallback("key %q not found in Vault", key)
+	}
+
+	value, ok := data.(string)
+	if !ok {
+		return fallback("key %q is not a string in Vault", key)
+	}
+
+	return value, secretVersion(secret), nil
+}
+
+// casRetries is the number of check-and-set writes attempted on conflicts
+const casRetries = 3
+
+// ReadOrCreate returns the value of a KV2 secret key, or writes value in the
+// key if it doesn't exist. Writes use check-and-set with the version read so
+// that concurrent writers don't overwrite each other, the value stored first
+// is returned on conflicts. created is true if value was written.
+func (c Client) ReadOrCreate(path, key, value string) (string, int, bool, error) {
+
+	// Load token from disk
+	err := c.refreshToken()
+	if err != nil {
+		return "", 0, false, fmt.Errorf("failed to refresh token: %s", err)
+	}
+
+	for i := 0; i < casRetries; i++ {
+		secret, err := c.Client.Logical().Read(path)
+		if err != nil {
+			return "", 0, false, fmt.Errorf("failed to read secret at %q: %s", path, err)
+		}
+
+		// Missing secrets are created with version 0
+		data := map[string]interface{}{}
+		version := 0
+		if secret != nil {
+			if d, ok := secret.Data["data"].(map[string]interface{}); ok {
+				data = d
+			}
+			version = secretVersion(secret)
+		}
+
+		if existing, ok := data[key]; ok && existing != nil {
+			stored, ok := existing.(string)
+			if !ok {
+				return "", 0, false, fmt.Errorf("key %q is not a string in Vault", key)
+			}
+			return stored, version, false, nil
+		}
+
+		data[key] = value
+		written, err := c.Client.Logical().Write(path, map[string]interface{}{
+			"data":    data,
+			"options": map[string]interface{}{"cas": version},
+		})
+		if err != nil && strings.Contains(err.Error(), "check-and-set") {
+			continue
+		}
+		if err != nil {
+			return "", 0, false, fmt.Errorf("failed to write secret at %q: %s", path, err)
+		}
+
+		writtenVersion := 0
+		if written != nil {
+			if v, ok := written.Data["version"].(json.Number); ok {
+				n, _ := v.Int64()
+				writtenVersion = int(n)
+			}
+		}
+
+		return value, writtenVersion, true, nil
+	}
+
+	return "", 0, false, fmt.Errorf("failed to write secret at %q: check-and-set conflicts after %d attempts", path, casRetries)
+}
+
+// secretVersion returns the KV2 version of a secret, 0 if unknown
+func secretVersion(secret *vault.Secret) int {
+	metadata, ok := secret.Data["metadata"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+
+	version, ok := metadata["version"].(json.Number)
+	if !ok {
+		return 0
+	}
+
+	v, err := version.Int64()
+	if err != nil {
+		return 0
+	}
+
+	return int(v)
+}
+
+// Exists returns true if a KV2 secret exists at path, by reading its
+// metadata so that secret values are never retrieved
+func (c Client) Exists(path string) (bool, error) {
+
+	// Load token from disk
+	err := c.refreshToken()
+	if err != nil {
+		return false, fmt.Errorf("failed to refresh token: %s", err)
+	}
+
+	// KV2 metadata path of the secret
+	if !strings.Contains(path, "/data/") {
+		return false, fmt.Errorf("path %q is not a KV2 data path", path)
+	}
+	metadataPath := strings.Replace(path, "/data/", "/metadata/", 1)
+
+	metadata, err := c.Client.Logical().Read(metadataPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read secret metadata at %q: %s", metadataPath, err)
 	}
 
-	return data.(string), nil
+	return metadata != nil, nil
 }
 
-// refreshToken re-read Vault token from disk and update it in Client
+// CurrentVersion returns the current version of a KV2 secret at path, by
+// reading its metadata so that secret values are never retrieved
+func (c Client) CurrentVersion(path string) (int, error) {
+
+	// Load token from disk
+	err := c.refreshToken()
+	if err != nil {
+		return 0, fmt.Errorf("failed to refresh token: %s", err)
+	}
+
+	// KV2 metadata path of the secret
+	if !strings.Contains(path, "/data/") {
+		return 0, fmt.Errorf("path %q is not a KV2 data path", path)
+	}
+	metadataPath := strings.Replace(path, "/data/", "/metadata/", 1)
+
+	metadata, err := c.Client.Logical().Read(metadataPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read secret metadata at %q: %s", metadataPath, err)
+	}
+	if metadata == nil {
+		return 0, fmt.Errorf("secret %q does not exist in Vault", path)
+	}
+
+	version, ok := metadata.Data["current_version"].(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("secret metadata at %q has no current version", metadataPath)
+	}
+	v, err := version.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse current version of %q: %s", path, err)
+	}
+
+	return int(v), nil
+}
+
+// refreshToken re-read Vault token from disk and update it in Client,
+// clients logged in without token file keep their token and endpoint
+// clients with Kubernetes auth log in again when it expires
 func (c Client) refreshToken() error {
+	if c.login != nil {
+		return c.login.refresh(c.Client)
+	}
+	if c.Token == "" {
+		return nil
+	}
+
 	token, err := ioutil.ReadFile(c.Token)
 	if err != nil {
 		return fmt.Errorf("failed to read token file: %s", err)
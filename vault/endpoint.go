@@ -0,0 +1,174 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// defaultJWTPath is the service account token used by Kubernetes auth
+const defaultJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// EndpointConfig configures a named Vault endpoint with its own
+// authentication and TLS settings
+type EndpointConfig struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+
+	// Namespaces are the path globs of namespaces whose secrets may resolve
+	// placeholders from the endpoint, by endpoint prefix or route
+	Namespaces []string `json:"namespaces"`
+
+	// Token is the path of a token file, such as one written by a Vault
+	// agent, re-read before each request
+	Token string `json:"token,omitempty"`
+
+	// Kubernetes logs in with the Kubernetes auth method instead of a token
+	Kubernetes *KubernetesAuth `json:"kubernetes,omitempty"`
+
+	TLS TLSConfig `json:"tls,omitempty"`
+}
+
+// KubernetesAuth configures the Kubernetes auth method login of an endpoint
+type KubernetesAuth struct {
+	Mount   string `json:"mount"`
+	Role    string `json:"role"`
+	JWTPath string `json:"jwtPath,omitempty"`
+}
+
+// TLSConfig configures TLS connections to an endpoint
+type TLSConfig struct {
+	CACert        string `json:"caCert,omitempty"`
+	ClientCert    string `json:"clientCert,omitempty"`
+	ClientKey     string `json:"clientKey,omitempty"`
+	TLSServerName string `json:"serverName,omitempty"`
+	Insecure      bool   `json:"insecure,omitempty"`
+}
+
+// Validate returns an error if the endpoint configuration is incomplete
+func (e EndpointConfig) Validate() error {
+	if e.Address == "" {
+		return errors.New("address is required")
+	}
+	if len(e.Namespaces) == 0 {
+		return errors.New("namespaces are required")
+	}
+	for _, pattern := range e.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid namespace pattern %q: %s", pattern, err)
+		}
+	}
+	if (e.Token == "") == (e.Kubernetes == nil) {
+		return errors.New("exactly one of token or kubernetes auth is required")
+	}
+	if e.Kubernetes != nil && (e.Kubernetes.Mount == "" || e.Kubernetes.Role == "") {
+		return errors.New("kubernetes auth requires mount and role")
+	}
+	if (e.TLS.ClientCert == "") != (e.TLS.ClientKey == "") {
+		return errors.New("tls clientCert and clientKey must be set together")
+	}
+
+	return nil
+}
+
+// NewEndpointClient returns a Vault client of an endpoint, clients with
+// Kubernetes auth log in on first request and again when their token expires
+func NewEndpointClient(e EndpointConfig) (Client, error) {
+	err := e.Validate()
+	if err != nil {
+		return Client{}, fmt.Errorf("vault endpoint %q is invalid: %s", e.Name, err)
+	}
+
+	config := vault.DefaultConfig()
+	config.Address = e.Address
+	err = config.ConfigureTLS(&vault.TLSConfig{
+		CACert:        e.TLS.CACert,
+		ClientCert:    e.TLS.ClientCert,
+		ClientKey:     e.TLS.ClientKey,
+		TLSServerName: e.TLS.TLSServerName,
+		Insecure:      e.TLS.Insecure,
+	})
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to configure tls of vault endpoint %q: %s", e.Name, err)
+	}
+
+	vc, err := vault.NewClient(config)
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to create client of vault endpoint %q: %s", e.Name, err)
+	}
+
+	client := Client{Client: vc, Token: e.Token}
+	if e.Kubernetes != nil {
+		auth := *e.Kubernetes
+		if auth.JWTPath == "" {
+			auth.JWTPath = defaultJWTPath
+		}
+		client.login = &kubernetesLogin{auth: auth}
+	}
+
+	return client, nil
+}
+
+// kubernetesLogin holds the Kubernetes auth token of a client, shared by
+// client copies
+type kubernetesLogin struct {
+	auth KubernetesAuth
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+// refresh logs in with the Kubernetes auth method if the token is missing
+// or has expired, tokens are renewed when 80% of their TTL has passed
+func (l *kubernetesLogin) refresh(vc *vault.Client) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.expires.IsZero() && time.Now().Before(l.expires) {
+		return nil
+	}
+
+	jwt, err := ioutil.ReadFile(l.auth.JWTPath)
+	if err != nil {
+		return fmt.Errorf("failed to read service account token: %s", err)
+	}
+
+	secret, err := vc.Logical().Write(fmt.Sprintf("auth/%s/login", l.auth.Mount), map[string]interface{}{
+		"role": l.auth.Role,
+		"jwt":  string(jwt),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to login with kubernetes auth method: %s", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return errors.New("failed to login with kubernetes auth method: no token returned")
+	}
+	vc.SetToken(secret.Auth.ClientToken)
+
+	ttl := time.Duration(secret.Auth.LeaseDuration) * time.Second
+	l.expires = time.Now().Add(ttl * 8 / 10)
+
+	return nil
+}
+
+// Health returns an error if Vault is unreachable, sealed or uninitialized,
+// standby nodes are healthy
+func (c Client) Health() error {
+	health, err := c.Client.Sys().Health()
+	if err != nil {
+		return fmt.Errorf("failed to check vault health: %s", err)
+	}
+	if !health.Initialized {
+		return errors.New("vault is not initialized")
+	}
+	if health.Sealed {
+		return errors.New("vault is sealed")
+	}
+
+	return nil
+}
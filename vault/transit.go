@@ -0,0 +1,50 @@
+package vault
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// TransitClient decrypts ciphertexts with the Vault transit secrets engine,
+// placeholders are "vault-transit:<key name>#<ciphertext>" with key names
+// templated with Pattern so that namespaces only use their own keys
+type TransitClient struct {
+	Vault   Client
+	Mount   string
+	Pattern string
+}
+
+// Read returns the plaintext of a ciphertext encrypted with a transit key
+func (c TransitClient) Read(name, ciphertext string) (string, error) {
+
+	// Load token from disk
+	err := c.Vault.refreshToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh token: %s", err)
+	}
+
+	path := fmt.Sprintf("%s/decrypt/%s", c.Mount, name)
+	secret, err := c.Vault.Client.Logical().Write(path, map[string]interface{}{"ciphertext": ciphertext})
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt with transit key %q: %s", name, err)
+	}
+	if secret == nil {
+		return "", fmt.Errorf("failed to decrypt with transit key %q: no data returned", name)
+	}
+
+	encoded, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return "", fmt.Errorf("failed to decrypt with transit key %q: no plaintext returned", name)
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode plaintext of transit key %q: %s", name, err)
+	}
+
+	return string(plaintext), nil
+}
+
+// PathPattern returns the pattern transit key names are templated with
+func (c TransitClient) PathPattern() string {
+	return c.Pattern
+}